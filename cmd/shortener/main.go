@@ -1,20 +1,28 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
 
 	"github.com/romm80/shortener.git/internal/app/handlers"
+	"github.com/romm80/shortener.git/internal/app/logger"
 	"github.com/romm80/shortener.git/internal/app/server"
+	"github.com/romm80/shortener.git/internal/app/service/tracing"
 
 	_ "github.com/golang-migrate/migrate/v4/database/postgres"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 )
 
+// shutdownTimeout - period to finish accepted deletions
+const shutdownTimeout = 10 * time.Second
+
 var (
 	buildVersion = "N/A"
 	buildDate    = "N/A"
@@ -22,18 +30,35 @@ var (
 )
 
 func main() {
+	srv, err := server.NewServer()
+	if err != nil {
+		logger.Default().Fatal("config", "error", err)
+	}
+	if server.Cfg.PrintConfig {
+		if err := server.WriteConfig(os.Stdout, server.Cfg); err != nil {
+			logger.Default().Fatal("print config", "error", err)
+		}
+		return
+	}
+
 	fmt.Printf("Build version: %s\n", buildVersion)
 	fmt.Printf("Build date:: %s\n", buildDate)
 	fmt.Printf("Build commit: %s\n", buildCommit)
-
-	srv, err := server.NewServer()
+	// the level is validated by the config
+	level, _ := logger.ParseLevel(server.Cfg.LogLevel)
+	logger.SetDefault(logger.New(os.Stdout, level))
+	if level > logger.LevelDebug {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	exporter, err := tracing.NewExporter(server.Cfg.TraceExporter, server.Cfg.TraceFile)
 	if err != nil {
-		log.Fatal(err)
+		logger.Default().Fatal("trace exporter", "error", err)
 	}
+	tracing.SetDefault(tracing.NewTracer(exporter))
 
 	handler, err := handlers.New()
 	if err != nil {
-		log.Fatal(err)
+		logger.Default().Fatal("init", "error", err)
 	}
 
 	done := make(chan os.Signal, 1)
@@ -41,10 +66,27 @@ func main() {
 
 	go func() {
 		if err := srv.Run(handler.Router); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("listen: %s\n", err)
+			logger.Default().Fatal("listen", "error", err)
+		}
+	}()
+	go func() {
+		if err := srv.RunAdmin(handler.AdminRouter); err != nil && err != http.ErrServerClosed {
+			logger.Default().Fatal("admin listen", "error", err)
 		}
 	}()
 
 	<-done
+	// load balancers stop sending requests after the readiness probe fails
+	handler.Drain()
+	time.Sleep(server.Cfg.ShutdownDelay)
 	srv.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := handler.Close(ctx); err != nil {
+		logger.Default().Error("background workers are not stopped", "error", err)
+	}
+	if err := tracing.Default().Close(); err != nil {
+		logger.Default().Error("trace exporter is not closed", "error", err)
+	}
 }
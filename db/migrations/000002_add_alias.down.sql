@@ -0,0 +1,6 @@
+DELETE FROM urls_id WHERE alias;
+
+DROP INDEX IF EXISTS original_url;
+CREATE UNIQUE INDEX IF NOT EXISTS original_url ON urls_id (url);
+
+ALTER TABLE urls_id DROP COLUMN IF EXISTS alias;
@@ -0,0 +1,4 @@
+ALTER TABLE urls_id ADD COLUMN IF NOT EXISTS alias boolean NOT NULL DEFAULT false;
+
+DROP INDEX IF EXISTS original_url;
+CREATE UNIQUE INDEX IF NOT EXISTS original_url ON urls_id (url) WHERE NOT alias;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS expires_at;
+
+ALTER TABLE urls_id DROP COLUMN IF EXISTS expires_at;
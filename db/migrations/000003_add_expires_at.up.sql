@@ -0,0 +1,3 @@
+ALTER TABLE urls_id ADD COLUMN IF NOT EXISTS expires_at timestamptz;
+
+CREATE INDEX IF NOT EXISTS expires_at ON urls_id (expires_at) WHERE expires_at IS NOT NULL AND NOT deleted;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS clicks_url_id_clicked_at;
+DROP TABLE IF EXISTS clicks;
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS clicks
+(
+    id bigint PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+    url_id character varying NOT NULL,
+    clicked_at timestamptz NOT NULL,
+    referrer character varying NOT NULL DEFAULT '',
+    user_agent character varying NOT NULL DEFAULT '',
+    ip character varying NOT NULL DEFAULT '',
+    CONSTRAINT url_id FOREIGN KEY (url_id)
+        REFERENCES urls_id (url_id) MATCH SIMPLE
+        ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS clicks_url_id_clicked_at ON clicks (url_id, clicked_at);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS user_url;
+DROP INDEX IF EXISTS user_created_at;
+
+ALTER TABLE urls_id DROP COLUMN IF EXISTS created_at;
@@ -0,0 +1,4 @@
+ALTER TABLE urls_id ADD COLUMN IF NOT EXISTS created_at timestamptz NOT NULL DEFAULT now();
+
+CREATE INDEX IF NOT EXISTS user_created_at ON urls_id (user_id, created_at, url_id);
+CREATE INDEX IF NOT EXISTS user_url ON urls_id (user_id, url, url_id);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS url_history_url_id;
+DROP TABLE IF EXISTS url_history;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS url_history
+(
+    id bigint PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+    url_id character varying NOT NULL,
+    url character varying NOT NULL,
+    replaced_at timestamptz NOT NULL DEFAULT now(),
+    CONSTRAINT url_id FOREIGN KEY (url_id)
+        REFERENCES urls_id (url_id) MATCH SIMPLE
+        ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS url_history_url_id ON url_history (url_id, replaced_at);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS deleted_at;
+
+ALTER TABLE urls_id DROP COLUMN IF EXISTS deleted_at;
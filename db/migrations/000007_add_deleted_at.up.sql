@@ -0,0 +1,4 @@
+ALTER TABLE urls_id ADD COLUMN IF NOT EXISTS deleted_at timestamptz;
+UPDATE urls_id SET deleted_at = now() WHERE deleted AND deleted_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS deleted_at ON urls_id (deleted_at) WHERE deleted;
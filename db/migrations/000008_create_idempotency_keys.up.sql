@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys
+(
+    user_id bigint NOT NULL,
+    key character varying NOT NULL,
+    request_hash character varying NOT NULL,
+    expires_at timestamptz NOT NULL,
+    status integer,
+    content_type character varying,
+    body bytea,
+    PRIMARY KEY (user_id, key),
+    CONSTRAINT user_id FOREIGN KEY (user_id)
+        REFERENCES users (id) MATCH SIMPLE
+        ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at ON idempotency_keys (expires_at);
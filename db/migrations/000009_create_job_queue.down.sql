@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS job_queue_kind_available_at;
+DROP TABLE IF EXISTS job_queue;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS job_queue
+(
+    id bigserial PRIMARY KEY,
+    kind character varying NOT NULL,
+    payload bytea NOT NULL,
+    attempts integer NOT NULL DEFAULT 0,
+    available_at timestamptz NOT NULL DEFAULT now(),
+    last_error character varying,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS job_queue_kind_available_at ON job_queue (kind, available_at);
@@ -0,0 +1,7 @@
+-- of the links of the same original link the live or the latest deleted one is kept
+DELETE FROM urls_id d USING urls_id l
+WHERE d.url = l.url AND d.url_id <> l.url_id AND NOT d.alias AND NOT l.alias AND d.deleted
+    AND (NOT l.deleted OR l.deleted_at > d.deleted_at OR (l.deleted_at = d.deleted_at AND l.url_id > d.url_id));
+
+DROP INDEX IF EXISTS original_url;
+CREATE UNIQUE INDEX IF NOT EXISTS original_url ON urls_id (url) WHERE NOT alias;
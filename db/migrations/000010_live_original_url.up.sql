@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS original_url;
+CREATE UNIQUE INDEX IF NOT EXISTS original_url ON urls_id (url) WHERE NOT alias AND NOT deleted;
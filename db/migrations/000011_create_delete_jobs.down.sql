@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS delete_jobs_finished_at;
+DROP TABLE IF EXISTS delete_jobs;
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS delete_jobs
+(
+    id character varying PRIMARY KEY,
+    user_id bigint NOT NULL,
+    status character varying NOT NULL,
+    urls_id character varying[] NOT NULL,
+    deleted character varying[],
+    skipped character varying[],
+    error character varying NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL,
+    finished_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS delete_jobs_finished_at ON delete_jobs (finished_at);
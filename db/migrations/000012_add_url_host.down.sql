@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS user_host;
+ALTER TABLE urls_id DROP COLUMN IF EXISTS host;
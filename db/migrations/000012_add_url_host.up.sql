@@ -0,0 +1,4 @@
+ALTER TABLE urls_id ADD COLUMN IF NOT EXISTS host character varying
+    GENERATED ALWAYS AS (lower(substring(url from '^[^:]+://(?:[^/:?#@]+@)?([^/:?#]+)'))) STORED;
+
+CREATE INDEX IF NOT EXISTS user_host ON urls_id (user_id, host);
@@ -2,8 +2,8 @@
 package app
 
 import (
+	"context"
 	"errors"
-	"log"
 	"net/http"
 )
 
@@ -12,19 +12,47 @@ var (
 	ErrEmptyRequest  = errors.New("empty request")
 	ErrDeletedURL    = errors.New("url deleted")
 	ErrLinkNoFound   = errors.New("link not found by id")
+	ErrInvalidAlias  = errors.New("invalid alias")
+	ErrAliasTaken    = errors.New("alias already taken")
+	ErrExpiredURL    = errors.New("url expired")
+	ErrForbidden     = errors.New("link belongs to another user")
+
+	ErrInvalidExpiration = errors.New("invalid expiration")
+	ErrInvalidQuery      = errors.New("invalid query")
+	ErrNotSupported      = errors.New("not supported by the storage")
+	ErrMalformedItem     = errors.New("malformed item")
+	ErrJobNotFound       = errors.New("job not found")
+	ErrQueueFull         = errors.New("queue is full")
+	ErrMigrationVersion  = errors.New("unexpected migration version")
+
+	ErrInvalidIdempotencyKey = errors.New("invalid idempotency key")
+	ErrIdempotencyMismatch   = errors.New("idempotency key is used by another request")
+	ErrRequestInProgress     = errors.New("request with the idempotency key is in progress")
 )
 
 // ErrStatusCode returns http response code depending on error type
 func ErrStatusCode(err error) int {
-	log.Println(err)
-
 	switch {
-	case errors.Is(err, ErrConflictURLID):
+	case errors.Is(err, ErrConflictURLID) || errors.Is(err, ErrAliasTaken) || errors.Is(err, ErrRequestInProgress):
 		return http.StatusConflict
-	case errors.Is(err, ErrEmptyRequest) || errors.Is(err, ErrLinkNoFound):
+	case errors.Is(err, ErrEmptyRequest) || errors.Is(err, ErrLinkNoFound) || errors.Is(err, ErrInvalidAlias) ||
+		errors.Is(err, ErrInvalidExpiration) || errors.Is(err, ErrInvalidQuery) || errors.Is(err, ErrMalformedItem) ||
+		errors.Is(err, ErrInvalidIdempotencyKey):
 		return http.StatusBadRequest
-	case errors.Is(err, ErrDeletedURL):
+	case errors.Is(err, ErrIdempotencyMismatch):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrJobNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, ErrDeletedURL) || errors.Is(err, ErrExpiredURL):
 		return http.StatusGone
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, ErrNotSupported):
+		return http.StatusNotImplemented
+	case errors.Is(err, ErrQueueFull):
+		return http.StatusServiceUnavailable
 	default:
 		return http.StatusInternalServerError
 	}
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/romm80/shortener.git/internal/app/server"
+)
+
+// NewAdminMiddleware returns the middleware allowing admin requests from the trusted subnet and with the admin
+// credentials of the config, only the configured checks are applied
+func NewAdminMiddleware(cfg server.Config) (gin.HandlerFunc, error) {
+	var subnet *net.IPNet
+	if cfg.AdminTrustedSubnet != "" {
+		var err error
+		if _, subnet, err = net.ParseCIDR(cfg.AdminTrustedSubnet); err != nil {
+			return nil, err
+		}
+	}
+	adminUser, adminPassword := []byte(cfg.AdminUser), []byte(cfg.AdminPassword)
+
+	return func(c *gin.Context) {
+		if subnet != nil {
+			// the peer address, forwarded headers can be forged by the client
+			host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+			if err != nil {
+				host = c.Request.RemoteAddr
+			}
+			if ip := net.ParseIP(host); ip == nil || !subnet.Contains(ip) {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+		}
+
+		if len(adminUser) > 0 {
+			user, password, ok := c.Request.BasicAuth()
+			userMatch := subtle.ConstantTimeCompare([]byte(user), adminUser) == 1
+			passwordMatch := subtle.ConstantTimeCompare([]byte(password), adminPassword) == 1
+			if !ok || !userMatch || !passwordMatch {
+				c.Header("WWW-Authenticate", `Basic realm="admin"`)
+				c.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+		}
+		c.Next()
+	}, nil
+}
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caarlos0/env/v6"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/romm80/shortener.git/internal/app/server"
+)
+
+func TestShortener_AdminRouter(t *testing.T) {
+	server.Cfg.DBType = server.DBMap
+
+	if err := env.Parse(&server.Cfg); err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		server.Cfg.AdminUser = ""
+		server.Cfg.AdminPassword = ""
+		server.Cfg.AdminTrustedSubnet = ""
+	}()
+
+	tests := []struct {
+		name       string
+		public     bool
+		path       string
+		subnet     string
+		user       string
+		remoteAddr string
+		auth       []string
+		status     int
+	}{
+		{name: "pprof is not public", public: true, path: "/debug/pprof/", status: http.StatusNotFound},
+		{name: "metrics are not public", public: true, path: "/metrics", status: http.StatusBadRequest},
+		{name: "probes are not public", public: true, path: "/readyz", status: http.StatusBadRequest},
+		{name: "no checks", path: "/debug/pprof/", status: http.StatusOK},
+		{name: "trusted subnet", path: "/healthz", subnet: "10.0.0.0/8",
+			remoteAddr: "10.1.2.3:5000", status: http.StatusOK},
+		{name: "untrusted subnet", path: "/healthz", subnet: "10.0.0.0/8",
+			remoteAddr: "192.0.2.1:5000", status: http.StatusForbidden},
+		{name: "basic auth", path: "/healthz", user: "admin",
+			auth: []string{"admin", "secret"}, status: http.StatusOK},
+		{name: "wrong password", path: "/healthz", user: "admin",
+			auth: []string{"admin", "guess"}, status: http.StatusUnauthorized},
+		{name: "no credentials", path: "/healthz", user: "admin", status: http.StatusUnauthorized},
+		{name: "both checks", path: "/healthz", subnet: "10.0.0.0/8", user: "admin",
+			remoteAddr: "192.0.2.1:5000", auth: []string{"admin", "secret"}, status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the checks are configured when the handler is built
+			server.Cfg.AdminTrustedSubnet = tt.subnet
+			server.Cfg.AdminUser = tt.user
+			server.Cfg.AdminPassword = "secret"
+			handler, err := New()
+			require.NoError(t, err)
+			t.Cleanup(func() { handler.Close(context.Background()) })
+			router := handler.AdminRouter
+			if tt.public {
+				router = handler.Router
+			}
+
+			request := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.remoteAddr != "" {
+				request.RemoteAddr = tt.remoteAddr
+			}
+			if tt.auth != nil {
+				request.SetBasicAuth(tt.auth[0], tt.auth[1])
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, request)
+			result := w.Result()
+			require.NoError(t, result.Body.Close())
+			assert.Equal(t, tt.status, result.StatusCode)
+		})
+	}
+
+	_, err := NewAdminMiddleware(server.Config{AdminTrustedSubnet: "10.0.0.0"})
+	assert.Error(t, err)
+}
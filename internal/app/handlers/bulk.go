@@ -0,0 +1,287 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/romm80/shortener.git/internal/app"
+	"github.com/romm80/shortener.git/internal/app/logger"
+	"github.com/romm80/shortener.git/internal/app/models"
+	"github.com/romm80/shortener.git/internal/app/server"
+)
+
+const (
+	bulkChunkSize   = 1000    // number of items stored at once
+	bulkMaxLineSize = 1 << 20 // maximum size of the NDJSON line
+
+	mimeNDJSON = "application/x-ndjson"
+	mimeCSV    = "text/csv"
+)
+
+// bulkItem bulk request item, a malformed item has the reason it is invalid
+type bulkItem struct {
+	models.RequestBatch
+	invalid error
+}
+
+// bulkReader reads bulk request items one by one
+type bulkReader interface {
+	Read() (bulkItem, error)
+}
+
+// bulkWriter writes bulk response items
+type bulkWriter interface {
+	Write(item models.ResponseBatch) error
+	Flush() error
+}
+
+// BulkURLs godoc
+// @Summary      Adds links from a stream
+// @Description  Shortens links of the NDJSON or CSV request body incrementally and streams results in the same order and format.
+// @Description  NDJSON lines are batch items, CSV rows are "correlation_id,original_url[,ttl]" with an optional header row.
+// @Description  Every item gets its own status: created, existing or invalid with the error message.
+// @Description  A failure after the response is started ends the stream with the aborted record
+// @Accept       x-ndjson,csv
+// @Produce      x-ndjson,csv
+// @Param RequestURL body models.RequestBatch true "original links, one per line"
+// @Success 200 {object} models.ResponseBatch "short links, one per line"
+// @Failure 415 {string} string "unsupported content type"
+// @Router       /api/shorten/bulk [post]
+func (s *Shortener) BulkURLs(c *gin.Context) {
+	mediaType, _, _ := mime.ParseMediaType(c.ContentType())
+	if mediaType != mimeNDJSON && mediaType != mimeCSV {
+		c.AbortWithStatus(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// HTTP/1.x server closes the request body once the response is flushed,
+	// so the body is read before the first chunk is answered
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	var reader bulkReader
+	var writer bulkWriter
+	if mediaType == mimeNDJSON {
+		reader = newNDJSONReader(bytes.NewReader(body))
+		writer = newNDJSONWriter(c.Writer)
+	} else {
+		reader = newCSVReader(bytes.NewReader(body))
+		writer = newCSVWriter(c.Writer)
+	}
+
+	c.Header("Content-Type", mediaType)
+	c.Status(http.StatusOK)
+
+	userID := c.GetUint64("userid")
+	chunk := make([]models.RequestBatch, 0, bulkChunkSize)
+	results := make([]models.ResponseBatch, 0, bulkChunkSize)
+	for {
+		item, err := reader.Read()
+		if err == nil {
+			if item.invalid == nil {
+				item.invalid = validBatchItem(&item.RequestBatch)
+			}
+			results = append(results, models.ResponseBatch{CorrelationID: item.CorrelationID})
+			if item.invalid != nil {
+				results[len(results)-1].Status = models.BatchInvalid
+				results[len(results)-1].Error = item.invalid.Error()
+			} else {
+				chunk = append(chunk, item.RequestBatch)
+			}
+		}
+		if len(results) < bulkChunkSize && err == nil {
+			continue
+		}
+
+		if err := s.storeBulkChunk(c, chunk, results, userID); err != nil {
+			abortBulk(c, writer, err, "items are not stored")
+			return
+		}
+		for _, v := range results {
+			if err := writer.Write(v); err != nil {
+				c.Error(err)
+				return
+			}
+		}
+		if err := writer.Flush(); err != nil {
+			c.Error(err)
+			return
+		}
+		c.Writer.Flush()
+
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			// the items read before the failure are answered, the rest of the body is skipped
+			abortBulk(c, writer, err, err.Error())
+			return
+		}
+		chunk = chunk[:0]
+		results = results[:0]
+	}
+}
+
+// abortBulk ends the started response with the aborted record, so the client can tell the cut off stream
+// from the complete one. The message is sent to the client, the error is logged
+func abortBulk(c *gin.Context, writer bulkWriter, err error, message string) {
+	c.Error(err)
+	if writer.Write(models.ResponseBatch{Status: models.BatchAborted, Error: message}) != nil {
+		return
+	}
+	if writer.Flush() == nil {
+		c.Writer.Flush()
+	}
+}
+
+// storeBulkChunk stores valid items of the chunk and fills in their results
+func (s *Shortener) storeBulkChunk(c *gin.Context, chunk []models.RequestBatch, results []models.ResponseBatch, userID uint64) error {
+	if len(chunk) == 0 {
+		return nil
+	}
+	ctx, cancel := storageContext(c, server.Cfg.StorageBatchTimeout)
+	defer cancel()
+	stored, err := s.Storage.AddBatch(ctx, chunk, userID)
+	if err != nil {
+		logger.FromContext(ctx).Error("bulk chunk is not stored", "items", len(chunk), "error", err)
+		return err
+	}
+
+	i := 0
+	for pos := range results {
+		if results[pos].Status == models.BatchInvalid {
+			continue
+		}
+		results[pos] = stored[i]
+		i++
+	}
+	return nil
+}
+
+type ndjsonReader struct {
+	scanner *bufio.Scanner
+}
+
+func newNDJSONReader(r io.Reader) *ndjsonReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), bulkMaxLineSize)
+	return &ndjsonReader{scanner: scanner}
+}
+
+func (r *ndjsonReader) Read() (bulkItem, error) {
+	var item bulkItem
+	for r.scanner.Scan() {
+		line := r.scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(line, &item.RequestBatch); err != nil {
+			item.invalid = fmt.Errorf("%w: %v", app.ErrMalformedItem, err)
+		}
+		return item, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return item, err
+	}
+	return item, io.EOF
+}
+
+type ndjsonWriter struct {
+	writer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+func newNDJSONWriter(w io.Writer) *ndjsonWriter {
+	writer := bufio.NewWriter(w)
+	return &ndjsonWriter{writer: writer, encoder: json.NewEncoder(writer)}
+}
+
+func (w *ndjsonWriter) Write(item models.ResponseBatch) error {
+	return w.encoder.Encode(item)
+}
+
+func (w *ndjsonWriter) Flush() error {
+	return w.writer.Flush()
+}
+
+type csvReader struct {
+	reader *csv.Reader
+	first  bool
+}
+
+func newCSVReader(r io.Reader) *csvReader {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	return &csvReader{reader: reader, first: true}
+}
+
+func (r *csvReader) Read() (bulkItem, error) {
+	var item bulkItem
+	for {
+		record, err := r.reader.Read()
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			r.first = false
+			item.invalid = fmt.Errorf("%w: %v", app.ErrMalformedItem, err)
+			return item, nil
+		}
+		if err != nil {
+			return item, err
+		}
+		if r.first {
+			r.first = false
+			if record[0] == "correlation_id" {
+				continue
+			}
+		}
+
+		item.CorrelationID = record[0]
+		if len(record) < 2 || len(record) > 3 {
+			item.invalid = fmt.Errorf("%w: row must have 2 or 3 fields, got %d", app.ErrMalformedItem, len(record))
+			return item, nil
+		}
+		item.OriginalURL = record[1]
+		if len(record) == 3 {
+			item.TTL = record[2]
+		}
+		return item, nil
+	}
+}
+
+type csvWriter struct {
+	writer *csv.Writer
+	header bool
+}
+
+func newCSVWriter(w io.Writer) *csvWriter {
+	return &csvWriter{writer: csv.NewWriter(w)}
+}
+
+func (w *csvWriter) Write(item models.ResponseBatch) error {
+	if !w.header {
+		w.header = true
+		if err := w.writer.Write([]string{"correlation_id", "short_url", "status", "error"}); err != nil {
+			return err
+		}
+	}
+	return w.writer.Write([]string{item.CorrelationID, item.ShortURL, string(item.Status), item.Error})
+}
+
+func (w *csvWriter) Flush() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
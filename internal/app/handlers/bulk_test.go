@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/caarlos0/env/v6"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/romm80/shortener.git/internal/app/models"
+	"github.com/romm80/shortener.git/internal/app/server"
+	"github.com/romm80/shortener.git/internal/app/service"
+)
+
+func TestShortener_BulkURLs(t *testing.T) {
+	server.Cfg.DBType = server.DBMap
+	server.Cfg.BaseURL = "http://127.0.0.1:8080"
+
+	if err := env.Parse(&server.Cfg); err != nil {
+		log.Fatal(err)
+	}
+	handler, err := New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	t.Cleanup(func() { handler.Close(context.Background()) })
+	google := service.BaseURL(service.ShortenURLID("https://www.google.com/"))
+	yandex := service.BaseURL(service.ShortenURLID("https://yandex.ru/"))
+
+	type want struct {
+		contentType string
+		body        string
+		status      int
+	}
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        want
+	}{
+		{
+			name:        "ndjson",
+			contentType: "application/x-ndjson",
+			body: `{"correlation_id":"1","original_url":"https://www.google.com/"}` + "\n" +
+				"\n" +
+				`{"correlation_id":"2","original_url":"https://www.google.com/"}` + "\n" +
+				`{"correlation_id":"3","original_url":` + "\n",
+			want: want{
+				status:      200,
+				contentType: "application/x-ndjson",
+				body: `{"correlation_id":"1","short_url":"` + google + `","status":"created"}` + "\n" +
+					`{"correlation_id":"2","short_url":"` + google + `","status":"existing"}` + "\n" +
+					`{"correlation_id":"","status":"invalid","error":"malformed item: unexpected end of JSON input"}` + "\n",
+			},
+		},
+		{
+			name:        "csv",
+			contentType: "text/csv; charset=utf-8",
+			body:        "correlation_id,original_url,ttl\n1,https://yandex.ru/,1h\n2,,\n3\n",
+			want: want{
+				status:      200,
+				contentType: "text/csv",
+				body: "correlation_id,short_url,status,error\n" +
+					"1," + yandex + ",created,\n" +
+					"2,,invalid,empty request: original_url is empty\n" +
+					"3,,invalid,\"malformed item: row must have 2 or 3 fields, got 1\"\n",
+			},
+		},
+		{
+			name:        "line too long",
+			contentType: "application/x-ndjson",
+			body: `{"correlation_id":"1","original_url":"https://go.dev/"}` + "\n" +
+				`{"correlation_id":"2","original_url":"https://go.dev/` + strings.Repeat("a", bulkMaxLineSize) + `"}` + "\n" +
+				`{"correlation_id":"3","original_url":"https://go.dev/doc/"}` + "\n",
+			want: want{
+				status:      200,
+				contentType: "application/x-ndjson",
+				body: `{"correlation_id":"1","short_url":"` + service.BaseURL(service.ShortenURLID("https://go.dev/")) + `","status":"created"}` + "\n" +
+					`{"correlation_id":"","status":"aborted","error":"bufio.Scanner: token too long"}` + "\n",
+			},
+		},
+		{
+			name:        "unsupported content type",
+			contentType: "application/json",
+			body:        `[]`,
+			want: want{
+				status: 415,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/api/shorten/bulk", strings.NewReader(tt.body))
+			request.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+
+			handler.Router.ServeHTTP(w, request)
+			result := w.Result()
+
+			assert.Equal(t, tt.want.status, result.StatusCode)
+			assert.Equal(t, tt.want.contentType, result.Header.Get("Content-Type"))
+
+			body, err := ioutil.ReadAll(result.Body)
+			require.NoError(t, err)
+			require.NoError(t, result.Body.Close())
+			assert.Equal(t, tt.want.body, string(body))
+		})
+	}
+}
+
+func TestShortener_BulkURLsServer(t *testing.T) {
+	server.Cfg.DBType = server.DBMap
+	server.Cfg.BaseURL = "http://127.0.0.1:8080"
+
+	if err := env.Parse(&server.Cfg); err != nil {
+		log.Fatal(err)
+	}
+	handler, err := New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	t.Cleanup(func() { handler.Close(context.Background()) })
+	ts := httptest.NewServer(handler.Router)
+	t.Cleanup(ts.Close)
+
+	// the body is larger than the server reads after the response is started
+	rows := bulkChunkSize*2 + 1
+	var body strings.Builder
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&body, "%d,https://go.dev/%d/%s\n", i, i, strings.Repeat("a", 200))
+	}
+
+	response, err := http.Post(ts.URL+"/api/shorten/bulk", "text/csv", strings.NewReader(body.String()))
+	require.NoError(t, err)
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	records, err := csv.NewReader(response.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, rows+1)
+	for i, record := range records[1:] {
+		assert.Equal(t, []string{strconv.Itoa(i), string(models.BatchCreated)}, []string{record[0], record[2]})
+	}
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/romm80/shortener.git/internal/app/models"
+	"github.com/romm80/shortener.git/internal/app/repositories"
+	"github.com/romm80/shortener.git/internal/app/server"
+	"github.com/romm80/shortener.git/internal/app/service/certificate"
+)
+
+// Drain marks the instance as not ready before the graceful shutdown
+func (s *Shortener) Drain() {
+	atomic.StoreInt32(&s.draining, 1)
+}
+
+// Healthz godoc
+// @Summary      Liveness probe
+// @Description  Reports the process is alive, does not check its dependencies
+// @Success 200 {string} string "alive"
+// @Router       /healthz [get]
+func (s *Shortener) Healthz(c *gin.Context) {
+	c.Status(http.StatusOK)
+}
+
+// Readyz godoc
+// @Summary      Readiness probe
+// @Description  Checks the storage, the schema migrations, the delete queue depth, the TLS certificate expiration
+// @Description  and the graceful shutdown. The instance is ready when no component failed
+// @Produce      json
+// @Success 200 {object} models.Readiness "ready"
+// @Failure 503 {object} models.Readiness "not ready"
+// @Router       /readyz [get]
+func (s *Shortener) Readyz(c *gin.Context) {
+	ctx, cancel := storageContext(c, server.Cfg.StorageReadTimeout)
+	defer cancel()
+
+	res := models.Readiness{
+		Ready: true,
+		Components: map[string]models.ComponentCheck{
+			"shutdown":     s.checkShutdown(),
+			"storage":      s.checkStorage(ctx),
+			"migrations":   s.checkMigrations(ctx),
+			"delete_queue": s.checkDeleteQueue(ctx),
+			"tls":          checkCertificate(),
+		},
+	}
+	for _, v := range res.Components {
+		if v.Status == models.ComponentFailed {
+			res.Ready = false
+		}
+	}
+
+	status := http.StatusOK
+	if !res.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, res)
+}
+
+func failed(err error) models.ComponentCheck {
+	return models.ComponentCheck{Status: models.ComponentFailed, Detail: err.Error()}
+}
+
+func (s *Shortener) checkShutdown() models.ComponentCheck {
+	if atomic.LoadInt32(&s.draining) != 0 {
+		return models.ComponentCheck{Status: models.ComponentFailed, Detail: "shutting down"}
+	}
+	return models.ComponentCheck{Status: models.ComponentOK}
+}
+
+func (s *Shortener) checkStorage(ctx context.Context) models.ComponentCheck {
+	if err := s.Storage.Ping(ctx); err != nil {
+		return failed(err)
+	}
+	return models.ComponentCheck{Status: models.ComponentOK}
+}
+
+func (s *Shortener) checkMigrations(ctx context.Context) models.ComponentCheck {
+	migrations, ok := repositories.Unwrap(s.Storage).(repositories.Migrations)
+	if !ok {
+		return models.ComponentCheck{Status: models.ComponentSkipped, Detail: "storage has no schema"}
+	}
+	if err := migrations.CheckMigrations(ctx); err != nil {
+		return failed(err)
+	}
+	return models.ComponentCheck{Status: models.ComponentOK}
+}
+
+func (s *Shortener) checkDeleteQueue(ctx context.Context) models.ComponentCheck {
+	pending, err := s.DeleteWorker.Pending(ctx)
+	if err != nil {
+		return failed(err)
+	}
+	threshold := server.Cfg.ReadyQueueDepth
+	if threshold <= 0 {
+		threshold = s.DeleteWorker.QueueSize
+	}
+	check := models.ComponentCheck{Status: models.ComponentOK, Detail: fmt.Sprintf("%d/%d", pending, threshold)}
+	if pending >= threshold {
+		check.Status = models.ComponentFailed
+	}
+	return check
+}
+
+func checkCertificate() models.ComponentCheck {
+	if !server.Cfg.EnableHTTPS {
+		return models.ComponentCheck{Status: models.ComponentSkipped, Detail: "https is disabled"}
+	}
+	expiresAt, err := certificate.ExpiresAt(server.Cfg.CertFilePath)
+	if err != nil {
+		return failed(err)
+	}
+	check := models.ComponentCheck{Status: models.ComponentOK, Detail: "expires at " + expiresAt.Format(time.RFC3339)}
+	if time.Until(expiresAt) < server.Cfg.ReadyCertExpiry {
+		check.Status = models.ComponentFailed
+	}
+	return check
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caarlos0/env/v6"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/romm80/shortener.git/internal/app/models"
+	"github.com/romm80/shortener.git/internal/app/server"
+)
+
+func TestShortener_Readyz(t *testing.T) {
+	server.Cfg.DBType = server.DBMap
+
+	if err := env.Parse(&server.Cfg); err != nil {
+		log.Fatal(err)
+	}
+	handler, err := New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	t.Cleanup(func() { handler.Close(context.Background()) })
+
+	serve := func(path string) (*http.Response, models.Readiness) {
+		w := httptest.NewRecorder()
+		handler.AdminRouter.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		result := w.Result()
+		defer result.Body.Close()
+		var res models.Readiness
+		if path == "/readyz" {
+			require.NoError(t, json.NewDecoder(result.Body).Decode(&res))
+		}
+		return result, res
+	}
+
+	result, _ := serve("/healthz")
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+
+	result, res := serve("/readyz")
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	assert.True(t, res.Ready)
+	assert.Equal(t, map[string]models.ComponentCheck{
+		"shutdown":     {Status: models.ComponentOK},
+		"storage":      {Status: models.ComponentOK},
+		"migrations":   {Status: models.ComponentSkipped, Detail: "storage has no schema"},
+		"delete_queue": {Status: models.ComponentOK, Detail: "0/1000"},
+		"tls":          {Status: models.ComponentSkipped, Detail: "https is disabled"},
+	}, res.Components)
+
+	handler.Drain()
+	result, res = serve("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, result.StatusCode)
+	assert.False(t, res.Ready)
+	assert.Equal(t, models.ComponentFailed, res.Components["shutdown"].Status)
+
+	result, _ = serve("/healthz")
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+}
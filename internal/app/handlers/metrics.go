@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/romm80/shortener.git/internal/app/repositories"
+	"github.com/romm80/shortener.git/internal/app/server"
+	"github.com/romm80/shortener.git/internal/app/service"
+	"github.com/romm80/shortener.git/internal/app/service/metrics"
+)
+
+// serviceMetrics metrics collected by the handlers
+type serviceMetrics struct {
+	registry        *metrics.Registry
+	requests        *metrics.CounterVec
+	requestDuration *metrics.HistogramVec
+	storageDuration *metrics.HistogramVec
+	storageErrors   *metrics.CounterVec
+}
+
+func newServiceMetrics() *serviceMetrics {
+	registry := metrics.NewRegistry()
+	return &serviceMetrics{
+		registry: registry,
+		requests: registry.NewCounter("shortener_http_requests_total",
+			"Number of HTTP requests by route and response status.", "method", "route", "status"),
+		requestDuration: registry.NewHistogram("shortener_http_request_duration_seconds",
+			"HTTP request latency by route.", metrics.DefBuckets, "method", "route"),
+		storageDuration: registry.NewHistogram("shortener_storage_operation_duration_seconds",
+			"Storage operation latency.", metrics.DefBuckets, "operation"),
+		storageErrors: registry.NewCounter("shortener_storage_errors_total",
+			"Number of storage operations which returned an error, including not found and conflict results.", "operation"),
+	}
+}
+
+// observeStorage records the storage operation
+func (m *serviceMetrics) observeStorage(operation string, duration time.Duration, err error) {
+	m.storageDuration.Observe(duration.Seconds(), operation)
+	if err != nil {
+		m.storageErrors.Inc(operation)
+	}
+}
+
+// registerCollectors registers metrics collected on every scrape from the storage and the delete worker
+func (s *Shortener) registerCollectors() {
+	s.metrics.registry.NewGaugeFunc("shortener_delete_queue_length",
+		"Number of queued link deletion tasks.", nil, func() []metrics.Sample {
+			ctx, cancel := service.WithTimeout(context.Background(), server.Cfg.StorageReadTimeout)
+			defer cancel()
+			pending, err := s.DeleteWorker.Pending(ctx)
+			if err != nil {
+				return nil
+			}
+			return []metrics.Sample{{Value: float64(pending)}}
+		})
+
+	pooled, ok := repositories.Unwrap(s.Storage).(repositories.Pooled)
+	if !ok {
+		return
+	}
+	s.metrics.registry.NewGaugeFunc("shortener_db_pool_connections",
+		"Number of database connections by state.", []string{"state"}, func() []metrics.Sample {
+			stats := pooled.PoolStats()
+			return []metrics.Sample{
+				{Labels: []string{"acquired"}, Value: float64(stats.Acquired)},
+				{Labels: []string{"idle"}, Value: float64(stats.Idle)},
+				{Labels: []string{"total"}, Value: float64(stats.Total)},
+			}
+		})
+	s.metrics.registry.NewGaugeFunc("shortener_db_pool_max_connections",
+		"Maximum size of the database connection pool.", nil, func() []metrics.Sample {
+			return []metrics.Sample{{Value: float64(pooled.PoolStats().Max)}}
+		})
+	s.metrics.registry.NewCounterFunc("shortener_db_pool_acquires_total",
+		"Number of successful database connection acquires.", nil, func() []metrics.Sample {
+			return []metrics.Sample{{Value: float64(pooled.PoolStats().AcquireCount)}}
+		})
+	s.metrics.registry.NewCounterFunc("shortener_db_pool_empty_acquires_total",
+		"Number of database connection acquires which waited for a connection.", nil, func() []metrics.Sample {
+			return []metrics.Sample{{Value: float64(pooled.PoolStats().EmptyAcquireCount)}}
+		})
+	s.metrics.registry.NewCounterFunc("shortener_db_pool_acquire_duration_seconds_total",
+		"Total time spent acquiring database connections.", nil, func() []metrics.Sample {
+			return []metrics.Sample{{Value: pooled.PoolStats().AcquireDuration.Seconds()}}
+		})
+}
+
+// MetricsMiddleware counts requests and their latency by route template
+func (s *Shortener) MetricsMiddleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	method := c.Request.Method
+	s.metrics.requests.Inc(method, route, strconv.Itoa(c.Writer.Status()))
+	s.metrics.requestDuration.Observe(time.Since(start).Seconds(), method, route)
+}
+
+// Metrics godoc
+// @Summary      Service metrics
+// @Description  Returns request, storage, connection pool and delete queue metrics in the Prometheus text format
+// @Produce      plain
+// @Success 200 {string} string "metrics"
+// @Router       /metrics [get]
+func (s *Shortener) Metrics(c *gin.Context) {
+	c.Header("Content-Type", metrics.ContentType)
+	c.Status(http.StatusOK)
+	if err := s.metrics.registry.Write(c.Writer); err != nil {
+		c.Error(err)
+	}
+}
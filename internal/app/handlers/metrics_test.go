@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caarlos0/env/v6"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/romm80/shortener.git/internal/app/server"
+	"github.com/romm80/shortener.git/internal/app/service/metrics"
+)
+
+func TestShortener_Metrics(t *testing.T) {
+	server.Cfg.DBType = server.DBMap
+
+	if err := env.Parse(&server.Cfg); err != nil {
+		log.Fatal(err)
+	}
+	handler, err := New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	t.Cleanup(func() { handler.Close(context.Background()) })
+
+	w := httptest.NewRecorder()
+	handler.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/missing", nil))
+	require.NoError(t, w.Result().Body.Close())
+
+	w = httptest.NewRecorder()
+	handler.AdminRouter.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	result := w.Result()
+	defer result.Body.Close()
+	body, err := ioutil.ReadAll(result.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	assert.Equal(t, metrics.ContentType, result.Header.Get("Content-Type"))
+	for _, line := range []string{
+		`shortener_http_requests_total{method="GET",route="/:id",status="400"} 1`,
+		`shortener_http_request_duration_seconds_count{method="GET",route="/:id"} 1`,
+		`shortener_storage_operation_duration_seconds_count{operation="get"} 1`,
+		`shortener_storage_errors_total{operation="get"} 1`,
+		`shortener_delete_queue_length 0`,
+	} {
+		assert.Contains(t, strings.Split(string(body), "\n"), line)
+	}
+}
@@ -1,16 +1,109 @@
 package handlers
 
 import (
+	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
+	"github.com/romm80/shortener.git/internal/app"
+	"github.com/romm80/shortener.git/internal/app/logger"
+	"github.com/romm80/shortener.git/internal/app/models"
 	"github.com/romm80/shortener.git/internal/app/server"
 	"github.com/romm80/shortener.git/internal/app/service"
+	"github.com/romm80/shortener.git/internal/app/service/tracing"
 )
 
+// maxRequestIDLength - maximum length of the propagated X-Request-ID header
+const maxRequestIDLength = 128
+
+// validRequestID reports whether the caller request id can be propagated to the logs and the response
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if r <= ' ' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random request id
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// RequestLogger assigns the request id, propagated from the X-Request-ID header or generated,
+// passes the logger with the id in the request context and writes the access log line
+func RequestLogger(c *gin.Context) {
+	start := time.Now()
+	id := c.GetHeader("X-Request-ID")
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	c.Header("X-Request-ID", id)
+	ctx := logger.WithRequestID(c.Request.Context(), id)
+	if sc := tracing.SpanContextFromContext(ctx); sc.IsValid() {
+		ctx = logger.WithContext(ctx, logger.FromContext(ctx).With("trace_id", sc.TraceID.String()))
+	}
+	c.Request = c.Request.WithContext(ctx)
+
+	c.Next()
+
+	status := c.Writer.Status()
+	level := logger.LevelInfo
+	if status >= http.StatusInternalServerError {
+		level = logger.LevelError
+	}
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	kv := []interface{}{
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+		"route", route,
+		"status", status,
+		"latency", time.Since(start),
+		"client_ip", c.ClientIP(),
+		"size", c.Writer.Size(),
+	}
+	if len(c.Errors) > 0 {
+		kv = append(kv, "error", c.Errors.String())
+	}
+	logger.FromContext(ctx).Log(level, "request", kv...)
+}
+
+// Recovery responds with the internal error to the panicked request and logs the panic with the stack
+func Recovery(c *gin.Context, recovered interface{}) {
+	logger.FromContext(c.Request.Context()).Error("panic recovered",
+		"error", fmt.Sprint(recovered), "stack", string(debug.Stack()))
+	c.AbortWithStatus(http.StatusInternalServerError)
+}
+
+// errStatus records the error for the access log and returns the response code of the error
+func errStatus(c *gin.Context, err error) int {
+	c.Error(err)
+	return app.ErrStatusCode(err)
+}
+
 type gzipWriter struct {
 	gin.ResponseWriter
 	writer *gzip.Writer
@@ -20,6 +113,12 @@ func (r *gzipWriter) Write(b []byte) (int, error) {
 	return r.writer.Write(b)
 }
 
+// Flush sends the data compressed so far, so streamed responses are not held until the handler returns
+func (r *gzipWriter) Flush() {
+	r.writer.Flush()
+	r.ResponseWriter.Flush()
+}
+
 func GzipMiddleware(c *gin.Context) {
 	if strings.Contains(c.Request.Header.Get("Content-Encoding"), "gzip") {
 		gz, err := gzip.NewReader(c.Request.Body)
@@ -47,7 +146,10 @@ func (s *Shortener) AuthMiddleware(c *gin.Context) {
 
 	cookie, err := c.Cookie("userid")
 	if err != nil || !service.ValidUserID(cookie, &userID) {
-		if userID, err = s.Storage.NewUser(); err != nil {
+		ctx, cancel := storageContext(c, server.Cfg.StorageWriteTimeout)
+		userID, err = s.Storage.NewUser(ctx)
+		cancel()
+		if err != nil {
 			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
@@ -62,3 +164,94 @@ func (s *Shortener) AuthMiddleware(c *gin.Context) {
 	c.Set("userid", userID)
 	c.Next()
 }
+
+// maxIdempotencyKeyLength - maximum length of the Idempotency-Key header
+const maxIdempotencyKeyLength = 255
+
+// recordingWriter keeps a copy of the response body
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *recordingWriter) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *recordingWriter) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
+
+// IdempotencyMiddleware replays the remembered response of the request with the same Idempotency-Key header
+// of the user. Responses with server errors are not remembered, so the request can be retried
+func (s *Shortener) IdempotencyMiddleware(c *gin.Context) {
+	key := c.GetHeader("Idempotency-Key")
+	if key == "" || server.Cfg.IdempotencyWindow <= 0 {
+		c.Next()
+		return
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		err := fmt.Errorf("%w: longer than %d", app.ErrInvalidIdempotencyKey, maxIdempotencyKeyLength)
+		c.AbortWithStatusJSON(errStatus(c, err), models.ResponseError{Error: err.Error()})
+		return
+	}
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	hash := sha256.Sum256(append([]byte(c.Request.Method+" "+c.FullPath()+"\n"), body...))
+
+	userID := c.GetUint64("userid")
+	ctx, cancel := storageContext(c, server.Cfg.StorageWriteTimeout)
+	defer cancel()
+	response, err := s.Idempotency.BeginRequest(ctx, userID, key, hex.EncodeToString(hash[:]),
+		time.Now().Add(server.Cfg.IdempotencyWindow))
+	if err != nil {
+		c.AbortWithStatusJSON(errStatus(c, err), models.ResponseError{Error: err.Error()})
+		return
+	}
+	if response != nil {
+		c.Header("Idempotent-Replayed", "true")
+		c.Data(response.Status, response.ContentType, response.Body)
+		c.Abort()
+		return
+	}
+
+	writer := &recordingWriter{ResponseWriter: c.Writer}
+	c.Writer = writer
+	completed := false
+	defer func() {
+		if completed {
+			return
+		}
+		// the handler panicked and the recovery middleware answers, the key must not stay reserved
+		ctx, cancel := service.WithTimeout(context.Background(), server.Cfg.StorageWriteTimeout)
+		defer cancel()
+		if err := s.Idempotency.ReleaseRequest(ctx, userID, key); err != nil {
+			logger.FromContext(ctx).Error("idempotency key is not released", "error", err)
+		}
+	}()
+	c.Next()
+	completed = true
+
+	// the request context may be already cancelled, the key must not stay reserved
+	ctx, cancel = service.WithTimeout(context.Background(), server.Cfg.StorageWriteTimeout)
+	defer cancel()
+	if writer.Status() >= http.StatusInternalServerError {
+		err = s.Idempotency.ReleaseRequest(ctx, userID, key)
+	} else {
+		err = s.Idempotency.CompleteRequest(ctx, userID, key, models.IdempotentResponse{
+			Status:      writer.Status(),
+			ContentType: writer.Header().Get("Content-Type"),
+			Body:        writer.body.Bytes(),
+		})
+	}
+	if err != nil {
+		logger.FromContext(ctx).Error("idempotency key is not released", "error", err)
+	}
+}
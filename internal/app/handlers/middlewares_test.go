@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caarlos0/env/v6"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/romm80/shortener.git/internal/app/logger"
+	"github.com/romm80/shortener.git/internal/app/server"
+)
+
+// syncBuffer log output read while the workers write to it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// lines returns the log lines with the request id
+func (b *syncBuffer) lines(requestID string) []map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	lines := make([]map[string]interface{}, 0)
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		var fields map[string]interface{}
+		if json.Unmarshal([]byte(line), &fields) == nil && fields["request_id"] == requestID {
+			lines = append(lines, fields)
+		}
+	}
+	return lines
+}
+
+func TestRequestLogger(t *testing.T) {
+	server.Cfg.DBType = server.DBMap
+
+	if err := env.Parse(&server.Cfg); err != nil {
+		log.Fatal(err)
+	}
+	handler, err := New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	t.Cleanup(func() { handler.Close(context.Background()) })
+
+	out := &syncBuffer{}
+	defaultLogger := logger.Default()
+	logger.SetDefault(logger.New(out, logger.LevelDebug))
+	defer logger.SetDefault(defaultLogger)
+
+	tests := []struct {
+		name      string
+		requestID string
+		propagate bool
+	}{
+		{name: "propagated", requestID: "caller-id-1", propagate: true},
+		{name: "generated", requestID: ""},
+		{name: "invalid replaced", requestID: "bad id"},
+		{name: "too long replaced", requestID: strings.Repeat("a", maxRequestIDLength+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/missing", nil)
+			if tt.requestID != "" {
+				request.Header.Set("X-Request-ID", tt.requestID)
+			}
+			w := httptest.NewRecorder()
+			handler.Router.ServeHTTP(w, request)
+			result := w.Result()
+			require.NoError(t, result.Body.Close())
+
+			id := result.Header.Get("X-Request-ID")
+			if tt.propagate {
+				assert.Equal(t, tt.requestID, id)
+			} else {
+				assert.Len(t, id, 32)
+			}
+			lines := out.lines(id)
+			require.Len(t, lines, 1)
+			assert.Equal(t, "request", lines[0]["msg"])
+			assert.Equal(t, "/:id", lines[0]["route"])
+			assert.Equal(t, float64(result.StatusCode), lines[0]["status"])
+		})
+	}
+
+	t.Run("delete worker", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodDelete, "/api/user/urls", strings.NewReader(`["abc"]`))
+		request.Header.Set("X-Request-ID", "delete-request")
+		w := httptest.NewRecorder()
+		handler.Router.ServeHTTP(w, request)
+		result := w.Result()
+		require.NoError(t, result.Body.Close())
+		require.Equal(t, http.StatusAccepted, result.StatusCode)
+
+		assert.Eventually(t, func() bool {
+			for _, line := range out.lines("delete-request") {
+				if line["msg"] == "delete task finished" {
+					return true
+				}
+			}
+			return false
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestGzipMiddleware_Flush(t *testing.T) {
+	w := httptest.NewRecorder()
+	router := gin.New()
+	router.GET("/", GzipMiddleware, func(c *gin.Context) {
+		c.Writer.Write([]byte("first"))
+		c.Writer.Flush()
+
+		// the flushed part is readable before the handler returns
+		assert.True(t, w.Flushed)
+		gz, err := gzip.NewReader(bytes.NewReader(w.Body.Bytes()))
+		require.NoError(t, err)
+		flushed := make([]byte, len("first"))
+		_, err = io.ReadFull(gz, flushed)
+		require.NoError(t, err)
+		assert.Equal(t, "first", string(flushed))
+
+		c.Writer.Write([]byte("second"))
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	router.ServeHTTP(w, request)
+
+	gz, err := gzip.NewReader(w.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, "firstsecond", string(body))
+}
+
+func TestIdempotencyMiddleware_Panic(t *testing.T) {
+	server.Cfg.DBType = server.DBMap
+	if err := env.Parse(&server.Cfg); err != nil {
+		log.Fatal(err)
+	}
+	handler, err := New()
+	require.NoError(t, err)
+	t.Cleanup(func() { handler.Close(context.Background()) })
+
+	calls := 0
+	router := gin.New()
+	router.Use(gin.CustomRecoveryWithWriter(io.Discard, Recovery), func(c *gin.Context) { c.Set("userid", uint64(1)) })
+	router.POST("/", handler.IdempotencyMiddleware, func(c *gin.Context) {
+		calls++
+		if calls == 1 {
+			panic("handler failed")
+		}
+		c.String(http.StatusCreated, "created")
+	})
+
+	statuses := make([]int, 0, 2)
+	for i := 0; i < 2; i++ {
+		request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("https://go.dev/"))
+		request.Header.Set("Idempotency-Key", "panic-1")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, request)
+		statuses = append(statuses, w.Code)
+	}
+	// the key of the panicked request is released, the retry is processed
+	assert.Equal(t, []int{http.StatusInternalServerError, http.StatusCreated}, statuses)
+}
@@ -1,11 +1,14 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/gin-contrib/pprof"
 	"github.com/gin-gonic/gin"
@@ -14,6 +17,8 @@ import (
 	"github.com/romm80/shortener.git/internal/app/models"
 	"github.com/romm80/shortener.git/internal/app/repositories"
 	"github.com/romm80/shortener.git/internal/app/server"
+	"github.com/romm80/shortener.git/internal/app/service"
+	"github.com/romm80/shortener.git/internal/app/service/scheduler"
 	"github.com/romm80/shortener.git/internal/app/service/workers"
 )
 
@@ -24,34 +29,117 @@ import (
 // @host      localhost:8080
 
 type Shortener struct {
-	Router       *gin.Engine
+	Router       *gin.Engine // shortener API
+	AdminRouter  *gin.Engine // profiling, metrics, probes and storage maintenance
 	Storage      repositories.Shortener
+	Stats        repositories.Stats
+	Idempotency  repositories.Idempotency
+	Queue        repositories.Queue
 	DeleteWorker *workers.DeleteWorker
+	ExpireWorker *workers.ExpireWorker
+	PurgeWorker  *workers.PurgeWorker
+	ClickWorker  *workers.ClickWorker
+	Scheduler    *scheduler.Scheduler
+	metrics      *serviceMetrics
+	reserved     map[string]struct{} // first path segments of the public routes, which aliases must not shadow
+	stop         context.CancelFunc  // stops the background workers
+	draining     int32               // set on the graceful shutdown, the instance is not ready
 }
 
 func New() (*Shortener, error) {
-	r := &Shortener{DeleteWorker: workers.NewDeleteWorker(1000)}
-	var err error
+	admin, err := NewAdminMiddleware(server.Cfg)
+	if err != nil {
+		return nil, err
+	}
+	r := &Shortener{
+		ExpireWorker: workers.NewExpireWorker(server.Cfg.ExpireInterval),
+		PurgeWorker:  workers.NewPurgeWorker(server.Cfg.PurgeInterval, server.Cfg.TrashRetention),
+		ClickWorker:  workers.NewClickWorker(1000),
+		metrics:      newServiceMetrics(),
+	}
 	if r.Storage, err = repositories.NewStorage(); err != nil {
 		return nil, err
 	}
-	r.DeleteWorker.Run(r.Storage)
+	r.Storage = repositories.Instrument(r.Storage, r.metrics.observeStorage)
+	if r.Stats, err = repositories.NewStats(r.Storage); err != nil {
+		return nil, err
+	}
+	if r.Idempotency, err = repositories.NewIdempotency(r.Storage); err != nil {
+		return nil, err
+	}
+	if r.Queue, err = repositories.NewQueue(r.Storage); err != nil {
+		return nil, err
+	}
+	jobs, err := repositories.NewJobStore(r.Storage)
+	if err != nil {
+		return nil, err
+	}
+	r.DeleteWorker = workers.NewDeleteWorker(r.Queue, jobs, server.Cfg.DeleteQueueSize, server.Cfg.DeleteWorkers, server.Cfg.DeleteWindow)
+	var ctx context.Context
+	ctx, r.stop = context.WithCancel(context.Background())
+	r.DeleteWorker.Run(ctx, r.Storage)
+	r.Scheduler = scheduler.New(r.Storage)
+	r.ExpireWorker.Register(r.Scheduler, r.Storage)
+	r.PurgeWorker.Register(r.Scheduler, r.Storage)
+	r.Scheduler.Run(ctx)
+	r.ClickWorker.Run(ctx, r.Stats)
+	r.registerCollectors()
 
-	r.Router = gin.Default()
-	r.Router.GET("/ping", r.PingDB)
-	r.Router.Use(GzipMiddleware)
-	r.Router.GET("/:id", r.Get)
-	r.Router.Use(r.AuthMiddleware)
-	r.Router.POST("/", r.Add)
-	r.Router.POST("/api/shorten", r.AddJSON)
-	r.Router.POST("/api/shorten/batch", r.BatchURLs)
-	r.Router.GET("/api/user/urls", r.GetUserURLs)
-	r.Router.DELETE("/api/user/urls", r.DeleteUserURLs)
+	r.Router = gin.New()
+	recovery := gin.CustomRecoveryWithWriter(io.Discard, Recovery)
+	r.Router.Use(TracingMiddleware, RequestLogger, recovery, r.MetricsMiddleware)
+	r.Router.GET("/ping", traced("handler.ping", r.PingDB))
+	r.Router.Use(traced("middleware.gzip", GzipMiddleware))
+	r.Router.GET("/:id", traced("handler.get", r.Get))
+	r.Router.Use(traced("middleware.auth", r.AuthMiddleware))
+	idempotency := traced("middleware.idempotency", r.IdempotencyMiddleware)
+	r.Router.POST("/", idempotency, traced("handler.add", r.Add))
+	r.Router.POST("/api/shorten", idempotency, traced("handler.add_json", r.AddJSON))
+	r.Router.POST("/api/shorten/batch", idempotency, traced("handler.batch_urls", r.BatchURLs))
+	r.Router.POST("/api/shorten/bulk", traced("handler.bulk_urls", r.BulkURLs))
+	r.Router.GET("/api/user/urls", traced("handler.get_user_urls", r.GetUserURLs))
+	r.Router.DELETE("/api/user/urls", traced("handler.delete_user_urls", r.DeleteUserURLs))
+	r.Router.GET("/api/user/urls/trash", traced("handler.get_user_trash", r.GetUserTrash))
+	r.Router.POST("/api/user/urls/restore", traced("handler.restore_user_urls", r.RestoreUserURLs))
+	r.Router.GET("/api/user/urls/:id/stats", traced("handler.get_url_stats", r.GetURLStats))
+	r.Router.PATCH("/api/user/urls/:id", traced("handler.update_user_url", r.UpdateUserURL))
+	r.Router.GET("/api/user/urls/:id/history", traced("handler.get_url_history", r.GetURLHistory))
+	r.Router.GET("/api/user/jobs/:id", traced("handler.get_user_job", r.GetUserJob))
+	paths := make([]string, 0)
+	for _, route := range r.Router.Routes() {
+		paths = append(paths, route.Path)
+	}
+	r.reserved = service.ReservedAliases(paths)
 
-	pprof.Register(r.Router)
+	// the admin router is not traced, probes and scrapes would flood the exporter
+	r.AdminRouter = gin.New()
+	r.AdminRouter.Use(RequestLogger, recovery, admin)
+	r.AdminRouter.GET("/healthz", r.Healthz)
+	r.AdminRouter.GET("/readyz", r.Readyz)
+	r.AdminRouter.GET("/metrics", r.Metrics)
+	r.AdminRouter.POST("/debug/storage/snapshot", r.SnapshotStorage)
+	pprof.Register(r.AdminRouter)
 	return r, nil
 }
 
+// Close stops the background workers and waits until accepted deletions are processed,
+// scheduler locks are released and buffered clicks are written
+func (s *Shortener) Close(ctx context.Context) error {
+	s.stop()
+	if err := s.DeleteWorker.Wait(ctx); err != nil {
+		return err
+	}
+	if err := s.Scheduler.Wait(ctx); err != nil {
+		return err
+	}
+	return s.ClickWorker.Wait(ctx)
+}
+
+// storageContext returns the request context limited by the storage operation timeout
+func storageContext(c *gin.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return service.WithTimeout(c.Request.Context(), timeout)
+}
+
 // Add godoc
 // @Summary      Adds a link
 // @Description  Shortens the received link and adds it to the database
@@ -68,10 +156,12 @@ func (s *Shortener) Add(c *gin.Context) {
 		return
 	}
 
-	urlID, err := s.Storage.Add(string(originURL), c.GetUint64("userid"))
+	ctx, cancel := storageContext(c, server.Cfg.StorageWriteTimeout)
+	defer cancel()
+	urlID, err := s.Storage.Add(ctx, string(originURL), c.GetUint64("userid"), nil)
 	statusCode := http.StatusCreated
 	if err != nil && !errors.Is(err, app.ErrConflictURLID) {
-		c.AbortWithError(http.StatusInternalServerError, err)
+		c.AbortWithError(app.ErrStatusCode(err), err)
 		return
 	}
 	if errors.Is(err, app.ErrConflictURLID) {
@@ -86,9 +176,11 @@ func (s *Shortener) Add(c *gin.Context) {
 // @Description  Shortens the received link and adds it to the database
 // @Accept       json
 // @Produce      json
-// @Param RequestURL body models.RequestURL true "original link"
+// @Param RequestURL body models.RequestURL true "original link, optional alias and expiration"
 // @Success 201 {object} models.ResponseURL "short link"
-// @Failure 400 {string} string "invalid request"
+// @Failure 400 {object} models.ResponseError "invalid request, alias or expiration"
+// @Failure 409 {object} models.ResponseURL "link is already exist"
+// @Failure 409 {object} models.ResponseError "alias already taken"
 // @Failure 500 {string} string "internal error"
 // @Router       /api/shorten [post]
 func (s *Shortener) AddJSON(c *gin.Context) {
@@ -102,10 +194,31 @@ func (s *Shortener) AddJSON(c *gin.Context) {
 		return
 	}
 
-	urlID, err := s.Storage.Add(request.URL, c.GetUint64("userid"))
+	expiresAt, err := service.ExpiresAt(request.ExpiresAt, request.TTL)
+	if err != nil {
+		c.AbortWithStatusJSON(errStatus(c, err), models.ResponseError{Error: err.Error()})
+		return
+	}
+
+	ctx, cancel := storageContext(c, server.Cfg.StorageWriteTimeout)
+	defer cancel()
+	var urlID string
+	if request.Alias != "" {
+		if err = service.ValidAlias(request.Alias, s.reserved); err != nil {
+			c.AbortWithStatusJSON(errStatus(c, err), models.ResponseError{Error: err.Error()})
+			return
+		}
+		urlID, err = s.Storage.AddAlias(ctx, request.URL, request.Alias, c.GetUint64("userid"), expiresAt)
+	} else {
+		urlID, err = s.Storage.Add(ctx, request.URL, c.GetUint64("userid"), expiresAt)
+	}
+	if errors.Is(err, app.ErrAliasTaken) {
+		c.AbortWithStatusJSON(errStatus(c, err), models.ResponseError{Error: err.Error()})
+		return
+	}
 	statusCode := http.StatusCreated
 	if err != nil && !errors.Is(err, app.ErrConflictURLID) {
-		c.AbortWithError(http.StatusInternalServerError, err)
+		c.AbortWithError(app.ErrStatusCode(err), err)
 		return
 	}
 	if errors.Is(err, app.ErrConflictURLID) {
@@ -122,79 +235,148 @@ func (s *Shortener) AddJSON(c *gin.Context) {
 // @Param id path string true "Link ID"
 // @Success 307	{string} string "successfully redirected"
 // @Failure 400 {string} string "Link not found"
-// @Failure 410 {string} string "Link removed"
+// @Failure 410 {string} string "Link removed or expired"
 // @Failure 500 {string} string "internal error"
 // @Router /{id} [get]
 func (s *Shortener) Get(c *gin.Context) {
 	urlID := c.Param("id")
-	originURL, err := s.Storage.Get(urlID)
+	ctx, cancel := storageContext(c, server.Cfg.StorageReadTimeout)
+	defer cancel()
+	originURL, err := s.Storage.Get(ctx, urlID)
 	if err != nil && !errors.Is(err, app.ErrDeletedURL) && !errors.Is(err, app.ErrLinkNoFound) {
-		c.AbortWithStatus(app.ErrStatusCode(err))
+		c.AbortWithStatus(errStatus(c, err))
 		return
 	}
 	if errors.Is(err, app.ErrDeletedURL) {
-		c.AbortWithStatus(app.ErrStatusCode(err))
+		c.AbortWithStatus(errStatus(c, err))
 		return
 	}
 	if errors.Is(err, app.ErrLinkNoFound) {
-		c.AbortWithStatus(app.ErrStatusCode(err))
+		c.AbortWithStatus(errStatus(c, err))
 		return
 	}
 
+	s.ClickWorker.Add(models.Click{
+		URLID:     urlID,
+		Time:      time.Now(),
+		Referrer:  c.Request.Referer(),
+		UserAgent: c.Request.UserAgent(),
+		IP:        c.ClientIP(),
+	})
 	c.Redirect(http.StatusTemporaryRedirect, originURL)
 }
 
 // BatchURLs godoc
 // @Summary      adds a links batch
-// @Description  Shortens the link batch and adds it to the database
+// @Description  Shortens the link batch and adds it to the database. Every item gets its own status:
+// @Description  created, existing or invalid with the error message
 // @Accept       json
 // @Produce      json
 // @Param RequestURL body []models.RequestBatch true "original links"
-// @Success 201 {object} []models.ResponseBatch "short links"
+// @Success 201 {object} []models.ResponseBatch "all links are shortened"
+// @Success 207 {object} []models.ResponseBatch "some links are existing or invalid"
 // @Failure 400 {string} string "invalid request"
-// @Failure 409 {string} string "added link is already exist"
 // @Failure 500 {string} string "internal error"
 // @Router       /api/shorten/batch [post]
 func (s *Shortener) BatchURLs(c *gin.Context) {
 	reqBatch := make([]models.RequestBatch, 0)
 	if err := json.NewDecoder(c.Request.Body).Decode(&reqBatch); err != nil {
 		c.AbortWithError(http.StatusBadRequest, err)
+		return
 	}
 
-	respBatch, err := s.Storage.AddBatch(reqBatch, c.GetUint64("userid"))
-	if err != nil && !errors.Is(err, app.ErrConflictURLID) {
-		c.AbortWithError(http.StatusInternalServerError, err)
-		return
+	respBatch := make([]models.ResponseBatch, len(reqBatch))
+	valid := make([]models.RequestBatch, 0, len(reqBatch))
+	positions := make([]int, 0, len(reqBatch))
+	for i, v := range reqBatch {
+		if err := validBatchItem(&v); err != nil {
+			respBatch[i] = models.ResponseBatch{
+				CorrelationID: v.CorrelationID,
+				Status:        models.BatchInvalid,
+				Error:         err.Error(),
+			}
+			continue
+		}
+		valid = append(valid, v)
+		positions = append(positions, i)
 	}
-	if errors.Is(err, app.ErrConflictURLID) {
-		c.AbortWithError(http.StatusConflict, err)
+
+	ctx, cancel := storageContext(c, server.Cfg.StorageBatchTimeout)
+	defer cancel()
+	stored, err := s.Storage.AddBatch(ctx, valid, c.GetUint64("userid"))
+	if err != nil {
+		c.AbortWithError(app.ErrStatusCode(err), err)
 		return
 	}
 
-	c.JSON(http.StatusCreated, respBatch)
+	statusCode := http.StatusCreated
+	for i, pos := range positions {
+		respBatch[pos] = stored[i]
+	}
+	for _, v := range respBatch {
+		if v.Status != models.BatchCreated {
+			statusCode = http.StatusMultiStatus
+			break
+		}
+	}
+
+	c.JSON(statusCode, respBatch)
+}
+
+// validBatchItem checks the batch item and replaces its lifetime by the expiration time
+func validBatchItem(item *models.RequestBatch) error {
+	if item.OriginalURL == "" {
+		return fmt.Errorf("%w: original_url is empty", app.ErrEmptyRequest)
+	}
+	expiresAt, err := service.ExpiresAt(item.ExpiresAt, item.TTL)
+	if err != nil {
+		return err
+	}
+	item.ExpiresAt = expiresAt
+	item.TTL = ""
+	return nil
 }
 
 // GetUserURLs godoc
 // @Summary      Returns a list of links added by the user
-// @Description  Returns a list of links added by the user
+// @Description  Returns a page of links added by the user, the next page cursor is returned in the X-Next-Cursor header
 // @Accept       json
 // @Produce      json
+// @Param limit query int false "page size, all links if omitted"
+// @Param cursor query string false "next page cursor"
+// @Param sort query string false "sort field: created (default) or url"
+// @Param order query string false "sort order: asc (default) or desc"
+// @Param domain query string false "destination domain filter"
+// @Param q query string false "original link substring filter"
 // @Success 200 {object} []models.UserURLs
 // @Success 204 {string} string "user has no links"
+// @Failure 400 {string} string "invalid query"
 // @Failure 500 {string} string "internal error"
 // @Router       /api/user/urls [get]
 func (s *Shortener) GetUserURLs(c *gin.Context) {
+	query, err := service.ParseURLsQuery(c.Query("limit"), c.Query("cursor"), c.Query("sort"),
+		c.Query("order"), c.Query("domain"), c.Query("q"))
+	if err != nil {
+		c.AbortWithStatusJSON(errStatus(c, err), models.ResponseError{Error: err.Error()})
+		return
+	}
+
 	userID := c.GetUint64("userid")
-	res, err := s.Storage.GetUserURLs(userID)
+	ctx, cancel := storageContext(c, server.Cfg.StorageReadTimeout)
+	defer cancel()
+	res, err := s.Storage.GetUserURLsPage(ctx, userID, query)
 	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+		c.AbortWithStatus(errStatus(c, err))
 		return
 	}
-	if len(res) == 0 {
+	if res.NextCursor != "" {
+		c.Header("X-Next-Cursor", res.NextCursor)
+	}
+	if len(res.URLs) == 0 {
 		c.Status(http.StatusNoContent)
 		return
 	}
-	c.JSON(http.StatusOK, res)
+	c.JSON(http.StatusOK, res.URLs)
 }
 
 // PingDB godoc
@@ -204,8 +386,10 @@ func (s *Shortener) GetUserURLs(c *gin.Context) {
 // @Failure 500 {string} string "internal error"
 // @Router       /ping [get]
 func (s *Shortener) PingDB(c *gin.Context) {
-	if err := s.Storage.Ping(); err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+	ctx, cancel := storageContext(c, server.Cfg.StorageReadTimeout)
+	defer cancel()
+	if err := s.Storage.Ping(ctx); err != nil {
+		c.AbortWithError(app.ErrStatusCode(err), err)
 		return
 	}
 	c.Status(http.StatusOK)
@@ -217,9 +401,10 @@ func (s *Shortener) PingDB(c *gin.Context) {
 // @Accept       json
 // @Produce      json
 // @Param urlsID body []string true "Link IDs to remove"
-// @Success 202 {string} string "request accepted for processing"
+// @Success 202 {object} models.DeleteJob "request accepted for processing, the job is in the Location header"
 // @Success 400 {string} string "invalid request"
-// @Router       /api/user/urls [post]
+// @Failure 503 {string} string "deletion queue is full, retry after the Retry-After header"
+// @Router       /api/user/urls [delete]
 func (s *Shortener) DeleteUserURLs(c *gin.Context) {
 	urlsID := make([]string, 0)
 	if err := c.BindJSON(&urlsID); err != nil {
@@ -232,7 +417,191 @@ func (s *Shortener) DeleteUserURLs(c *gin.Context) {
 	}
 
 	userID := c.GetUint64("userid")
-	s.DeleteWorker.Add(userID, urlsID)
+	ctx, cancel := storageContext(c, server.Cfg.StorageWriteTimeout)
+	defer cancel()
+	job, err := s.DeleteWorker.Add(ctx, userID, urlsID)
+	if errors.Is(err, app.ErrQueueFull) {
+		c.Header("Retry-After", "1")
+	}
+	if err != nil {
+		c.AbortWithError(app.ErrStatusCode(err), err)
+		return
+	}
+
+	c.Header("Location", "/api/user/jobs/"+job.ID)
+	c.JSON(http.StatusAccepted, job)
+}
+
+// GetUserJob godoc
+// @Summary      Returns the deletion job
+// @Description  Returns the job status with deleted and skipped link ids, available only to the user who started it
+// @Produce      json
+// @Param id path string true "Job ID"
+// @Success 200 {object} models.DeleteJob
+// @Failure 404 {string} string "job not found"
+// @Router       /api/user/jobs/{id} [get]
+func (s *Shortener) GetUserJob(c *gin.Context) {
+	job, err := s.DeleteWorker.Jobs.Get(c.Request.Context(), c.Param("id"), c.GetUint64("userid"))
+	if err != nil {
+		c.AbortWithStatus(errStatus(c, err))
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// GetURLStats godoc
+// @Summary      Returns link click statistics
+// @Description  Returns the total number of clicks and per-day breakdown, available only to the link owner
+// @Produce      json
+// @Param id path string true "Link ID"
+// @Success 200 {object} models.LinkStats
+// @Failure 403 {string} string "link belongs to another user"
+// @Failure 404 {string} string "Link not found"
+// @Failure 500 {string} string "internal error"
+// @Router       /api/user/urls/{id}/stats [get]
+func (s *Shortener) GetURLStats(c *gin.Context) {
+	ctx, cancel := storageContext(c, server.Cfg.StorageReadTimeout)
+	defer cancel()
+	stats, err := s.Stats.GetStats(ctx, c.Param("id"), c.GetUint64("userid"))
+	if errors.Is(err, app.ErrLinkNoFound) {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		c.AbortWithStatus(errStatus(c, err))
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+// UpdateUserURL godoc
+// @Summary      Replaces the original link
+// @Description  Replaces the original link of the shortened link, the previous one is kept in the history
+// @Accept       json
+// @Produce      json
+// @Param id path string true "Link ID"
+// @Param RequestURL body models.RequestURL true "new original link"
+// @Success 200 {object} models.ResponseURL "short link"
+// @Failure 400 {string} string "invalid request or link not found"
+// @Failure 403 {string} string "link belongs to another user"
+// @Failure 409 {string} string "new original link is already shortened"
+// @Failure 410 {string} string "Link removed"
+// @Failure 500 {string} string "internal error"
+// @Router       /api/user/urls/{id} [patch]
+func (s *Shortener) UpdateUserURL(c *gin.Context) {
+	var request models.RequestURL
+	if err := json.NewDecoder(c.Request.Body).Decode(&request); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	if request.URL == "" {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	urlID := c.Param("id")
+	ctx, cancel := storageContext(c, server.Cfg.StorageWriteTimeout)
+	defer cancel()
+	if err := s.Storage.UpdateURL(ctx, urlID, request.URL, c.GetUint64("userid")); err != nil {
+		c.AbortWithStatus(errStatus(c, err))
+		return
+	}
+	c.JSON(http.StatusOK, models.ResponseURL{Result: service.BaseURL(urlID)})
+}
+
+// GetURLHistory godoc
+// @Summary      Returns previous original links
+// @Description  Returns previous original links with replacement time, available only to the link owner
+// @Produce      json
+// @Param id path string true "Link ID"
+// @Success 200 {object} []models.URLHistory
+// @Failure 400 {string} string "Link not found"
+// @Failure 403 {string} string "link belongs to another user"
+// @Failure 500 {string} string "internal error"
+// @Router       /api/user/urls/{id}/history [get]
+func (s *Shortener) GetURLHistory(c *gin.Context) {
+	ctx, cancel := storageContext(c, server.Cfg.StorageReadTimeout)
+	defer cancel()
+	history, err := s.Storage.GetURLHistory(ctx, c.Param("id"), c.GetUint64("userid"))
+	if err != nil {
+		c.AbortWithStatus(errStatus(c, err))
+		return
+	}
+	c.JSON(http.StatusOK, history)
+}
 
-	c.Status(http.StatusAccepted)
+// SnapshotStorage godoc
+// @Summary      Writes a storage snapshot
+// @Description  Writes the full storage state to the snapshot file and compacts the storage file
+// @Success 204 {string} string "snapshot written"
+// @Failure 501 {string} string "storage does not support snapshots"
+// @Failure 500 {string} string "internal error"
+// @Router       /debug/storage/snapshot [post]
+func (s *Shortener) SnapshotStorage(c *gin.Context) {
+	snapshotter, ok := repositories.Unwrap(s.Storage).(repositories.Snapshotter)
+	if !ok {
+		c.AbortWithStatus(errStatus(c, app.ErrNotSupported))
+		return
+	}
+	ctx, cancel := storageContext(c, server.Cfg.StorageBatchTimeout)
+	defer cancel()
+	if err := snapshotter.Snapshot(ctx); err != nil {
+		c.AbortWithStatus(errStatus(c, err))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// GetUserTrash godoc
+// @Summary      Returns a list of links deleted by the user
+// @Description  Returns deleted links that can be restored until the retention period expires
+// @Produce      json
+// @Success 200 {object} []models.TrashURL
+// @Success 204 {string} string "trash is empty"
+// @Failure 500 {string} string "internal error"
+// @Router       /api/user/urls/trash [get]
+func (s *Shortener) GetUserTrash(c *gin.Context) {
+	ctx, cancel := storageContext(c, server.Cfg.StorageReadTimeout)
+	defer cancel()
+	res, err := s.Storage.GetUserTrash(ctx, c.GetUint64("userid"))
+	if err != nil {
+		c.AbortWithError(app.ErrStatusCode(err), err)
+		return
+	}
+	if len(res) == 0 {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// RestoreUserURLs godoc
+// @Summary      Restores deleted user links by shortened ID
+// @Description  Restores deleted user links by shortened ID, returns IDs of restored links
+// @Accept       json
+// @Produce      json
+// @Param urlsID body []string true "Link IDs to restore"
+// @Success 200 {object} []string "restored link IDs"
+// @Failure 400 {string} string "invalid request"
+// @Failure 500 {string} string "internal error"
+// @Router       /api/user/urls/restore [post]
+func (s *Shortener) RestoreUserURLs(c *gin.Context) {
+	urlsID := make([]string, 0)
+	if err := c.BindJSON(&urlsID); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	if len(urlsID) == 0 {
+		c.AbortWithError(http.StatusBadRequest, app.ErrEmptyRequest)
+		return
+	}
+
+	ctx, cancel := storageContext(c, server.Cfg.StorageWriteTimeout)
+	defer cancel()
+	restored, err := s.Storage.RestoreBatch(ctx, c.GetUint64("userid"), urlsID)
+	if err != nil {
+		c.AbortWithError(app.ErrStatusCode(err), err)
+		return
+	}
+	c.JSON(http.StatusOK, restored)
 }
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -9,6 +10,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/caarlos0/env/v6"
 	"github.com/stretchr/testify/assert"
@@ -34,13 +36,14 @@ func TestShortener_Add(t *testing.T) {
 	server.Cfg.DBType = server.DBMap
 	server.Cfg.FileStorage = ""
 
-	handler, err := New()
-	if err != nil {
+	if err := env.Parse(&server.Cfg); err != nil {
 		log.Fatal(err)
 	}
-	if err := env.Parse(&server.Cfg); err != nil {
+	handler, err := New()
+	if err != nil {
 		log.Fatal(err)
 	}
+	t.Cleanup(func() { handler.Close(context.Background()) })
 
 	type want struct {
 		body   string
@@ -95,15 +98,16 @@ func TestShortener_Add(t *testing.T) {
 func TestShortener_Get(t *testing.T) {
 	server.Cfg.DBType = server.DBMap
 	server.Cfg.FileStorage = ""
-	handler, err := New()
-	if err != nil {
+	if err := env.Parse(&server.Cfg); err != nil {
 		log.Fatal(err)
 	}
-	if err := env.Parse(&server.Cfg); err != nil {
+	handler, err := New()
+	if err != nil {
 		log.Fatal(err)
 	}
+	t.Cleanup(func() { handler.Close(context.Background()) })
 
-	userID, _ := handler.Storage.NewUser()
+	userID, _ := handler.Storage.NewUser(context.Background())
 	urls = []models.URLsID{
 		{
 			OriginalURL: "https://www.google.com/",
@@ -113,8 +117,10 @@ func TestShortener_Get(t *testing.T) {
 		},
 	}
 
-	urls[0].ID, _ = handler.Storage.Add(urls[0].OriginalURL, userID)
-	urls[1].ID, _ = handler.Storage.Add(urls[1].OriginalURL, userID)
+	urls[0].ID, _ = handler.Storage.Add(context.Background(), urls[0].OriginalURL, userID, nil)
+	urls[1].ID, _ = handler.Storage.Add(context.Background(), urls[1].OriginalURL, userID, nil)
+	expiredAt := time.Now().Add(-time.Minute)
+	expiredID, _ := handler.Storage.Add(context.Background(), "https://go.dev/", userID, &expiredAt)
 
 	type want struct {
 		location string
@@ -152,6 +158,14 @@ func TestShortener_Get(t *testing.T) {
 				status: 400,
 			},
 		},
+		{
+			name: "Link expired",
+			path: "/",
+			id:   expiredID,
+			want: want{
+				status: 410,
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -172,13 +186,14 @@ func TestShortener_Get(t *testing.T) {
 func TestShortener_AddJSON(t *testing.T) {
 	server.Cfg.DBType = server.DBMap
 
-	handler, err := New()
-	if err != nil {
+	if err := env.Parse(&server.Cfg); err != nil {
 		log.Fatal(err)
 	}
-	if err := env.Parse(&server.Cfg); err != nil {
+	handler, err := New()
+	if err != nil {
 		log.Fatal(err)
 	}
+	t.Cleanup(func() { handler.Close(context.Background()) })
 
 	type want struct {
 		contentType string
@@ -268,11 +283,33 @@ func TestShortener_BatchURLs(t *testing.T) {
 		{
 			CorrelationID: "-",
 			ShortURL:      service.BaseURL(service.ShortenURLID(RequestURLs[0].OriginalURL)),
+			Status:        models.BatchCreated,
 		},
 		{
 			CorrelationID: "-",
 			ShortURL:      service.BaseURL(service.ShortenURLID(RequestURLs[1].OriginalURL)),
+			Status:        models.BatchCreated,
+		},
+	}
+	multiStatusJSON, err := json.Marshal([]models.ResponseBatch{
+		{
+			CorrelationID: "1",
+			ShortURL:      service.BaseURL(service.ShortenURLID(RequestURLs[0].OriginalURL)),
+			Status:        models.BatchExisting,
+		},
+		{
+			CorrelationID: "2",
+			Status:        models.BatchInvalid,
+			Error:         "empty request: original_url is empty",
+		},
+		{
+			CorrelationID: "3",
+			Status:        models.BatchInvalid,
+			Error:         "invalid expiration: time: invalid duration \"soon\"",
 		},
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
 	reqJSON, err := json.Marshal(RequestURLs)
 	if err != nil {
@@ -283,13 +320,14 @@ func TestShortener_BatchURLs(t *testing.T) {
 		log.Fatal(err)
 	}
 
-	handler, err := New()
-	if err != nil {
+	if err := env.Parse(&server.Cfg); err != nil {
 		log.Fatal(err)
 	}
-	if err := env.Parse(&server.Cfg); err != nil {
+	handler, err := New()
+	if err != nil {
 		log.Fatal(err)
 	}
+	t.Cleanup(func() { handler.Close(context.Background()) })
 
 	type want struct {
 		contentType string
@@ -312,13 +350,24 @@ func TestShortener_BatchURLs(t *testing.T) {
 				body:        string(respJSON),
 			},
 		},
+		{
+			name: "existing and invalid links",
+			path: batchPath,
+			body: `[{"correlation_id":"1","original_url":"https://www.google.com/"},
+				{"correlation_id":"2","original_url":""},
+				{"correlation_id":"3","original_url":"https://go.dev/","ttl":"soon"}]`,
+			want: want{
+				status:      207,
+				contentType: "application/json; charset=utf-8",
+				body:        string(multiStatusJSON),
+			},
+		},
 		{
 			name: "invalid json",
 			path: batchPath,
 			body: `{"url2":"https://yandex.ru/"}`,
 			want: want{
 				status: 400,
-				body:   "[]",
 			},
 		},
 	}
@@ -344,16 +393,112 @@ func TestShortener_BatchURLs(t *testing.T) {
 	}
 }
 
-func TestShortener_GetUserURLs(t *testing.T) {
+func TestShortener_BatchURLsStatuses(t *testing.T) {
 	server.Cfg.DBType = server.DBMap
-
+	server.Cfg.FileStorage = ""
+	if err := env.Parse(&server.Cfg); err != nil {
+		log.Fatal(err)
+	}
 	handler, err := New()
 	if err != nil {
 		log.Fatal(err)
 	}
-	if err = env.Parse(&server.Cfg); err != nil {
+	t.Cleanup(func() { handler.Close(context.Background()) })
+
+	userID, err := handler.Storage.NewUser(context.Background())
+	require.NoError(t, err)
+	existingID, err := handler.Storage.Add(context.Background(), "https://pkg.go.dev/", userID, nil)
+	require.NoError(t, err)
+
+	serve := func(body string) (int, []models.ResponseBatch) {
+		request := httptest.NewRequest(http.MethodPost, "/api/shorten/batch", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		handler.Router.ServeHTTP(w, request)
+		result := w.Result()
+		defer result.Body.Close()
+
+		var respBatch []models.ResponseBatch
+		require.NoError(t, json.NewDecoder(result.Body).Decode(&respBatch))
+		return result.StatusCode, respBatch
+	}
+	redirect := func(shortURL string) string {
+		request := httptest.NewRequest(http.MethodGet, "/"+shortURL[strings.LastIndex(shortURL, "/")+1:], nil)
+		w := httptest.NewRecorder()
+		handler.Router.ServeHTTP(w, request)
+		result := w.Result()
+		require.NoError(t, result.Body.Close())
+		return result.Header.Get("Location")
+	}
+
+	t.Run("created", func(t *testing.T) {
+		status, respBatch := serve(`[{"correlation_id":"a","original_url":"https://go.dev/blog/"},
+			{"correlation_id":"b","original_url":"https://go.dev/play/","ttl":"1h"}]`)
+		assert.Equal(t, http.StatusCreated, status)
+		require.Len(t, respBatch, 2)
+		for i, want := range []string{"https://go.dev/blog/", "https://go.dev/play/"} {
+			assert.Equal(t, models.BatchCreated, respBatch[i].Status)
+			assert.Empty(t, respBatch[i].Error)
+			assert.Equal(t, want, redirect(respBatch[i].ShortURL))
+		}
+		assert.Equal(t, "a", respBatch[0].CorrelationID)
+		assert.Equal(t, "b", respBatch[1].CorrelationID)
+	})
+
+	t.Run("existing", func(t *testing.T) {
+		status, respBatch := serve(`[{"correlation_id":"a","original_url":"https://pkg.go.dev/"}]`)
+		assert.Equal(t, http.StatusMultiStatus, status)
+		require.Len(t, respBatch, 1)
+		assert.Equal(t, models.BatchExisting, respBatch[0].Status)
+		assert.Equal(t, service.BaseURL(existingID), respBatch[0].ShortURL)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+		status, respBatch := serve(`[{"correlation_id":"a","original_url":""},
+			{"correlation_id":"b","original_url":"https://go.dev/doc/","ttl":"-1h"},
+			{"correlation_id":"c","original_url":"https://go.dev/ref/","ttl":"1h","expires_at":"` + past + `"},
+			{"correlation_id":"d","original_url":"https://go.dev/dl/","expires_at":"` + past + `"}]`)
+		assert.Equal(t, http.StatusMultiStatus, status)
+		require.Len(t, respBatch, 4)
+		for i, correlationID := range []string{"a", "b", "c", "d"} {
+			assert.Equal(t, correlationID, respBatch[i].CorrelationID)
+			assert.Equal(t, models.BatchInvalid, respBatch[i].Status)
+			assert.Empty(t, respBatch[i].ShortURL)
+		}
+		assert.Equal(t, "empty request: original_url is empty", respBatch[0].Error)
+		assert.Equal(t, "invalid expiration: ttl must be positive", respBatch[1].Error)
+		assert.Equal(t, "invalid expiration: expires_at and ttl are mutually exclusive", respBatch[2].Error)
+		assert.Equal(t, "invalid expiration: expires_at is in the past", respBatch[3].Error)
+
+		// rejected items are not stored
+		status, respBatch = serve(`[{"correlation_id":"a","original_url":"https://go.dev/doc/"}]`)
+		assert.Equal(t, http.StatusCreated, status)
+		assert.Equal(t, models.BatchCreated, respBatch[0].Status)
+	})
+
+	t.Run("mixed", func(t *testing.T) {
+		status, respBatch := serve(`[{"correlation_id":"a","original_url":"https://go.dev/tour/"},
+			{"correlation_id":"b","original_url":""},
+			{"correlation_id":"c","original_url":"https://pkg.go.dev/"}]`)
+		assert.Equal(t, http.StatusMultiStatus, status)
+		require.Len(t, respBatch, 3)
+		assert.Equal(t, models.BatchCreated, respBatch[0].Status)
+		assert.Equal(t, models.BatchInvalid, respBatch[1].Status)
+		assert.Equal(t, models.BatchExisting, respBatch[2].Status)
+	})
+}
+
+func TestShortener_GetUserURLs(t *testing.T) {
+	server.Cfg.DBType = server.DBMap
+
+	if err := env.Parse(&server.Cfg); err != nil {
 		log.Fatal(err)
 	}
+	handler, err := New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	t.Cleanup(func() { handler.Close(context.Background()) })
 	userURLsPath := "/api/user/urls"
 	URLs := []models.RequestBatch{
 		{
@@ -365,11 +510,11 @@ func TestShortener_GetUserURLs(t *testing.T) {
 			OriginalURL:   "https://www.yandex.ru/",
 		},
 	}
-	userID, err := handler.Storage.NewUser()
+	userID, err := handler.Storage.NewUser(context.Background())
 	if err != nil {
 		log.Fatal(err)
 	}
-	shortURLs, err := handler.Storage.AddBatch(URLs, userID)
+	shortURLs, err := handler.Storage.AddBatch(context.Background(), URLs, userID)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -446,3 +591,612 @@ func TestShortener_GetUserURLs(t *testing.T) {
 		})
 	}
 }
+
+func TestShortener_AddJSONAlias(t *testing.T) {
+	server.Cfg.DBType = server.DBMap
+
+	if err := env.Parse(&server.Cfg); err != nil {
+		log.Fatal(err)
+	}
+	handler, err := New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	t.Cleanup(func() { handler.Close(context.Background()) })
+	ownerID, err := handler.Storage.NewUser(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	otherID, err := handler.Storage.NewUser(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	type want struct {
+		body   string
+		status int
+	}
+	tests := []struct {
+		name   string
+		body   string
+		want   want
+		userID uint64
+	}{
+		{
+			name:   "Successfully added alias",
+			body:   `{"url":"https://www.google.com/","alias":"spring-sale"}`,
+			userID: ownerID,
+			want: want{
+				status: 201,
+				body:   fmt.Sprintf(`{"result":"%s"}`, service.BaseURL("spring-sale")),
+			},
+		},
+		{
+			name:   "Alias already added by the owner",
+			body:   `{"url":"https://www.google.com/","alias":"spring-sale"}`,
+			userID: ownerID,
+			want: want{
+				status: 409,
+				body:   fmt.Sprintf(`{"result":"%s"}`, service.BaseURL("spring-sale")),
+			},
+		},
+		{
+			name:   "Alias taken by another user",
+			body:   `{"url":"https://yandex.ru/","alias":"spring-sale"}`,
+			userID: otherID,
+			want: want{
+				status: 409,
+				body:   `{"error":"alias already taken"}`,
+			},
+		},
+		{
+			name:   "Reserved alias",
+			body:   `{"url":"https://yandex.ru/","alias":"ping"}`,
+			userID: otherID,
+			want: want{
+				status: 400,
+				body:   `{"error":"invalid alias: ping is reserved"}`,
+			},
+		},
+		{
+			name:   "Forbidden character",
+			body:   `{"url":"https://yandex.ru/","alias":"spring/sale"}`,
+			userID: otherID,
+			want: want{
+				status: 400,
+				body:   `{"error":"invalid alias: forbidden character '/'"}`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(tt.body))
+			signedID, _ := service.SignUserID(tt.userID)
+			request.AddCookie(&http.Cookie{
+				Name:  "userid",
+				Value: signedID,
+			})
+			w := httptest.NewRecorder()
+
+			handler.Router.ServeHTTP(w, request)
+			result := w.Result()
+
+			assert.Equal(t, tt.want.status, result.StatusCode)
+
+			body, err := ioutil.ReadAll(result.Body)
+			require.NoError(t, err)
+			err = result.Body.Close()
+			require.NoError(t, err)
+			assert.Equal(t, tt.want.body, string(body))
+		})
+	}
+
+	// every static route of the public router is reserved
+	segments := make(map[string]struct{})
+	for _, route := range handler.Router.Routes() {
+		if segment := strings.Split(route.Path, "/")[1]; segment != "" && !strings.HasPrefix(segment, ":") {
+			segments[segment] = struct{}{}
+		}
+	}
+	for segment := range segments {
+		segment := segment
+		t.Run("reserved "+segment, func(t *testing.T) {
+			body := fmt.Sprintf(`{"url":"https://yandex.ru/","alias":"%s"}`, segment)
+			request := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(body))
+			signedID, _ := service.SignUserID(otherID)
+			request.AddCookie(&http.Cookie{Name: "userid", Value: signedID})
+			w := httptest.NewRecorder()
+			handler.Router.ServeHTTP(w, request)
+			result := w.Result()
+			defer result.Body.Close()
+			assert.Equal(t, http.StatusBadRequest, result.StatusCode)
+		})
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/spring-sale", nil)
+	w := httptest.NewRecorder()
+	handler.Router.ServeHTTP(w, request)
+	result := w.Result()
+	result.Body.Close()
+
+	assert.Equal(t, http.StatusTemporaryRedirect, result.StatusCode)
+	assert.Equal(t, "https://www.google.com/", result.Header.Get("Location"))
+}
+
+func TestShortener_GetURLStats(t *testing.T) {
+	server.Cfg.DBType = server.DBMap
+
+	if err := env.Parse(&server.Cfg); err != nil {
+		log.Fatal(err)
+	}
+	handler, err := New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	t.Cleanup(func() { handler.Close(context.Background()) })
+	ownerID, err := handler.Storage.NewUser(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	otherID, err := handler.Storage.NewUser(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	urlID, err := handler.Storage.Add(context.Background(), "https://www.google.com/", ownerID, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	clickTime := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	// the click of the purged link does not fail the batch
+	err = handler.Stats.AddClicks(context.Background(), []models.Click{
+		{URLID: urlID, Time: clickTime},
+		{URLID: "purged", Time: clickTime},
+		{URLID: urlID, Time: clickTime.Add(time.Hour)},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	type want struct {
+		body   string
+		status int
+	}
+	tests := []struct {
+		name   string
+		id     string
+		want   want
+		userID uint64
+	}{
+		{
+			name:   "Successfully received stats",
+			id:     urlID,
+			userID: ownerID,
+			want: want{
+				status: 200,
+				body:   `{"total":2,"days":[{"date":"2022-06-01","clicks":2}]}`,
+			},
+		},
+		{
+			name:   "Link belongs to another user",
+			id:     urlID,
+			userID: otherID,
+			want: want{
+				status: 403,
+			},
+		},
+		{
+			name:   "Link not found by id",
+			id:     "1234",
+			userID: ownerID,
+			want: want{
+				status: 404,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api/user/urls/"+tt.id+"/stats", nil)
+			signedID, _ := service.SignUserID(tt.userID)
+			request.AddCookie(&http.Cookie{
+				Name:  "userid",
+				Value: signedID,
+			})
+			w := httptest.NewRecorder()
+
+			handler.Router.ServeHTTP(w, request)
+			result := w.Result()
+
+			assert.Equal(t, tt.want.status, result.StatusCode)
+
+			body, err := ioutil.ReadAll(result.Body)
+			require.NoError(t, err)
+			err = result.Body.Close()
+			require.NoError(t, err)
+			assert.Equal(t, tt.want.body, string(body))
+		})
+	}
+}
+
+func TestShortener_UpdateUserURL(t *testing.T) {
+	server.Cfg.DBType = server.DBMap
+
+	if err := env.Parse(&server.Cfg); err != nil {
+		log.Fatal(err)
+	}
+	handler, err := New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	t.Cleanup(func() { handler.Close(context.Background()) })
+	ownerID, err := handler.Storage.NewUser(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	otherID, err := handler.Storage.NewUser(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	urlID, err := handler.Storage.Add(context.Background(), "https://www.google.com/", ownerID, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err = handler.Storage.Add(context.Background(), "https://yandex.ru/", ownerID, nil); err != nil {
+		log.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		userID uint64
+	}{
+		{
+			name:   "Link belongs to another user",
+			body:   `{"url":"https://go.dev/"}`,
+			userID: otherID,
+			status: 403,
+		},
+		{
+			name:   "New link is already shortened",
+			body:   `{"url":"https://yandex.ru/"}`,
+			userID: ownerID,
+			status: 409,
+		},
+		{
+			name:   "Successfully replaced link",
+			body:   `{"url":"https://go.dev/"}`,
+			userID: ownerID,
+			status: 200,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPatch, "/api/user/urls/"+urlID, strings.NewReader(tt.body))
+			signedID, _ := service.SignUserID(tt.userID)
+			request.AddCookie(&http.Cookie{
+				Name:  "userid",
+				Value: signedID,
+			})
+			w := httptest.NewRecorder()
+
+			handler.Router.ServeHTTP(w, request)
+			result := w.Result()
+			result.Body.Close()
+
+			assert.Equal(t, tt.status, result.StatusCode)
+		})
+	}
+
+	originURL, err := handler.Storage.Get(context.Background(), urlID)
+	require.NoError(t, err)
+	assert.Equal(t, "https://go.dev/", originURL)
+
+	history, err := handler.Storage.GetURLHistory(context.Background(), urlID, ownerID)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, "https://www.google.com/", history[0].OriginalURL)
+}
+
+func TestShortener_RestoreUserURLs(t *testing.T) {
+	server.Cfg.DBType = server.DBMap
+
+	if err := env.Parse(&server.Cfg); err != nil {
+		log.Fatal(err)
+	}
+	handler, err := New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	t.Cleanup(func() { handler.Close(context.Background()) })
+	userID, err := handler.Storage.NewUser(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	urlID, err := handler.Storage.Add(context.Background(), "https://www.google.com/", userID, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err = handler.Storage.DeleteBatch(context.Background(), userID, []string{urlID}); err != nil {
+		log.Fatal(err)
+	}
+	signedID, _ := service.SignUserID(userID)
+
+	type want struct {
+		body   string
+		status int
+	}
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   want
+	}{
+		{
+			name:   "Deleted link in trash",
+			method: http.MethodGet,
+			path:   "/api/user/urls/trash",
+			want: want{
+				status: 200,
+				body:   service.BaseURL(urlID),
+			},
+		},
+		{
+			name:   "Successfully restored link",
+			method: http.MethodPost,
+			path:   "/api/user/urls/restore",
+			body:   fmt.Sprintf(`["%s","1234"]`, urlID),
+			want: want{
+				status: 200,
+				body:   fmt.Sprintf(`["%s"]`, urlID),
+			},
+		},
+		{
+			name:   "Trash is empty",
+			method: http.MethodGet,
+			path:   "/api/user/urls/trash",
+			want: want{
+				status: 204,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			request.AddCookie(&http.Cookie{
+				Name:  "userid",
+				Value: signedID,
+			})
+			w := httptest.NewRecorder()
+
+			handler.Router.ServeHTTP(w, request)
+			result := w.Result()
+
+			assert.Equal(t, tt.want.status, result.StatusCode)
+
+			body, err := ioutil.ReadAll(result.Body)
+			require.NoError(t, err)
+			err = result.Body.Close()
+			require.NoError(t, err)
+			assert.Contains(t, string(body), tt.want.body)
+		})
+	}
+
+	urls, err := handler.Storage.GetUserURLs(context.Background(), userID)
+	require.NoError(t, err)
+	assert.Len(t, urls, 1)
+}
+
+func TestShortener_Idempotency(t *testing.T) {
+	server.Cfg.DBType = server.DBMap
+
+	if err := env.Parse(&server.Cfg); err != nil {
+		log.Fatal(err)
+	}
+	handler, err := New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	t.Cleanup(func() { handler.Close(context.Background()) })
+	userID, err := handler.Storage.NewUser(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	otherID, err := handler.Storage.NewUser(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	batch := `[{"correlation_id":"1","original_url":"https://go.dev/"}]`
+
+	type want struct {
+		status   int
+		replayed string
+	}
+	tests := []struct {
+		name   string
+		key    string
+		body   string
+		userID uint64
+		want   want
+	}{
+		{
+			name:   "first request",
+			key:    "import-1",
+			body:   batch,
+			userID: userID,
+			want:   want{status: 201},
+		},
+		{
+			name:   "replayed request",
+			key:    "import-1",
+			body:   batch,
+			userID: userID,
+			want:   want{status: 201, replayed: "true"},
+		},
+		{
+			name:   "same key of another user",
+			key:    "import-1",
+			body:   batch,
+			userID: otherID,
+			want:   want{status: 207},
+		},
+		{
+			name:   "same key with another body",
+			key:    "import-1",
+			body:   `[{"correlation_id":"1","original_url":"https://github.com/"}]`,
+			userID: userID,
+			want:   want{status: 422},
+		},
+		{
+			name:   "without key",
+			body:   batch,
+			userID: userID,
+			want:   want{status: 207},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/api/shorten/batch", strings.NewReader(tt.body))
+			if tt.key != "" {
+				request.Header.Set("Idempotency-Key", tt.key)
+			}
+			signedID, _ := service.SignUserID(tt.userID)
+			request.AddCookie(&http.Cookie{
+				Name:  "userid",
+				Value: signedID,
+			})
+			w := httptest.NewRecorder()
+
+			handler.Router.ServeHTTP(w, request)
+			result := w.Result()
+			require.NoError(t, result.Body.Close())
+
+			assert.Equal(t, tt.want.status, result.StatusCode)
+			assert.Equal(t, tt.want.replayed, result.Header.Get("Idempotent-Replayed"))
+		})
+	}
+}
+
+func TestShortener_DeleteJob(t *testing.T) {
+	server.Cfg.DBType = server.DBMap
+
+	if err := env.Parse(&server.Cfg); err != nil {
+		log.Fatal(err)
+	}
+	handler, err := New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	t.Cleanup(func() { handler.Close(context.Background()) })
+	ownerID, err := handler.Storage.NewUser(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	otherID, err := handler.Storage.NewUser(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	ownURL, err := handler.Storage.Add(context.Background(), "https://www.google.com/", ownerID, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	otherURL, err := handler.Storage.Add(context.Background(), "https://yandex.ru/", otherID, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serve := func(method, path, body string, userID uint64) *http.Response {
+		request := httptest.NewRequest(method, path, strings.NewReader(body))
+		signedID, _ := service.SignUserID(userID)
+		request.AddCookie(&http.Cookie{
+			Name:  "userid",
+			Value: signedID,
+		})
+		w := httptest.NewRecorder()
+		handler.Router.ServeHTTP(w, request)
+		return w.Result()
+	}
+
+	result := serve(http.MethodDelete, "/api/user/urls", `["`+ownURL+`","`+otherURL+`"]`, ownerID)
+	var job models.DeleteJob
+	require.NoError(t, json.NewDecoder(result.Body).Decode(&job))
+	require.NoError(t, result.Body.Close())
+	assert.Equal(t, http.StatusAccepted, result.StatusCode)
+	assert.Equal(t, "/api/user/jobs/"+job.ID, result.Header.Get("Location"))
+
+	require.Eventually(t, func() bool {
+		result := serve(http.MethodGet, "/api/user/jobs/"+job.ID, "", ownerID)
+		defer result.Body.Close()
+		require.Equal(t, http.StatusOK, result.StatusCode)
+		require.NoError(t, json.NewDecoder(result.Body).Decode(&job))
+		return job.Status == models.JobSucceeded
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{ownURL}, job.Deleted)
+	assert.Equal(t, []string{otherURL}, job.Skipped)
+
+	result = serve(http.MethodGet, "/api/user/jobs/"+job.ID, "", otherID)
+	require.NoError(t, result.Body.Close())
+	assert.Equal(t, http.StatusNotFound, result.StatusCode)
+}
+
+func TestShortener_DeleteDrain(t *testing.T) {
+	server.Cfg.DBType = server.DBMap
+
+	if err := env.Parse(&server.Cfg); err != nil {
+		log.Fatal(err)
+	}
+	handler, err := New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	t.Cleanup(func() { handler.Close(context.Background()) })
+	userID, err := handler.Storage.NewUser(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serve := func(urlID string) *http.Response {
+		request := httptest.NewRequest(http.MethodDelete, "/api/user/urls", strings.NewReader(`["`+urlID+`"]`))
+		signedID, _ := service.SignUserID(userID)
+		request.AddCookie(&http.Cookie{
+			Name:  "userid",
+			Value: signedID,
+		})
+		w := httptest.NewRecorder()
+		handler.Router.ServeHTTP(w, request)
+		return w.Result()
+	}
+
+	jobs := make([]models.DeleteJob, 0, 2)
+	for _, originURL := range []string{"https://www.google.com/", "https://yandex.ru/"} {
+		urlID, err := handler.Storage.Add(context.Background(), originURL, userID, nil)
+		require.NoError(t, err)
+		result := serve(urlID)
+		var job models.DeleteJob
+		require.NoError(t, json.NewDecoder(result.Body).Decode(&job))
+		require.NoError(t, result.Body.Close())
+		require.Equal(t, http.StatusAccepted, result.StatusCode)
+		jobs = append(jobs, job)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, handler.Close(ctx))
+	for _, v := range jobs {
+		job, err := handler.DeleteWorker.Jobs.Get(context.Background(), v.ID, userID)
+		require.NoError(t, err)
+		assert.Equal(t, models.JobSucceeded, job.Status)
+		assert.Equal(t, v.URLsID, job.Deleted)
+	}
+
+	// deletions are rejected after the shutdown
+	result := serve(jobs[0].URLsID[0])
+	require.NoError(t, result.Body.Close())
+	assert.Equal(t, http.StatusServiceUnavailable, result.StatusCode)
+	assert.Equal(t, "1", result.Header.Get("Retry-After"))
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/romm80/shortener.git/internal/app/logger"
+	"github.com/romm80/shortener.git/internal/app/service/tracing"
+)
+
+// TracingMiddleware starts the request span continuing the trace of the traceparent header,
+// an invalid header starts a new trace
+func TracingMiddleware(c *gin.Context) {
+	ctx := c.Request.Context()
+	if parent, err := tracing.ParseTraceparent(c.GetHeader("traceparent")); err == nil {
+		ctx = tracing.ContextWithRemote(ctx, parent)
+	}
+	ctx, span := tracing.Start(ctx, "HTTP "+c.Request.Method,
+		"http.method", c.Request.Method,
+		"http.target", c.Request.URL.Path,
+	)
+	defer span.End()
+	c.Request = c.Request.WithContext(ctx)
+
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	status := c.Writer.Status()
+	span.SetName(c.Request.Method + " " + route)
+	span.SetAttributes("http.route", route, "http.status_code", status)
+	if id := logger.RequestID(c.Request.Context()); id != "" {
+		span.SetAttributes("request_id", id)
+	}
+	if status >= http.StatusInternalServerError {
+		if last := c.Errors.Last(); last != nil {
+			span.SetError(last)
+		} else {
+			span.SetError(errors.New(http.StatusText(status)))
+		}
+	}
+}
+
+// traced wraps the handler or the middleware into the child span of the request span,
+// the spans of the next handlers called by the middleware are nested into its span
+func traced(name string, h gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		parent := c.Request.Context()
+		ctx, span := tracing.Start(parent, name)
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+
+		h(c)
+
+		if last := c.Errors.Last(); last != nil && c.Writer.Status() >= http.StatusInternalServerError {
+			span.SetError(last)
+		}
+		c.Request = c.Request.WithContext(parent)
+	}
+}
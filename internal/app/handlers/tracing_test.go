@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caarlos0/env/v6"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/romm80/shortener.git/internal/app/server"
+	"github.com/romm80/shortener.git/internal/app/service/tracing"
+)
+
+const (
+	testTraceID  = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testParentID = "00f067aa0ba902b7"
+)
+
+// spans returns the exported spans of the trace by name
+func (b *syncBuffer) spans(traceID string) map[string]tracing.SpanData {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	spans := make(map[string]tracing.SpanData)
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		var span tracing.SpanData
+		if json.Unmarshal([]byte(line), &span) == nil && span.TraceID == traceID {
+			spans[span.Name] = span
+		}
+	}
+	return spans
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	server.Cfg.DBType = server.DBMap
+
+	if err := env.Parse(&server.Cfg); err != nil {
+		log.Fatal(err)
+	}
+	handler, err := New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	t.Cleanup(func() { handler.Close(context.Background()) })
+
+	out := &syncBuffer{}
+	defaultTracer := tracing.Default()
+	tracing.SetDefault(tracing.NewTracer(tracing.NewWriterExporter(out)))
+	defer tracing.SetDefault(defaultTracer)
+
+	traceparent := "00-" + testTraceID + "-" + testParentID + "-01"
+	request := httptest.NewRequest(http.MethodGet, "/api/user/urls", nil)
+	request.Header.Set("traceparent", traceparent)
+	w := httptest.NewRecorder()
+	handler.Router.ServeHTTP(w, request)
+	result := w.Result()
+	require.NoError(t, result.Body.Close())
+
+	spans := out.spans(testTraceID)
+	root, ok := spans["GET /api/user/urls"]
+	require.True(t, ok, "request span is not exported")
+	assert.Equal(t, testParentID, root.ParentID)
+	assert.Equal(t, float64(result.StatusCode), root.Attributes["http.status_code"])
+
+	// each span is nested into the previous one
+	chain := []string{"GET /api/user/urls", "middleware.gzip", "middleware.auth", "storage.new_user"}
+	for i := 1; i < len(chain); i++ {
+		span, ok := spans[chain[i]]
+		require.True(t, ok, "span %s is not exported", chain[i])
+		assert.Equal(t, spans[chain[i-1]].SpanID, span.ParentID, chain[i])
+	}
+	assert.Equal(t, spans["middleware.auth"].SpanID, spans["handler.get_user_urls"].ParentID)
+
+	t.Run("delete worker", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodDelete, "/api/user/urls", strings.NewReader(`["abc"]`))
+		request.Header.Set("traceparent", "00-"+strings.Repeat("1", 32)+"-"+testParentID+"-01")
+		w := httptest.NewRecorder()
+		handler.Router.ServeHTTP(w, request)
+		result := w.Result()
+		require.NoError(t, result.Body.Close())
+		require.Equal(t, http.StatusAccepted, result.StatusCode)
+
+		assert.Eventually(t, func() bool {
+			spans := out.spans(strings.Repeat("1", 32))
+			batch, ok := spans["delete_worker.batch"]
+			return ok && spans["storage.delete_batch"].ParentID == batch.SpanID &&
+				batch.ParentID == spans["handler.delete_user_urls"].SpanID
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
@@ -0,0 +1,55 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(buf, LevelInfo).With("component", "test")
+
+	l.Debug("hidden")
+	l.Info("shown", "error", errors.New("boom"), "latency", time.Second, "count", 3, "odd")
+	ctx := WithRequestID(WithContext(context.Background(), l), "abc")
+	FromContext(ctx).Error("failed")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+
+	var first map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &first))
+	assert.Equal(t, "info", first["level"])
+	assert.Equal(t, "shown", first["msg"])
+	assert.Equal(t, "test", first["component"])
+	assert.Equal(t, "boom", first["error"])
+	assert.Equal(t, "1s", first["latency"])
+	assert.Equal(t, float64(3), first["count"])
+	assert.Equal(t, "!MISSING", first["odd"])
+	assert.NotEmpty(t, first["time"])
+
+	var second map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &second))
+	assert.Equal(t, "error", second["level"])
+	assert.Equal(t, "test", second["component"])
+	assert.Equal(t, "abc", second["request_id"])
+	assert.Equal(t, "abc", RequestID(ctx))
+	assert.Equal(t, "", RequestID(context.Background()))
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("WARN")
+	require.NoError(t, err)
+	assert.Equal(t, LevelWarn, level)
+
+	_, err = ParseLevel("verbose")
+	assert.Error(t, err)
+}
@@ -1,9 +1,14 @@
 // Package models describes data models
 package models
 
+import "time"
+
 // RequestURL original link for shortening
 type RequestURL struct {
-	URL string `json:"url"`
+	URL       string     `json:"url"`
+	Alias     string     `json:"alias,omitempty"`      // optional custom link id
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // optional link expiration time
+	TTL       string     `json:"ttl,omitempty"`        // optional link lifetime, e.g. "72h"
 }
 
 // ResponseURL shortened link
@@ -13,20 +18,37 @@ type ResponseURL struct {
 
 // RequestBatch batch request for link shortening
 type RequestBatch struct {
-	CorrelationID string `json:"correlation_id"`
-	OriginalURL   string `json:"original_url"`
+	CorrelationID string     `json:"correlation_id"`
+	OriginalURL   string     `json:"original_url"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"` // optional link expiration time
+	TTL           string     `json:"ttl,omitempty"`        // optional link lifetime, e.g. "72h"
 }
 
+// BatchStatus result of shortening a batch item
+type BatchStatus string
+
+const (
+	BatchCreated  BatchStatus = "created"  // the link is shortened
+	BatchExisting BatchStatus = "existing" // the link was already shortened
+	BatchInvalid  BatchStatus = "invalid"  // the item is rejected, the reason is in the error
+	BatchAborted  BatchStatus = "aborted"  // the stream is cut off by the error, the next items are not processed
+)
+
 // ResponseBatch result of batch shortening links
 type ResponseBatch struct {
-	CorrelationID string `json:"correlation_id"`
-	ShortURL      string `json:"short_url"`
+	CorrelationID string      `json:"correlation_id"`
+	ShortURL      string      `json:"short_url,omitempty"`
+	Status        BatchStatus `json:"status"`
+	Error         string      `json:"error,omitempty"`
 }
 
 // URLsID data to write to file
 type URLsID struct {
-	ID          string `json:"id"`
-	OriginalURL string `json:"original_url"`
+	ID          string     `json:"id"`
+	OriginalURL string     `json:"original_url"`
+	Alias       bool       `json:"alias,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"` // tombstone of the deleted link
 }
 
 // UserURLs shortened link query result by user id
@@ -34,3 +56,135 @@ type UserURLs struct {
 	ShortURL    string `json:"short_url"`
 	OriginalURL string `json:"original_url"`
 }
+
+// URLsQuery user links pagination, sorting and filtering parameters
+type URLsQuery struct {
+	Limit  int    // page size, 0 - all links
+	Cursor string // position after the last link of the previous page
+	Sort   string // sort field: "created" or "url"
+	Desc   bool   // descending order
+	Domain string // destination domain filter, subdomains included
+	Search string // original link substring filter, case insensitive
+}
+
+// UserURLsPage page of user links
+type UserURLsPage struct {
+	URLs       []UserURLs
+	NextCursor string // empty on the last page
+}
+
+// Cursor decoded page position: sort key and id of the last link on the page
+type Cursor struct {
+	CreatedAt time.Time `json:"c,omitempty"`
+	URL       string    `json:"u,omitempty"`
+	ID        string    `json:"i"`
+}
+
+// ResponseError error description
+type ResponseError struct {
+	Error string `json:"error"`
+}
+
+// Click redirect event via a shortened link
+type Click struct {
+	URLID     string    `json:"url_id"`
+	Time      time.Time `json:"time"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+}
+
+// LinkStats shortened link click statistics
+type LinkStats struct {
+	Total int64      `json:"total"`
+	Days  []DayStats `json:"days"`
+}
+
+// DayStats number of clicks per day
+type DayStats struct {
+	Date   string `json:"date"`
+	Clicks int64  `json:"clicks"`
+}
+
+// URLHistory previous destination of the shortened link
+type URLHistory struct {
+	OriginalURL string    `json:"original_url"`
+	ReplacedAt  time.Time `json:"replaced_at"`
+}
+
+// TrashURL deleted link that can be restored
+type TrashURL struct {
+	ShortURL    string    `json:"short_url"`
+	OriginalURL string    `json:"original_url"`
+	DeletedAt   time.Time `json:"deleted_at"`
+}
+
+// IdempotentResponse response remembered by the idempotency key
+type IdempotentResponse struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// JobStatus state of the asynchronous job
+type JobStatus string
+
+const (
+	JobPending   JobStatus = "pending"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+)
+
+// DeleteJob asynchronous links deletion
+type DeleteJob struct {
+	ID         string     `json:"id"`
+	UserID     uint64     `json:"-"`
+	Status     JobStatus  `json:"status"`
+	URLsID     []string   `json:"urls"`              // requested link ids
+	Deleted    []string   `json:"deleted,omitempty"` // deleted link ids
+	Skipped    []string   `json:"skipped,omitempty"` // link ids not found among the user links
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// QueueMessage background job queue message
+type QueueMessage struct {
+	ID       string
+	Kind     string // job type, consumers dequeue messages of their kind
+	Payload  []byte
+	Attempts int // number of deliveries including the current one
+}
+
+// ComponentStatus state of the component checked by the readiness probe
+type ComponentStatus string
+
+const (
+	ComponentOK      ComponentStatus = "ok"
+	ComponentFailed  ComponentStatus = "failed"
+	ComponentSkipped ComponentStatus = "skipped" // the check does not apply to the configuration
+)
+
+// ComponentCheck result of the component check
+type ComponentCheck struct {
+	Status ComponentStatus `json:"status"`
+	Detail string          `json:"detail,omitempty"`
+}
+
+// Readiness readiness probe response
+type Readiness struct {
+	Ready      bool                      `json:"ready"`
+	Components map[string]ComponentCheck `json:"components"`
+}
+
+// PoolStats storage connection pool statistics
+type PoolStats struct {
+	Total             int32         // number of open connections
+	Acquired          int32         // number of connections in use
+	Idle              int32         // number of idle connections
+	Max               int32         // maximum size of the pool
+	AcquireCount      int64         // number of successful acquires
+	EmptyAcquireCount int64         // number of acquires which waited for a connection
+	AcquireDuration   time.Duration // total time spent acquiring connections
+}
@@ -3,8 +3,14 @@ package dbpostgres
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/golang-migrate/migrate/v4"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 
 	"github.com/romm80/shortener.git/internal/app"
@@ -14,22 +20,52 @@ import (
 )
 
 type DB struct {
-	pool *pgxpool.Pool
+	pool      *pgxpool.Pool
+	idGen     service.IDGenerator
+	locks     *advisoryLocks
+	migration uint // schema version expected by the instance
 }
 
 var (
-	sqlInsertURLID = `WITH 	extant AS 	(SELECT url_id FROM urls_id WHERE url = ($2)),
-							inserted AS (INSERT INTO urls_id (url_id, url, user_id) SELECT ($1), ($2), ($3)
+	// expired links which are not reaped yet are marked deleted, so the links are shortened again with new ids
+	sqlExpireURLs = `UPDATE urls_id SET deleted=true, deleted_at=now()
+						WHERE url = any($1) AND NOT alias AND NOT deleted AND expires_at <= now()`
+	sqlInsertURLID = `WITH 	extant AS 	(SELECT url_id FROM urls_id WHERE url = ($2) AND NOT alias AND NOT deleted),
+							inserted AS (INSERT INTO urls_id (url_id, url, user_id, expires_at) SELECT ($1), ($2), ($3), ($4)
 											WHERE NOT EXISTS (SELECT NULL FROM extant)
+											ON CONFLICT (url_id) DO NOTHING
 											RETURNING url_id)
 							SELECT url_id, 'succes' FROM inserted
 							UNION ALL
 							SELECT url_id, 'conflict' FROM extant`
+
+	sqlCreateBatchTable = `CREATE TEMP TABLE urls_batch (
+								pos integer PRIMARY KEY,
+								url_id character varying NOT NULL,
+								url character varying NOT NULL,
+								expires_at timestamptz
+							) ON COMMIT DROP`
+	sqlInsertBatch = `WITH 	extant AS 	(SELECT b.pos, u.url_id FROM urls_batch b JOIN urls_id u ON u.url = b.url AND NOT u.alias AND NOT u.deleted),
+							inserted AS (INSERT INTO urls_id (url_id, url, user_id, expires_at)
+											SELECT b.url_id, b.url, ($1), b.expires_at FROM urls_batch b
+											WHERE NOT EXISTS (SELECT NULL FROM extant e WHERE e.pos = b.pos)
+											ORDER BY b.pos
+											ON CONFLICT DO NOTHING
+											RETURNING url_id, url)
+							SELECT b.pos, i.url_id, false FROM inserted i JOIN urls_batch b ON b.url_id = i.url_id AND b.url = i.url
+							UNION ALL
+							SELECT pos, url_id, true FROM extant`
 )
 
 func New() (*DB, error) {
 
-	if err := migrateDB(); err != nil {
+	idGen, err := service.NewIDGenerator()
+	if err != nil {
+		return nil, err
+	}
+
+	migration, err := migrateDB()
+	if err != nil {
 		return nil, err
 	}
 
@@ -42,26 +78,48 @@ func New() (*DB, error) {
 		return nil, err
 	}
 
-	return &DB{pool: pool}, nil
+	return &DB{
+		pool:      pool,
+		idGen:     idGen,
+		locks:     &advisoryLocks{mu: &sync.Mutex{}, held: make(map[string]bool)},
+		migration: migration,
+	}, nil
 }
 
-func migrateDB() error {
+// migrateDB applies the migrations and returns the schema version
+func migrateDB() (uint, error) {
 
 	m, err := migrate.New(
-		"file://db/migrations",
+		"file://"+server.Cfg.MigrationsPath,
 		server.Cfg.DatabaseDNS)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	if err := m.Up(); err != nil && err.Error() != "no change" {
+		return 0, err
+	}
+	version, _, err := m.Version()
+	return version, err
+}
+
+// CheckMigrations checks the schema is at the version applied on start and is not left dirty by a failed migration
+func (db *DB) CheckMigrations(ctx context.Context) error {
+	var version int64
+	var dirty bool
+	if err := db.pool.QueryRow(ctx, `SELECT version, dirty FROM schema_migrations`).Scan(&version, &dirty); err != nil {
 		return err
 	}
+	if dirty {
+		return fmt.Errorf("%w: version %d is dirty", app.ErrMigrationVersion, version)
+	}
+	if version != int64(db.migration) {
+		return fmt.Errorf("%w: %d, expected %d", app.ErrMigrationVersion, version, db.migration)
+	}
 	return nil
 }
 
-func (db *DB) Add(url string, userID uint64) (string, error) {
-	ctx := context.Background()
+func (db *DB) Add(ctx context.Context, url string, userID uint64, expiresAt *time.Time) (string, error) {
 	conn, err := db.pool.Acquire(ctx)
 	if err != nil {
 		return "", err
@@ -74,14 +132,25 @@ func (db *DB) Add(url string, userID uint64) (string, error) {
 	}
 	defer tx.Rollback(ctx)
 
-	urlID := service.ShortenURLID(url)
-	var status string
-	var errConflict error
-
-	err = tx.QueryRow(ctx, sqlInsertURLID, urlID, url, userID).Scan(&urlID, &status)
+	if _, err := tx.Exec(ctx, sqlExpireURLs, []string{url}); err != nil {
+		return "", err
+	}
+	urlID, status, err := db.insertURL(ctx, tx, url, userID, expiresAt)
+	if isUniqueViolation(err, "original_url") {
+		// the link is inserted by a concurrent request, the failed transaction is rolled back before the lookup
+		if err := tx.Rollback(ctx); err != nil {
+			return "", err
+		}
+		err = conn.QueryRow(ctx, `SELECT url_id FROM urls_id WHERE url = ($1) AND NOT alias AND NOT deleted`, url).Scan(&urlID)
+		if err != nil {
+			return "", err
+		}
+		return urlID, app.ErrConflictURLID
+	}
 	if err != nil {
 		return "", err
 	}
+	var errConflict error
 	if status == "conflict" {
 		errConflict = app.ErrConflictURLID
 	}
@@ -92,8 +161,67 @@ func (db *DB) Add(url string, userID uint64) (string, error) {
 	return urlID, errConflict
 }
 
-func (db *DB) AddBatch(urls []models.RequestBatch, userID uint64) ([]models.ResponseBatch, error) {
-	ctx := context.Background()
+// insertURL inserts the link with a free id. Returns the id and the "conflict" status
+// if the link already exists. The query returns no rows when the generated id is taken,
+// in this case the insert is repeated with the next candidate id
+func (db *DB) insertURL(ctx context.Context, tx pgx.Tx, url string, userID uint64, expiresAt *time.Time) (string, string, error) {
+	for attempt := 0; attempt < service.MaxIDAttempts; attempt++ {
+		urlID, err := db.idGen.Generate(url, attempt)
+		if err != nil {
+			return "", "", err
+		}
+
+		var status string
+		err = tx.QueryRow(ctx, sqlInsertURLID, urlID, url, userID, expiresAt).Scan(&urlID, &status)
+		if errors.Is(err, pgx.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return "", "", err
+		}
+		return urlID, status, nil
+	}
+	return "", "", service.ErrIDAttemptsExceeded
+}
+
+// isUniqueViolation checks the error is a violation (code 23505) of the unique index
+func isUniqueViolation(err error, index string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == index
+}
+
+func (db *DB) AddAlias(ctx context.Context, url, alias string, userID uint64, expiresAt *time.Time) (string, error) {
+	conn, err := db.pool.Acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, `INSERT INTO urls_id (url_id, url, user_id, alias, expires_at) VALUES ($1, $2, $3, true, $4)
+										ON CONFLICT (url_id) DO NOTHING`, alias, url, userID, expiresAt)
+	if err != nil {
+		return "", err
+	}
+	if tag.RowsAffected() == 1 {
+		return alias, nil
+	}
+
+	var ownerURL string
+	var ownerID uint64
+	err = conn.QueryRow(ctx, `SELECT url, user_id FROM urls_id WHERE url_id = ($1)`, alias).Scan(&ownerURL, &ownerID)
+	if err != nil {
+		return "", err
+	}
+	if ownerID == userID && ownerURL == url {
+		return alias, app.ErrConflictURLID
+	}
+	return "", app.ErrAliasTaken
+}
+
+// AddBatch copies the links into a staging table and inserts them with a single statement.
+// Links which are already stored are returned with the existing status, links whose generated id
+// is taken are copied again with the next candidate id
+func (db *DB) AddBatch(ctx context.Context, urls []models.RequestBatch, userID uint64) ([]models.ResponseBatch, error) {
 	conn, err := db.pool.Acquire(ctx)
 	if err != nil {
 		return nil, err
@@ -106,51 +234,145 @@ func (db *DB) AddBatch(urls []models.RequestBatch, userID uint64) ([]models.Resp
 	}
 	defer tx.Rollback(ctx)
 
-	respBatch := make([]models.ResponseBatch, 0)
+	if _, err := tx.Exec(ctx, sqlCreateBatchTable); err != nil {
+		return nil, err
+	}
+	originURLs := make([]string, 0, len(urls))
 	for _, v := range urls {
-		urlID := service.ShortenURLID(v.OriginalURL)
-		if err = tx.QueryRow(ctx, sqlInsertURLID, urlID, v.OriginalURL, userID).Scan(&urlID, new(string)); err != nil {
+		originURLs = append(originURLs, v.OriginalURL)
+	}
+	if _, err := tx.Exec(ctx, sqlExpireURLs, originURLs); err != nil {
+		return nil, err
+	}
+
+	// repeated links of the batch are inserted once
+	first := make(map[string]int, len(urls))
+	pending := make([]int, 0, len(urls))
+	for i, v := range urls {
+		if _, ok := first[v.OriginalURL]; !ok {
+			first[v.OriginalURL] = i
+			pending = append(pending, i)
+		}
+	}
+
+	ids := make([]string, len(urls))
+	conflicts := make([]bool, len(urls))
+	for attempt := 0; len(pending) > 0; attempt++ {
+		if attempt == service.MaxIDAttempts {
+			return nil, service.ErrIDAttemptsExceeded
+		}
+		if pending, err = db.insertBatch(ctx, tx, urls, pending, userID, attempt, ids, conflicts); err != nil {
 			return nil, err
 		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	respBatch := make([]models.ResponseBatch, 0, len(urls))
+	for i, v := range urls {
+		pos := first[v.OriginalURL]
+		status := models.BatchCreated
+		if conflicts[pos] || pos != i {
+			status = models.BatchExisting
+		}
 		respBatch = append(respBatch, models.ResponseBatch{
 			CorrelationID: v.CorrelationID,
-			ShortURL:      service.BaseURL(urlID),
+			ShortURL:      service.BaseURL(ids[pos]),
+			Status:        status,
 		})
 	}
-	if err := tx.Commit(ctx); err != nil {
+	return respBatch, nil
+}
+
+// insertBatch copies the pending links with ids of the attempt into the staging table and inserts them.
+// Fills in ids and conflicts of the stored links and returns positions of the links whose id is taken
+func (db *DB) insertBatch(ctx context.Context, tx pgx.Tx, urls []models.RequestBatch, pending []int, userID uint64,
+	attempt int, ids []string, conflicts []bool) ([]int, error) {
+	if _, err := tx.Exec(ctx, `TRUNCATE urls_batch`); err != nil {
 		return nil, err
 	}
 
-	return respBatch, nil
+	rows := make([][]interface{}, 0, len(pending))
+	for _, pos := range pending {
+		urlID, err := db.idGen.Generate(urls[pos].OriginalURL, attempt)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, []interface{}{pos, urlID, urls[pos].OriginalURL, urls[pos].ExpiresAt})
+	}
+	_, err := tx.CopyFrom(ctx, pgx.Identifier{"urls_batch"}, []string{"pos", "url_id", "url", "expires_at"},
+		pgx.CopyFromRows(rows))
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := tx.Query(ctx, sqlInsertBatch, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	stored := make(map[int]struct{}, len(pending))
+	for result.Next() {
+		var pos int
+		var urlID string
+		var conflict bool
+		if err := result.Scan(&pos, &urlID, &conflict); err != nil {
+			return nil, err
+		}
+		ids[pos] = urlID
+		conflicts[pos] = conflict
+		stored[pos] = struct{}{}
+	}
+	if err := result.Err(); err != nil {
+		return nil, err
+	}
+
+	taken := make([]int, 0)
+	for _, pos := range pending {
+		if _, ok := stored[pos]; !ok {
+			taken = append(taken, pos)
+		}
+	}
+	return taken, nil
 }
 
-func (db *DB) Get(id string) (originURL string, err error) {
-	conn, err := db.pool.Acquire(context.Background())
+func (db *DB) Get(ctx context.Context, id string) (originURL string, err error) {
+	conn, err := db.pool.Acquire(ctx)
 	if err != nil {
 		return
 	}
 	defer conn.Release()
 
 	deleted := false
-	err = conn.QueryRow(context.Background(), `SELECT url, deleted FROM urls_id WHERE url_id=$1`, id).Scan(&originURL, &deleted)
+	var expiresAt *time.Time
+	err = conn.QueryRow(ctx, `SELECT url, deleted, expires_at FROM urls_id WHERE url_id=$1`, id).Scan(&originURL, &deleted, &expiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// never created or purged
+		return "", app.ErrLinkNoFound
+	}
 	if err != nil {
 		return
 	}
 	if deleted {
 		err = app.ErrDeletedURL
+	} else if service.Expired(expiresAt) {
+		err = app.ErrExpiredURL
 	}
 	return
 }
 
-func (db *DB) GetUserURLs(userID uint64) ([]models.UserURLs, error) {
+func (db *DB) GetUserURLs(ctx context.Context, userID uint64) ([]models.UserURLs, error) {
 	urls := make([]models.UserURLs, 0)
-	conn, err := db.pool.Acquire(context.Background())
+	conn, err := db.pool.Acquire(ctx)
 	if err != nil {
 		return urls, err
 	}
 	defer conn.Release()
 
-	rows, err := conn.Query(context.Background(), `SELECT url_id, url FROM urls_id WHERE user_id=($1)`, userID)
+	rows, err := conn.Query(ctx, `SELECT url_id, url FROM urls_id WHERE user_id=($1) AND NOT deleted`, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -167,47 +389,331 @@ func (db *DB) GetUserURLs(userID uint64) ([]models.UserURLs, error) {
 	return urls, nil
 }
 
-func (db *DB) NewUser() (userID uint64, err error) {
-	conn, err := db.pool.Acquire(context.Background())
+// GetUserURLsPage returns a page of user links using a keyset query
+// on the (user_id, created_at, url_id) or (user_id, url, url_id) index, an exact domain uses the (user_id, host) index
+func (db *DB) GetUserURLsPage(ctx context.Context, userID uint64, query models.URLsQuery) (models.UserURLsPage, error) {
+	page := models.UserURLsPage{URLs: make([]models.UserURLs, 0)}
+
+	sortColumn, cmp, order := "created_at", ">", "ASC"
+	if query.Sort == service.SortURL {
+		sortColumn = "url"
+	}
+	if query.Desc {
+		cmp, order = "<", "DESC"
+	}
+
+	args := []interface{}{userID}
+	sql := `SELECT url_id, url, created_at FROM urls_id WHERE user_id = ($1) AND NOT deleted`
+	if query.Domain != "" {
+		args = append(args, query.Domain)
+		// the stored host column is compared without patterns, so the domain needs no escaping
+		sql += fmt.Sprintf(` AND (host = ($%[1]d) OR right(host, length($%[1]d) + 1) = '.' || ($%[1]d))`, len(args))
+	}
+	if query.Search != "" {
+		args = append(args, query.Search)
+		sql += fmt.Sprintf(` AND strpos(lower(url), lower($%d)) > 0`, len(args))
+	}
+	if query.Cursor != "" {
+		cursor, err := service.DecodeCursor(query.Cursor)
+		if err != nil {
+			return page, err
+		}
+		var value interface{} = cursor.CreatedAt
+		if query.Sort == service.SortURL {
+			value = cursor.URL
+		}
+		args = append(args, value, cursor.ID)
+		sql += fmt.Sprintf(` AND (%s, url_id) %s ($%d, $%d)`, sortColumn, cmp, len(args)-1, len(args))
+	}
+	sql += fmt.Sprintf(` ORDER BY %[1]s %[2]s, url_id %[2]s`, sortColumn, order)
+	if query.Limit > 0 {
+		args = append(args, query.Limit+1)
+		sql += fmt.Sprintf(` LIMIT $%d`, len(args))
+	}
+
+	rows, err := db.pool.Query(ctx, sql, args...)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+
+	var last service.URLRecord
+	for rows.Next() {
+		record := service.URLRecord{}
+		if err := rows.Scan(&record.ID, &record.OriginalURL, &record.CreatedAt); err != nil {
+			return page, err
+		}
+		if query.Limit > 0 && len(page.URLs) == query.Limit {
+			page.NextCursor = service.NextCursor(last, query.Sort)
+			break
+		}
+		page.URLs = append(page.URLs, models.UserURLs{
+			ShortURL:    service.BaseURL(record.ID),
+			OriginalURL: record.OriginalURL,
+		})
+		last = record
+	}
+	return page, rows.Err()
+}
+
+func (db *DB) NewUser(ctx context.Context) (userID uint64, err error) {
+	conn, err := db.pool.Acquire(ctx)
 	if err != nil {
 		return
 	}
 	defer conn.Release()
 
-	err = conn.QueryRow(context.Background(), `INSERT INTO users (id) VALUES(default) RETURNING (id)`).Scan(&userID)
+	err = conn.QueryRow(ctx, `INSERT INTO users (id) VALUES(default) RETURNING (id)`).Scan(&userID)
 	if err != nil {
 		return
 	}
 	return
 }
 
-func (db *DB) Ping() error {
-	return db.pool.Ping(context.Background())
+func (db *DB) PoolStats() models.PoolStats {
+	stat := db.pool.Stat()
+	return models.PoolStats{
+		Total:             stat.TotalConns(),
+		Acquired:          stat.AcquiredConns(),
+		Idle:              stat.IdleConns(),
+		Max:               stat.MaxConns(),
+		AcquireCount:      stat.AcquireCount(),
+		EmptyAcquireCount: stat.EmptyAcquireCount(),
+		AcquireDuration:   stat.AcquireDuration(),
+	}
+}
+
+func (db *DB) Ping(ctx context.Context) error {
+	return db.pool.Ping(ctx)
+}
+
+func (db *DB) DeleteBatch(ctx context.Context, userID uint64, urlsID []string) ([]string, error) {
+	rows, err := db.pool.Query(ctx, `UPDATE urls_id SET deleted=true, deleted_at=now()
+														WHERE user_id = ($1) AND url_id = any($2) AND NOT deleted
+														RETURNING url_id`, userID, urlsID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deleted := make([]string, 0, len(urlsID))
+	for rows.Next() {
+		var urlID string
+		if err := rows.Scan(&urlID); err != nil {
+			return nil, err
+		}
+		deleted = append(deleted, urlID)
+	}
+	return deleted, rows.Err()
+}
+
+func (db *DB) DeleteExpired(ctx context.Context) error {
+	_, err := db.pool.Exec(ctx, `UPDATE urls_id SET deleted=true, deleted_at=now() WHERE NOT deleted AND expires_at <= now()`)
+	return err
 }
 
-func (db *DB) DeleteBatch(userID uint64, urlsID []string) error {
+// AddClicks stores the clicks, clicks of the links purged in the meantime are skipped
+// so they do not fail the whole batch
+func (db *DB) AddClicks(ctx context.Context, clicks []models.Click) error {
+	urlsID := make([]string, 0, len(clicks))
+	times := make([]time.Time, 0, len(clicks))
+	referrers := make([]string, 0, len(clicks))
+	userAgents := make([]string, 0, len(clicks))
+	ips := make([]string, 0, len(clicks))
+	for _, click := range clicks {
+		urlsID = append(urlsID, click.URLID)
+		times = append(times, click.Time)
+		referrers = append(referrers, click.Referrer)
+		userAgents = append(userAgents, click.UserAgent)
+		ips = append(ips, click.IP)
+	}
+
+	_, err := db.pool.Exec(ctx, `INSERT INTO clicks (url_id, clicked_at, referrer, user_agent, ip)
+									SELECT c.url_id, c.clicked_at, c.referrer, c.user_agent, c.ip
+									FROM unnest($1::varchar[], $2::timestamptz[], $3::varchar[], $4::varchar[], $5::varchar[])
+										AS c(url_id, clicked_at, referrer, user_agent, ip)
+									WHERE EXISTS (SELECT NULL FROM urls_id u WHERE u.url_id = c.url_id)`,
+		urlsID, times, referrers, userAgents, ips)
+	return err
+}
 
-	ctx := context.Background()
+func (db *DB) GetStats(ctx context.Context, urlID string, userID uint64) (models.LinkStats, error) {
+	stats := models.LinkStats{Days: make([]models.DayStats, 0)}
 	conn, err := db.pool.Acquire(ctx)
 	if err != nil {
-		return err
+		return stats, err
 	}
 	defer conn.Release()
 
-	tx, err := conn.Begin(ctx)
+	var ownerID uint64
+	err = conn.QueryRow(ctx, `SELECT user_id FROM urls_id WHERE url_id = ($1)`, urlID).Scan(&ownerID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return stats, app.ErrLinkNoFound
+	}
+	if err != nil {
+		return stats, err
+	}
+	if ownerID != userID {
+		return stats, app.ErrForbidden
+	}
+
+	rows, err := conn.Query(ctx, `SELECT (clicked_at AT TIME ZONE 'UTC')::date AS day, count(*) FROM clicks
+									WHERE url_id = ($1) GROUP BY day ORDER BY day`, urlID)
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var day time.Time
+		var clicks int64
+		if err := rows.Scan(&day, &clicks); err != nil {
+			return stats, err
+		}
+		stats.Total += clicks
+		stats.Days = append(stats.Days, models.DayStats{
+			Date:   day.Format(service.DateLayout),
+			Clicks: clicks,
+		})
+	}
+	return stats, rows.Err()
+}
+
+func (db *DB) UpdateURL(ctx context.Context, urlID, url string, userID uint64) error {
+	tx, err := db.pool.Begin(ctx)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback(ctx)
 
-	_, err = tx.Exec(ctx, `UPDATE urls_id SET deleted=true WHERE user_id = ($1) AND url_id = any($2)`, userID, urlsID)
+	var old string
+	var ownerID uint64
+	var deleted, alias bool
+	err = tx.QueryRow(ctx, `SELECT url, user_id, deleted, alias FROM urls_id WHERE url_id = ($1) FOR UPDATE`, urlID).
+		Scan(&old, &ownerID, &deleted, &alias)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return app.ErrLinkNoFound
+	}
 	if err != nil {
 		return err
 	}
+	if ownerID != userID {
+		return app.ErrForbidden
+	}
+	if deleted {
+		return app.ErrDeletedURL
+	}
+	if old == url {
+		return nil
+	}
 
-	if err := tx.Commit(ctx); err != nil {
+	if !alias {
+		if _, err := tx.Exec(ctx, sqlExpireURLs, []string{url}); err != nil {
+			return err
+		}
+		var exists bool
+		err = tx.QueryRow(ctx, `SELECT EXISTS (SELECT NULL FROM urls_id WHERE url = ($1) AND NOT alias AND NOT deleted)`, url).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return app.ErrConflictURLID
+		}
+	}
+
+	if _, err = tx.Exec(ctx, `INSERT INTO url_history (url_id, url) VALUES ($1, $2)`, urlID, old); err != nil {
 		return err
 	}
+	if _, err = tx.Exec(ctx, `UPDATE urls_id SET url = ($2) WHERE url_id = ($1)`, urlID, url); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (db *DB) GetURLHistory(ctx context.Context, urlID string, userID uint64) ([]models.URLHistory, error) {
+	conn, err := db.pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
 
-	return nil
+	var ownerID uint64
+	err = conn.QueryRow(ctx, `SELECT user_id FROM urls_id WHERE url_id = ($1)`, urlID).Scan(&ownerID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, app.ErrLinkNoFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ownerID != userID {
+		return nil, app.ErrForbidden
+	}
+
+	rows, err := conn.Query(ctx, `SELECT url, replaced_at FROM url_history WHERE url_id = ($1) ORDER BY replaced_at, id`, urlID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := make([]models.URLHistory, 0)
+	for rows.Next() {
+		h := models.URLHistory{}
+		if err := rows.Scan(&h.OriginalURL, &h.ReplacedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, h)
+	}
+	return history, rows.Err()
+}
+
+func (db *DB) GetUserTrash(ctx context.Context, userID uint64) ([]models.TrashURL, error) {
+	rows, err := db.pool.Query(ctx, `SELECT url_id, url, deleted_at FROM urls_id
+														WHERE user_id = ($1) AND deleted ORDER BY deleted_at, url_id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	urls := make([]models.TrashURL, 0)
+	for rows.Next() {
+		var urlID string
+		url := models.TrashURL{}
+		if err := rows.Scan(&urlID, &url.OriginalURL, &url.DeletedAt); err != nil {
+			return nil, err
+		}
+		url.ShortURL = service.BaseURL(urlID)
+		urls = append(urls, url)
+	}
+	return urls, rows.Err()
+}
+
+func (db *DB) RestoreBatch(ctx context.Context, userID uint64, urlsID []string) ([]string, error) {
+	// a link shortened again after the deletion is not restored, of several deleted links
+	// of the same original link the latest deleted one is restored
+	rows, err := db.pool.Query(ctx, `UPDATE urls_id SET deleted=false, deleted_at=NULL
+														WHERE url_id IN (
+															SELECT DISTINCT ON (CASE WHEN alias THEN url_id ELSE url END) url_id FROM urls_id r
+															WHERE user_id = ($1) AND url_id = any($2) AND deleted
+															AND (expires_at IS NULL OR expires_at > now())
+															AND (alias OR NOT EXISTS (SELECT NULL FROM urls_id l WHERE l.url = r.url AND NOT l.alias AND NOT l.deleted))
+															ORDER BY CASE WHEN alias THEN url_id ELSE url END, deleted_at DESC)
+														RETURNING url_id`, userID, urlsID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	restored := make([]string, 0, len(urlsID))
+	for rows.Next() {
+		var urlID string
+		if err := rows.Scan(&urlID); err != nil {
+			return nil, err
+		}
+		restored = append(restored, urlID)
+	}
+	return restored, rows.Err()
+}
+
+func (db *DB) PurgeDeleted(ctx context.Context, before time.Time) error {
+	_, err := db.pool.Exec(ctx, `DELETE FROM urls_id WHERE deleted AND deleted_at <= ($1)`, before)
+	return err
 }
@@ -0,0 +1,74 @@
+package dbpostgres
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/romm80/shortener.git/internal/app"
+	"github.com/romm80/shortener.git/internal/app/models"
+)
+
+// sqlBeginRequest reserves the key if it is new or expired, returns no rows if the key is in use
+var sqlBeginRequest = `INSERT INTO idempotency_keys (user_id, key, request_hash, expires_at) VALUES ($1, $2, $3, $4)
+						ON CONFLICT (user_id, key) DO UPDATE
+							SET request_hash = EXCLUDED.request_hash, expires_at = EXCLUDED.expires_at,
+								status = NULL, content_type = NULL, body = NULL
+							WHERE idempotency_keys.expires_at <= now()
+						RETURNING true`
+
+func (db *DB) BeginRequest(ctx context.Context, userID uint64, key, requestHash string, expiresAt time.Time) (*models.IdempotentResponse, error) {
+	var reserved bool
+	err := db.pool.QueryRow(ctx, sqlBeginRequest, userID, key, requestHash, expiresAt).Scan(&reserved)
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+
+	var storedHash string
+	var status *int32
+	var contentType *string
+	var body []byte
+	err = db.pool.QueryRow(ctx, `SELECT request_hash, status, content_type, body FROM idempotency_keys
+		WHERE user_id = ($1) AND key = ($2)`, userID, key).Scan(&storedHash, &status, &contentType, &body)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// the key is released concurrently, the client can retry
+		return nil, app.ErrRequestInProgress
+	}
+	if err != nil {
+		return nil, err
+	}
+	if storedHash != requestHash {
+		return nil, app.ErrIdempotencyMismatch
+	}
+	if status == nil {
+		return nil, app.ErrRequestInProgress
+	}
+
+	response := &models.IdempotentResponse{Status: int(*status), Body: body}
+	if contentType != nil {
+		response.ContentType = *contentType
+	}
+	return response, nil
+}
+
+func (db *DB) CompleteRequest(ctx context.Context, userID uint64, key string, response models.IdempotentResponse) error {
+	_, err := db.pool.Exec(ctx, `UPDATE idempotency_keys SET status = ($3), content_type = ($4), body = ($5)
+		WHERE user_id = ($1) AND key = ($2)`, userID, key, response.Status, response.ContentType, response.Body)
+	return err
+}
+
+func (db *DB) ReleaseRequest(ctx context.Context, userID uint64, key string) error {
+	_, err := db.pool.Exec(ctx, `DELETE FROM idempotency_keys WHERE user_id = ($1) AND key = ($2) AND status IS NULL`,
+		userID, key)
+	return err
+}
+
+func (db *DB) DeleteExpiredKeys(ctx context.Context) error {
+	_, err := db.pool.Exec(ctx, `DELETE FROM idempotency_keys WHERE expires_at <= now()`)
+	return err
+}
@@ -0,0 +1,136 @@
+package dbpostgres
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/romm80/shortener.git/internal/app"
+	"github.com/romm80/shortener.git/internal/app/models"
+)
+
+var (
+	// sqlEnqueue adds the message if the kind has less than limit messages, returns no rows otherwise.
+	// Concurrent inserts can exceed the limit slightly
+	sqlEnqueue = `INSERT INTO job_queue (kind, payload) SELECT ($1), ($2)
+					WHERE ($3)::integer <= 0 OR (SELECT count(*) FROM job_queue WHERE kind = ($1)) < ($3)::integer
+					RETURNING id`
+	// sqlDequeue leases available messages, messages leased by other instances are skipped
+	sqlDequeue = `UPDATE job_queue SET attempts = attempts + 1, available_at = now() + make_interval(secs => ($3))
+					WHERE id IN (SELECT id FROM job_queue WHERE kind = ($1) AND available_at <= now()
+									ORDER BY id LIMIT ($2) FOR UPDATE SKIP LOCKED)
+					RETURNING id, kind, payload, attempts`
+)
+
+func (db *DB) Enqueue(ctx context.Context, kind string, payload []byte, limit int) (string, error) {
+	var id int64
+	err := db.pool.QueryRow(ctx, sqlEnqueue, kind, payload, limit).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", app.ErrQueueFull
+	}
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(id, 10), nil
+}
+
+func (db *DB) Dequeue(ctx context.Context, kind string, limit int, visibility time.Duration) ([]models.QueueMessage, error) {
+	rows, err := db.pool.Query(ctx, sqlDequeue, kind, limit, visibility.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]int64, 0)
+	messages := make(map[int64]models.QueueMessage)
+	for rows.Next() {
+		var id int64
+		var m models.QueueMessage
+		if err := rows.Scan(&id, &m.Kind, &m.Payload, &m.Attempts); err != nil {
+			return nil, err
+		}
+		m.ID = strconv.FormatInt(id, 10)
+		ids = append(ids, id)
+		messages[id] = m
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// the update returns rows in arbitrary order
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	result := make([]models.QueueMessage, 0, len(ids))
+	for _, id := range ids {
+		result = append(result, messages[id])
+	}
+	return result, nil
+}
+
+func (db *DB) Ack(ctx context.Context, id string) error {
+	messageID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return err
+	}
+	_, err = db.pool.Exec(ctx, `DELETE FROM job_queue WHERE id = ($1)`, messageID)
+	return err
+}
+
+func (db *DB) Retry(ctx context.Context, id string, availableAt time.Time, reason string) error {
+	messageID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return err
+	}
+	_, err = db.pool.Exec(ctx, `UPDATE job_queue SET available_at = ($2), last_error = ($3) WHERE id = ($1)`,
+		messageID, availableAt, reason)
+	return err
+}
+
+func (db *DB) Pending(ctx context.Context, kind string) (int, error) {
+	var count int
+	err := db.pool.QueryRow(ctx, `SELECT count(*) FROM job_queue WHERE kind = ($1)`, kind).Scan(&count)
+	return count, err
+}
+
+// sqlSaveJob creates or replaces the job
+var sqlSaveJob = `INSERT INTO delete_jobs (id, user_id, status, urls_id, deleted, skipped, error, created_at, finished_at)
+					VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+					ON CONFLICT (id) DO UPDATE
+						SET status = EXCLUDED.status, deleted = EXCLUDED.deleted, skipped = EXCLUDED.skipped,
+							error = EXCLUDED.error, finished_at = EXCLUDED.finished_at`
+
+func (db *DB) SaveJobs(ctx context.Context, jobs ...models.DeleteJob) error {
+	batch := &pgx.Batch{}
+	for _, job := range jobs {
+		batch.Queue(sqlSaveJob, job.ID, job.UserID, string(job.Status), job.URLsID, job.Deleted, job.Skipped,
+			job.Error, job.CreatedAt, job.FinishedAt)
+	}
+	// the implicit transaction of the batch stores all jobs or none
+	return db.pool.SendBatch(ctx, batch).Close()
+}
+
+func (db *DB) GetJob(ctx context.Context, id string) (models.DeleteJob, error) {
+	job := models.DeleteJob{ID: id}
+	var status string
+	err := db.pool.QueryRow(ctx, `SELECT user_id, status, urls_id, deleted, skipped, error, created_at, finished_at
+		FROM delete_jobs WHERE id = ($1)`, id).
+		Scan(&job.UserID, &status, &job.URLsID, &job.Deleted, &job.Skipped, &job.Error, &job.CreatedAt, &job.FinishedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.DeleteJob{}, app.ErrJobNotFound
+	}
+	job.Status = models.JobStatus(status)
+	return job, err
+}
+
+func (db *DB) RemoveJob(ctx context.Context, id string) error {
+	_, err := db.pool.Exec(ctx, `DELETE FROM delete_jobs WHERE id = ($1)`, id)
+	return err
+}
+
+func (db *DB) RemoveFinishedJobs(ctx context.Context, before time.Time) error {
+	_, err := db.pool.Exec(ctx, `DELETE FROM delete_jobs WHERE finished_at < ($1)`, before)
+	return err
+}
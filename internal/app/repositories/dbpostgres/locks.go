@@ -0,0 +1,87 @@
+package dbpostgres
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// advisoryLocks session advisory locks of the instance.
+// The locks are held by a dedicated connection, they are released by the server when the connection is lost
+type advisoryLocks struct {
+	mu   *sync.Mutex
+	conn *pgxpool.Conn // nil while no lock is held
+	held map[string]bool
+}
+
+// lockKey returns the advisory lock key of the named lock
+func lockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("shortener:" + name))
+	return int64(h.Sum64())
+}
+
+func (db *DB) TryLock(ctx context.Context, name string) (bool, error) {
+	db.locks.mu.Lock()
+	defer db.locks.mu.Unlock()
+
+	if db.locks.conn == nil {
+		conn, err := db.pool.Acquire(ctx)
+		if err != nil {
+			return false, err
+		}
+		db.locks.conn = conn
+	}
+
+	if db.locks.held[name] {
+		// locks are lost together with the session
+		if err := db.locks.conn.Conn().Ping(ctx); err != nil {
+			db.resetLocks(ctx)
+			return false, err
+		}
+		return true, nil
+	}
+
+	// the lock is reentrant within the session, it is requested only if it is not held yet
+	var locked bool
+	if err := db.locks.conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1)`, lockKey(name)).Scan(&locked); err != nil {
+		db.resetLocks(ctx)
+		return false, err
+	}
+	if locked {
+		db.locks.held[name] = true
+	} else if len(db.locks.held) == 0 {
+		db.locks.conn.Release()
+		db.locks.conn = nil
+	}
+	return locked, nil
+}
+
+func (db *DB) Unlock(ctx context.Context, name string) error {
+	db.locks.mu.Lock()
+	defer db.locks.mu.Unlock()
+
+	if !db.locks.held[name] {
+		return nil
+	}
+	delete(db.locks.held, name)
+	if _, err := db.locks.conn.Exec(ctx, `SELECT pg_advisory_unlock($1)`, lockKey(name)); err != nil {
+		db.resetLocks(ctx)
+		return err
+	}
+	if len(db.locks.held) == 0 {
+		db.locks.conn.Release()
+		db.locks.conn = nil
+	}
+	return nil
+}
+
+// resetLocks closes the lock connection, the server releases all its locks, must be called under lock
+func (db *DB) resetLocks(ctx context.Context) {
+	db.locks.conn.Conn().Close(ctx)
+	db.locks.conn.Release()
+	db.locks.conn = nil
+	db.locks.held = make(map[string]bool)
+}
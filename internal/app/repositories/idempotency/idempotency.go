@@ -0,0 +1,96 @@
+// Package idempotency implements the in-memory idempotency keys store
+package idempotency
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/romm80/shortener.git/internal/app"
+	"github.com/romm80/shortener.git/internal/app/models"
+)
+
+type userKey struct {
+	userID uint64
+	key    string
+}
+
+type entry struct {
+	requestHash string
+	expiresAt   time.Time
+	response    *models.IdempotentResponse // nil while the request is in progress
+}
+
+// MemoryStore idempotency keys of the in-memory storages
+type MemoryStore struct {
+	mu   *sync.Mutex
+	keys map[userKey]*entry
+}
+
+// NewMemoryStore store initialization
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		mu:   &sync.Mutex{},
+		keys: make(map[userKey]*entry),
+	}
+}
+
+func (s *MemoryStore) BeginRequest(ctx context.Context, userID uint64, key, requestHash string, expiresAt time.Time) (*models.IdempotentResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	k := userKey{userID: userID, key: key}
+	if e, ok := s.keys[k]; ok && time.Now().Before(e.expiresAt) {
+		if e.requestHash != requestHash {
+			return nil, app.ErrIdempotencyMismatch
+		}
+		if e.response == nil {
+			return nil, app.ErrRequestInProgress
+		}
+		return e.response, nil
+	}
+	s.keys[k] = &entry{requestHash: requestHash, expiresAt: expiresAt}
+	return nil, nil
+}
+
+func (s *MemoryStore) CompleteRequest(ctx context.Context, userID uint64, key string, response models.IdempotentResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.keys[userKey{userID: userID, key: key}]; ok {
+		e.response = &response
+	}
+	return nil
+}
+
+func (s *MemoryStore) ReleaseRequest(ctx context.Context, userID uint64, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := userKey{userID: userID, key: key}
+	if e, ok := s.keys[k]; ok && e.response == nil {
+		delete(s.keys, k)
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteExpiredKeys(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for k, e := range s.keys {
+		if !now.Before(e.expiresAt) {
+			delete(s.keys, k)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package repositories
+
+import (
+	"context"
+	"time"
+
+	"github.com/romm80/shortener.git/internal/app/models"
+	"github.com/romm80/shortener.git/internal/app/service/tracing"
+)
+
+// Observer receives the duration and the result of every storage operation
+type Observer func(operation string, duration time.Duration, err error)
+
+// instrumented storage reporting its operations to the observer
+type instrumented struct {
+	Shortener
+	observe Observer
+}
+
+// Instrument wraps the storage to report its operations and trace them as spans.
+// Optional interfaces of the storage are checked on Unwrap(storage)
+func Instrument(storage Shortener, observe Observer) Shortener {
+	return &instrumented{Shortener: storage, observe: observe}
+}
+
+// finish reports the operation to the observer and ends its span
+func (s *instrumented) finish(span *tracing.Span, operation string, start time.Time, err error) {
+	s.observe(operation, time.Since(start), err)
+	span.SetError(err)
+	span.End()
+}
+
+// Unwrap returns the storage wrapped by Instrument
+func Unwrap(storage Shortener) Shortener {
+	if s, ok := storage.(*instrumented); ok {
+		return s.Shortener
+	}
+	return storage
+}
+
+func (s *instrumented) Add(ctx context.Context, url string, userID uint64, expiresAt *time.Time) (string, error) {
+	ctx, span := tracing.Start(ctx, "storage.add")
+	start := time.Now()
+	res, err := s.Shortener.Add(ctx, url, userID, expiresAt)
+	s.finish(span, "add", start, err)
+	return res, err
+}
+
+func (s *instrumented) AddBatch(ctx context.Context, urls []models.RequestBatch, userID uint64) ([]models.ResponseBatch, error) {
+	ctx, span := tracing.Start(ctx, "storage.add_batch")
+	start := time.Now()
+	res, err := s.Shortener.AddBatch(ctx, urls, userID)
+	s.finish(span, "add_batch", start, err)
+	return res, err
+}
+
+func (s *instrumented) AddAlias(ctx context.Context, url, alias string, userID uint64, expiresAt *time.Time) (string, error) {
+	ctx, span := tracing.Start(ctx, "storage.add_alias")
+	start := time.Now()
+	res, err := s.Shortener.AddAlias(ctx, url, alias, userID, expiresAt)
+	s.finish(span, "add_alias", start, err)
+	return res, err
+}
+
+func (s *instrumented) Get(ctx context.Context, id string) (string, error) {
+	ctx, span := tracing.Start(ctx, "storage.get")
+	start := time.Now()
+	res, err := s.Shortener.Get(ctx, id)
+	s.finish(span, "get", start, err)
+	return res, err
+}
+
+func (s *instrumented) GetUserURLs(ctx context.Context, userID uint64) ([]models.UserURLs, error) {
+	ctx, span := tracing.Start(ctx, "storage.get_user_urls")
+	start := time.Now()
+	res, err := s.Shortener.GetUserURLs(ctx, userID)
+	s.finish(span, "get_user_urls", start, err)
+	return res, err
+}
+
+func (s *instrumented) GetUserURLsPage(ctx context.Context, userID uint64, query models.URLsQuery) (models.UserURLsPage, error) {
+	ctx, span := tracing.Start(ctx, "storage.get_user_urls_page")
+	start := time.Now()
+	res, err := s.Shortener.GetUserURLsPage(ctx, userID, query)
+	s.finish(span, "get_user_urls_page", start, err)
+	return res, err
+}
+
+func (s *instrumented) NewUser(ctx context.Context) (uint64, error) {
+	ctx, span := tracing.Start(ctx, "storage.new_user")
+	start := time.Now()
+	res, err := s.Shortener.NewUser(ctx)
+	s.finish(span, "new_user", start, err)
+	return res, err
+}
+
+func (s *instrumented) Ping(ctx context.Context) error {
+	ctx, span := tracing.Start(ctx, "storage.ping")
+	start := time.Now()
+	err := s.Shortener.Ping(ctx)
+	s.finish(span, "ping", start, err)
+	return err
+}
+
+func (s *instrumented) DeleteBatch(ctx context.Context, userID uint64, urlsID []string) ([]string, error) {
+	ctx, span := tracing.Start(ctx, "storage.delete_batch")
+	start := time.Now()
+	res, err := s.Shortener.DeleteBatch(ctx, userID, urlsID)
+	s.finish(span, "delete_batch", start, err)
+	return res, err
+}
+
+func (s *instrumented) GetUserTrash(ctx context.Context, userID uint64) ([]models.TrashURL, error) {
+	ctx, span := tracing.Start(ctx, "storage.get_user_trash")
+	start := time.Now()
+	res, err := s.Shortener.GetUserTrash(ctx, userID)
+	s.finish(span, "get_user_trash", start, err)
+	return res, err
+}
+
+func (s *instrumented) RestoreBatch(ctx context.Context, userID uint64, urlsID []string) ([]string, error) {
+	ctx, span := tracing.Start(ctx, "storage.restore_batch")
+	start := time.Now()
+	res, err := s.Shortener.RestoreBatch(ctx, userID, urlsID)
+	s.finish(span, "restore_batch", start, err)
+	return res, err
+}
+
+func (s *instrumented) PurgeDeleted(ctx context.Context, before time.Time) error {
+	ctx, span := tracing.Start(ctx, "storage.purge_deleted")
+	start := time.Now()
+	err := s.Shortener.PurgeDeleted(ctx, before)
+	s.finish(span, "purge_deleted", start, err)
+	return err
+}
+
+func (s *instrumented) DeleteExpired(ctx context.Context) error {
+	ctx, span := tracing.Start(ctx, "storage.delete_expired")
+	start := time.Now()
+	err := s.Shortener.DeleteExpired(ctx)
+	s.finish(span, "delete_expired", start, err)
+	return err
+}
+
+func (s *instrumented) UpdateURL(ctx context.Context, urlID, url string, userID uint64) error {
+	ctx, span := tracing.Start(ctx, "storage.update_url")
+	start := time.Now()
+	err := s.Shortener.UpdateURL(ctx, urlID, url, userID)
+	s.finish(span, "update_url", start, err)
+	return err
+}
+
+func (s *instrumented) GetURLHistory(ctx context.Context, urlID string, userID uint64) ([]models.URLHistory, error) {
+	ctx, span := tracing.Start(ctx, "storage.get_url_history")
+	start := time.Now()
+	res, err := s.Shortener.GetURLHistory(ctx, urlID, userID)
+	s.finish(span, "get_url_history", start, err)
+	return res, err
+}
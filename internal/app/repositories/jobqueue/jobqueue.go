@@ -0,0 +1,483 @@
+// Package jobqueue implements the background job queue and the jobs state of the in-memory storages
+package jobqueue
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/romm80/shortener.git/internal/app"
+	"github.com/romm80/shortener.git/internal/app/logger"
+	"github.com/romm80/shortener.git/internal/app/models"
+)
+
+// logHeader - first line of the queue file, identifies the file format version
+const logHeader = "shortener-queue v1"
+
+// compactRecords - number of the queue file records after which the file is compacted
+// if most of them belong to removed messages and jobs
+const compactRecords = 1000
+
+type recordType string
+
+const (
+	recordEnqueue recordType = "enqueue" // message added
+	recordLease   recordType = "lease"   // message delivered
+	recordRetry   recordType = "retry"   // message returned to the queue
+	recordAck     recordType = "ack"     // message removed
+	recordJob     recordType = "job"     // job created or changed
+	recordDrop    recordType = "drop"    // job removed
+)
+
+// record - queue file entry, replaying all records in order rebuilds the queue
+type record struct {
+	Type        recordType        `json:"type"`
+	ID          string            `json:"id"`
+	Kind        string            `json:"kind,omitempty"`
+	Payload     []byte            `json:"payload,omitempty"`
+	Attempts    int               `json:"attempts,omitempty"`
+	AvailableAt time.Time         `json:"available_at"`
+	Error       string            `json:"error,omitempty"`
+	Job         *models.DeleteJob `json:"job,omitempty"`
+}
+
+type message struct {
+	models.QueueMessage
+	availableAt time.Time
+	leased      bool
+	acked       bool   // removed, the message is dropped from the order lazily
+	err         string // reason of the last failed delivery
+}
+
+// LogQueue job queue and jobs state kept in memory and written to an append-only file.
+// Without the file the queue is lost on restart.
+// Acknowledgements and retries are not synced: lost on a crash they only cause a redelivery
+type LogQueue struct {
+	mu       *sync.Mutex
+	path     string
+	file     *os.File
+	records  int // number of records in the file
+	lastID   uint64
+	messages []*message                   // in order of enqueueing, including acknowledged ones
+	index    map[string]*message          // not acknowledged messages by id
+	counts   map[string]int               // number of not acknowledged messages by kind
+	jobs     map[string]*models.DeleteJob // jobs state by id
+}
+
+// New opens the queue file, empty path - the queue is not persisted.
+// Messages delivered before the restart are available immediately
+func New(path string) (*LogQueue, error) {
+	q := &LogQueue{
+		mu:     &sync.Mutex{},
+		path:   path,
+		index:  make(map[string]*message),
+		counts: make(map[string]int),
+		jobs:   make(map[string]*models.DeleteJob),
+	}
+	if path == "" {
+		return q, nil
+	}
+
+	records, err := readRecords(path)
+	if err != nil {
+		return nil, err
+	}
+	for i := range records {
+		q.apply(&records[i])
+	}
+	now := time.Now()
+	for _, m := range q.index {
+		if m.leased {
+			m.leased = false
+			m.availableAt = now
+		}
+	}
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *LogQueue) Enqueue(ctx context.Context, kind string, payload []byte, limit int) (string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if limit > 0 && q.counts[kind] >= limit {
+		return "", app.ErrQueueFull
+	}
+
+	rec := record{
+		Type:        recordEnqueue,
+		ID:          strconv.FormatUint(q.lastID+1, 10),
+		Kind:        kind,
+		Payload:     payload,
+		AvailableAt: time.Now(),
+	}
+	if err := q.commit(ctx, true, rec); err != nil {
+		return "", err
+	}
+	return rec.ID, nil
+}
+
+func (q *LogQueue) Dequeue(ctx context.Context, kind string, limit int, visibility time.Duration) ([]models.QueueMessage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	records := make([]record, 0)
+	for _, m := range q.messages {
+		if limit > 0 && len(records) == limit {
+			break
+		}
+		if m.acked || m.Kind != kind || m.availableAt.After(now) {
+			continue
+		}
+		records = append(records, record{
+			Type:        recordLease,
+			ID:          m.ID,
+			Attempts:    m.Attempts + 1,
+			AvailableAt: now.Add(visibility),
+		})
+	}
+	// the lease is synced, so the attempts are not lost on a crash
+	if err := q.commit(ctx, true, records...); err != nil {
+		return nil, err
+	}
+
+	delivered := make([]models.QueueMessage, 0, len(records))
+	for _, rec := range records {
+		if m, ok := q.index[rec.ID]; ok {
+			delivered = append(delivered, m.QueueMessage)
+		}
+	}
+	return delivered, nil
+}
+
+func (q *LogQueue) Ack(ctx context.Context, id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.index[id]; !ok {
+		return nil
+	}
+	return q.commit(ctx, false, record{Type: recordAck, ID: id})
+}
+
+func (q *LogQueue) Retry(ctx context.Context, id string, availableAt time.Time, reason string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if _, ok := q.index[id]; !ok {
+		return nil
+	}
+	return q.commit(ctx, false, record{Type: recordRetry, ID: id, AvailableAt: availableAt, Error: reason})
+}
+
+func (q *LogQueue) Pending(ctx context.Context, kind string) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return q.counts[kind], nil
+}
+
+func (q *LogQueue) SaveJobs(ctx context.Context, jobs ...models.DeleteJob) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	records := make([]record, 0, len(jobs))
+	for i := range jobs {
+		records = append(records, record{Type: recordJob, ID: jobs[i].ID, Job: &jobs[i]})
+	}
+	return q.commit(ctx, true, records...)
+}
+
+func (q *LogQueue) GetJob(ctx context.Context, id string) (models.DeleteJob, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return models.DeleteJob{}, err
+	}
+	job, ok := q.jobs[id]
+	if !ok {
+		return models.DeleteJob{}, app.ErrJobNotFound
+	}
+	return *job, nil
+}
+
+func (q *LogQueue) RemoveJob(ctx context.Context, id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.jobs[id]; !ok {
+		return nil
+	}
+	return q.commit(ctx, false, record{Type: recordDrop, ID: id})
+}
+
+func (q *LogQueue) RemoveFinishedJobs(ctx context.Context, before time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	records := make([]record, 0)
+	for id, job := range q.jobs {
+		if job.FinishedAt != nil && job.FinishedAt.Before(before) {
+			records = append(records, record{Type: recordDrop, ID: id})
+		}
+	}
+	return q.commit(ctx, false, records...)
+}
+
+// commit writes the records to the queue file and then applies them, must be called under lock.
+// Records written without sync survive a crash of the process but not of the host
+func (q *LogQueue) commit(ctx context.Context, sync bool, records ...record) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	if q.file != nil {
+		buf := &bytes.Buffer{}
+		for i := range records {
+			line, err := json.Marshal(&records[i])
+			if err != nil {
+				return err
+			}
+			buf.Write(line)
+			buf.WriteByte('\n')
+		}
+		if _, err := q.file.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		if sync {
+			if err := q.file.Sync(); err != nil {
+				return err
+			}
+		}
+		q.records += len(records)
+	}
+	for i := range records {
+		q.apply(&records[i])
+	}
+
+	if q.file != nil && q.records > compactRecords && q.records > 4*(len(q.index)+len(q.jobs)) {
+		// the records are already stored, a failed compaction is retried on the next record
+		if err := q.compact(); err != nil {
+			logger.FromContext(ctx).Error("queue file compaction failed", "error", err)
+		}
+	}
+	return nil
+}
+
+// apply changes the queue by the record, must be called under lock
+func (q *LogQueue) apply(rec *record) {
+	switch rec.Type {
+	case recordEnqueue:
+		if id, err := strconv.ParseUint(rec.ID, 10, 64); err == nil && id > q.lastID {
+			q.lastID = id
+		}
+		m := &message{
+			QueueMessage: models.QueueMessage{
+				ID:       rec.ID,
+				Kind:     rec.Kind,
+				Payload:  rec.Payload,
+				Attempts: rec.Attempts,
+			},
+			availableAt: rec.AvailableAt,
+			err:         rec.Error,
+		}
+		q.messages = append(q.messages, m)
+		q.index[m.ID] = m
+		q.counts[m.Kind]++
+		return
+	case recordJob:
+		if rec.Job != nil {
+			job := *rec.Job
+			q.jobs[rec.ID] = &job
+		}
+		return
+	case recordDrop:
+		delete(q.jobs, rec.ID)
+		return
+	}
+
+	m, ok := q.index[rec.ID]
+	if !ok {
+		return
+	}
+	switch rec.Type {
+	case recordLease:
+		m.Attempts = rec.Attempts
+		m.availableAt = rec.AvailableAt
+		m.leased = true
+	case recordRetry:
+		m.availableAt = rec.AvailableAt
+		m.leased = false
+		m.err = rec.Error
+	case recordAck:
+		m.acked = true
+		delete(q.index, m.ID)
+		q.counts[m.Kind]--
+		if len(q.messages) > 2*len(q.index) {
+			// acknowledged messages are dropped from the order once they are the majority
+			live := make([]*message, 0, len(q.index))
+			for _, v := range q.messages {
+				if !v.acked {
+					live = append(live, v)
+				}
+			}
+			q.messages = live
+		}
+	}
+}
+
+// compact atomically replaces the queue file with the records of the current messages and jobs and reopens it
+func (q *LogQueue) compact() error {
+	records := make([]record, 0, len(q.index)+len(q.jobs))
+	for _, m := range q.messages {
+		if m.acked {
+			continue
+		}
+		records = append(records, record{
+			Type:        recordEnqueue,
+			ID:          m.ID,
+			Kind:        m.Kind,
+			Payload:     m.Payload,
+			Attempts:    m.Attempts,
+			AvailableAt: m.availableAt,
+			Error:       m.err,
+		})
+		if m.leased {
+			records = append(records, record{Type: recordLease, ID: m.ID, Attempts: m.Attempts, AvailableAt: m.availableAt})
+		}
+	}
+	for id, job := range q.jobs {
+		records = append(records, record{Type: recordJob, ID: id, Job: job})
+	}
+	if err := writeRecords(q.path, records); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(q.path, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if q.file != nil {
+		q.file.Close()
+	}
+	q.file = file
+	q.records = len(records)
+	return nil
+}
+
+// readRecords reads all records of the queue file, a torn last record is skipped
+func readRecords(path string) ([]record, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header, err := reader.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if err == io.EOF {
+		// an empty file or a torn header write
+		return nil, nil
+	}
+	if string(bytes.TrimSuffix(header, []byte("\n"))) != logHeader {
+		return nil, fmt.Errorf("queue file %s: unknown format", path)
+	}
+
+	records := make([]record, 0)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(line) == 0 {
+			return records, nil
+		}
+		if err == io.EOF {
+			logger.Default().Warn("queue file: skipping torn record", "path", path)
+			return records, nil
+		}
+
+		var rec record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			if _, peekErr := reader.Peek(1); peekErr == io.EOF {
+				logger.Default().Warn("queue file: skipping torn record", "path", path)
+				return records, nil
+			}
+			return nil, fmt.Errorf("queue file %s: %w", path, err)
+		}
+		records = append(records, rec)
+	}
+}
+
+// writeRecords atomically replaces the file with the header and the records
+func writeRecords(path string, records []record) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	writer := bufio.NewWriter(file)
+	if _, err := writer.WriteString(logHeader + "\n"); err != nil {
+		file.Close()
+		return err
+	}
+	for i := range records {
+		line, err := json.Marshal(&records[i])
+		if err != nil {
+			file.Close()
+			return err
+		}
+		writer.Write(line)
+		writer.WriteByte('\n')
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
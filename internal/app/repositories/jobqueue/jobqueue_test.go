@@ -0,0 +1,94 @@
+package jobqueue
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/romm80/shortener.git/internal/app"
+	"github.com/romm80/shortener.git/internal/app/models"
+)
+
+func TestLogQueue(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.json.queue")
+	q, err := New(path)
+	require.NoError(t, err)
+
+	acked, err := q.Enqueue(ctx, "delete", []byte("first"), 3)
+	require.NoError(t, err)
+	leased, err := q.Enqueue(ctx, "delete", []byte("second"), 3)
+	require.NoError(t, err)
+	retried, err := q.Enqueue(ctx, "delete", []byte("third"), 3)
+	require.NoError(t, err)
+	_, err = q.Enqueue(ctx, "delete", []byte("fourth"), 3)
+	assert.ErrorIs(t, err, app.ErrQueueFull)
+
+	messages, err := q.Dequeue(ctx, "delete", 0, time.Hour)
+	require.NoError(t, err)
+	require.Len(t, messages, 3)
+	assert.Equal(t, []byte("first"), messages[0].Payload)
+	assert.Equal(t, 1, messages[0].Attempts)
+	require.NoError(t, q.Ack(ctx, acked))
+	require.NoError(t, q.Retry(ctx, retried, time.Now().Add(-time.Second), "failed"))
+
+	// leased messages are hidden for the visibility timeout
+	messages, err = q.Dequeue(ctx, "delete", 0, time.Hour)
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	assert.Equal(t, retried, messages[0].ID)
+	assert.Equal(t, 2, messages[0].Attempts)
+
+	// messages which are not acknowledged are delivered again after the restart
+	q, err = New(path)
+	require.NoError(t, err)
+	messages, err = q.Dequeue(ctx, "delete", 0, time.Hour)
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	assert.Equal(t, leased, messages[0].ID)
+	assert.Equal(t, 2, messages[0].Attempts)
+	assert.Equal(t, retried, messages[1].ID)
+	assert.Equal(t, 3, messages[1].Attempts)
+
+	id, err := q.Enqueue(ctx, "delete", []byte("fourth"), 0)
+	require.NoError(t, err)
+	assert.NotContains(t, []string{acked, leased, retried}, id)
+}
+
+func TestLogQueue_Jobs(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.json.queue")
+	q, err := New(path)
+	require.NoError(t, err)
+
+	finishedAt := time.Now().Add(-time.Hour)
+	pending := models.DeleteJob{ID: "pending", UserID: 1, Status: models.JobPending, URLsID: []string{"a", "b"}}
+	finished := models.DeleteJob{ID: "finished", UserID: 1, Status: models.JobSucceeded, FinishedAt: &finishedAt}
+	removed := models.DeleteJob{ID: "removed", UserID: 1, Status: models.JobPending}
+	require.NoError(t, q.SaveJobs(ctx, pending, finished, removed))
+	require.NoError(t, q.RemoveJob(ctx, removed.ID))
+
+	pending.Status = models.JobRunning
+	pending.Deleted = []string{"a"}
+	require.NoError(t, q.SaveJobs(ctx, pending))
+
+	// the jobs state outlives the restart
+	q, err = New(path)
+	require.NoError(t, err)
+	job, err := q.GetJob(ctx, pending.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.JobRunning, job.Status)
+	assert.Equal(t, []string{"a"}, job.Deleted)
+	_, err = q.GetJob(ctx, removed.ID)
+	assert.ErrorIs(t, err, app.ErrJobNotFound)
+
+	require.NoError(t, q.RemoveFinishedJobs(ctx, time.Now()))
+	_, err = q.GetJob(ctx, finished.ID)
+	assert.ErrorIs(t, err, app.ErrJobNotFound)
+	_, err = q.GetJob(ctx, pending.ID)
+	assert.NoError(t, err)
+}
@@ -2,11 +2,15 @@
 package linkedliststorage
 
 import (
+	"context"
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/romm80/shortener.git/internal/app"
 	"github.com/romm80/shortener.git/internal/app/models"
+	"github.com/romm80/shortener.git/internal/app/repositories/idempotency"
+	"github.com/romm80/shortener.git/internal/app/repositories/jobqueue"
 	"github.com/romm80/shortener.git/internal/app/service"
 )
 
@@ -16,6 +20,13 @@ type node struct {
 	urlID     string
 	originURL string
 	userID    uint64
+	alias     bool
+	expiresAt *time.Time
+	deleted   bool
+	deletedAt time.Time
+	createdAt time.Time
+	clicks    []models.Click
+	history   []models.URLHistory
 }
 
 type URLsList struct {
@@ -23,12 +34,26 @@ type URLsList struct {
 	tail         *node
 	mu           *sync.RWMutex
 	userIDsCount uint64
+	idGen        service.IDGenerator
+	*idempotency.MemoryStore
+	*jobqueue.LogQueue
 }
 
-func New() *URLsList {
-	return &URLsList{
-		mu: &sync.RWMutex{},
+func New() (*URLsList, error) {
+	idGen, err := service.NewIDGenerator()
+	if err != nil {
+		return nil, err
+	}
+	queue, err := jobqueue.New("")
+	if err != nil {
+		return nil, err
 	}
+	return &URLsList{
+		mu:          &sync.RWMutex{},
+		idGen:       idGen,
+		MemoryStore: idempotency.NewMemoryStore(),
+		LogQueue:    queue,
+	}, nil
 }
 
 func (list *URLsList) findNode(urlID string) (*node, bool) {
@@ -42,11 +67,40 @@ func (list *URLsList) findNode(urlID string) (*node, bool) {
 	return nil, false
 }
 
-func (list *URLsList) appendNode(urlID, originURL string, userID uint64) {
+func (list *URLsList) findNodeByURL(originURL string) (*node, bool) {
+	current := list.head
+	for current != nil {
+		// an expired or deleted link is shortened again with a new id
+		if current.originURL == originURL && !current.alias && !current.deleted && !service.Expired(current.expiresAt) {
+			return current, true
+		}
+		current = current.next
+	}
+	return nil, false
+}
+
+// freeID returns a link id that is not yet taken, must be called under lock
+func (list *URLsList) freeID(url string) (string, error) {
+	for attempt := 0; attempt < service.MaxIDAttempts; attempt++ {
+		urlID, err := list.idGen.Generate(url, attempt)
+		if err != nil {
+			return "", err
+		}
+		if _, inList := list.findNode(urlID); !inList {
+			return urlID, nil
+		}
+	}
+	return "", service.ErrIDAttemptsExceeded
+}
+
+func (list *URLsList) appendNode(urlID, originURL string, userID uint64, alias bool, expiresAt *time.Time) {
 	n := &node{
 		urlID:     urlID,
 		originURL: originURL,
 		userID:    userID,
+		alias:     alias,
+		expiresAt: expiresAt,
+		createdAt: time.Now(),
 	}
 
 	if list.head == nil {
@@ -71,61 +125,110 @@ func (list *URLsList) deleteNode(node *node) {
 		list.head.prev = nil
 		return
 	}
+	if node.next == nil {
+		list.tail = node.prev
+		list.tail.next = nil
+		return
+	}
 	node.prev.next = node.next
-	list.tail = node.next
+	node.next.prev = node.prev
 }
 
-func (list *URLsList) Add(url string, userID uint64) (string, error) {
+func (list *URLsList) Add(ctx context.Context, url string, userID uint64, expiresAt *time.Time) (string, error) {
 	list.mu.Lock()
 	defer list.mu.Unlock()
 
-	urlID := service.ShortenURLID(url)
-	if _, inList := list.findNode(urlID); inList {
-		return "", app.ErrConflictURLID
+	if err := ctx.Err(); err != nil {
+		return "", err
 	}
 
-	list.appendNode(urlID, url, userID)
+	if node, inList := list.findNodeByURL(url); inList {
+		return node.urlID, app.ErrConflictURLID
+	}
+
+	urlID, err := list.freeID(url)
+	if err != nil {
+		return "", err
+	}
+
+	list.appendNode(urlID, url, userID, false, expiresAt)
 	return urlID, nil
 }
 
-func (list *URLsList) AddBatch(urls []models.RequestBatch, userID uint64) ([]models.ResponseBatch, error) {
+func (list *URLsList) AddAlias(ctx context.Context, url, alias string, userID uint64, expiresAt *time.Time) (string, error) {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	if node, inList := list.findNode(alias); inList {
+		if node.userID == userID && node.originURL == url {
+			return alias, app.ErrConflictURLID
+		}
+		return "", app.ErrAliasTaken
+	}
+
+	list.appendNode(alias, url, userID, true, expiresAt)
+	return alias, nil
+}
+
+func (list *URLsList) AddBatch(ctx context.Context, urls []models.RequestBatch, userID uint64) ([]models.ResponseBatch, error) {
 	respBatch := make([]models.ResponseBatch, 0, len(urls))
 
 	for _, v := range urls {
-		urlID, err := list.Add(v.OriginalURL, userID)
+		urlID, err := list.Add(ctx, v.OriginalURL, userID, v.ExpiresAt)
 		if err != nil && !errors.Is(err, app.ErrConflictURLID) {
 			return nil, err
 		}
+		status := models.BatchCreated
 		if errors.Is(err, app.ErrConflictURLID) {
-			continue
+			status = models.BatchExisting
 		}
 
 		respBatch = append(respBatch, models.ResponseBatch{
 			CorrelationID: v.CorrelationID,
 			ShortURL:      service.BaseURL(urlID),
+			Status:        status,
 		})
 	}
 	return respBatch, nil
 }
 
-func (list *URLsList) Get(id string) (string, error) {
+func (list *URLsList) Get(ctx context.Context, id string) (string, error) {
 	list.mu.RLock()
 	defer list.mu.RUnlock()
 
-	if node, inList := list.findNode(id); inList {
-		return node.originURL, nil
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	node, inList := list.findNode(id)
+	if !inList {
+		return "", app.ErrLinkNoFound
+	}
+	if node.deleted {
+		return "", app.ErrDeletedURL
+	}
+	if service.Expired(node.expiresAt) {
+		return "", app.ErrExpiredURL
 	}
-	return "", app.ErrLinkNoFound
+	return node.originURL, nil
 }
 
-func (list *URLsList) GetUserURLs(userID uint64) ([]models.UserURLs, error) {
+func (list *URLsList) GetUserURLs(ctx context.Context, userID uint64) ([]models.UserURLs, error) {
 	list.mu.RLock()
 	defer list.mu.RUnlock()
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	urls := make([]models.UserURLs, 0)
 	current := list.head
 	for current != nil {
-		if current.userID == userID {
+		if current.userID == userID && !current.deleted {
 			urls = append(urls, models.UserURLs{
 				ShortURL:    service.BaseURL(current.urlID),
 				OriginalURL: current.originURL,
@@ -136,27 +239,234 @@ func (list *URLsList) GetUserURLs(userID uint64) ([]models.UserURLs, error) {
 	return urls, nil
 }
 
-func (list *URLsList) NewUser() (uint64, error) {
+func (list *URLsList) GetUserURLsPage(ctx context.Context, userID uint64, query models.URLsQuery) (models.UserURLsPage, error) {
+	list.mu.RLock()
+	if err := ctx.Err(); err != nil {
+		list.mu.RUnlock()
+		return models.UserURLsPage{}, err
+	}
+	records := make([]service.URLRecord, 0)
+	current := list.head
+	for current != nil {
+		if current.userID == userID && !current.deleted {
+			records = append(records, service.URLRecord{
+				ID:          current.urlID,
+				OriginalURL: current.originURL,
+				CreatedAt:   current.createdAt,
+			})
+		}
+		current = current.next
+	}
+	list.mu.RUnlock()
+
+	return service.PageUserURLs(records, query)
+}
+
+func (list *URLsList) NewUser(ctx context.Context) (uint64, error) {
 	list.mu.Lock()
 	defer list.mu.Unlock()
 
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
 	list.userIDsCount++
 
 	return list.userIDsCount, nil
 }
 
-func (list URLsList) Ping() error {
+func (list URLsList) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+func (list *URLsList) DeleteBatch(ctx context.Context, userID uint64, urlsID []string) ([]string, error) {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	deleted := make([]string, 0, len(urlsID))
+	for _, urlID := range urlsID {
+		if node, inList := list.findNode(urlID); inList && node.userID == userID && !node.deleted {
+			node.deleted = true
+			node.deletedAt = time.Now()
+			deleted = append(deleted, urlID)
+		}
+	}
+	return deleted, nil
+}
+
+func (list *URLsList) DeleteExpired(ctx context.Context) error {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	current := list.head
+	for current != nil {
+		if service.Expired(current.expiresAt) && !current.deleted {
+			current.deleted = true
+			current.deletedAt = time.Now()
+		}
+		current = current.next
+	}
+	return nil
+}
+
+func (list *URLsList) AddClicks(ctx context.Context, clicks []models.Click) error {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	for _, click := range clicks {
+		if node, inList := list.findNode(click.URLID); inList {
+			node.clicks = append(node.clicks, click)
+		}
+	}
 	return nil
 }
 
-func (list *URLsList) DeleteBatch(userID uint64, urlsID []string) error {
+func (list *URLsList) GetStats(ctx context.Context, urlID string, userID uint64) (models.LinkStats, error) {
+	list.mu.RLock()
+	defer list.mu.RUnlock()
+
+	if err := ctx.Err(); err != nil {
+		return models.LinkStats{}, err
+	}
+
+	node, inList := list.findNode(urlID)
+	if !inList {
+		return models.LinkStats{}, app.ErrLinkNoFound
+	}
+	if node.userID != userID {
+		return models.LinkStats{}, app.ErrForbidden
+	}
+	return service.AggregateClicks(node.clicks), nil
+}
+
+func (list *URLsList) UpdateURL(ctx context.Context, urlID, url string, userID uint64) error {
 	list.mu.Lock()
 	defer list.mu.Unlock()
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	node, inList := list.findNode(urlID)
+	if !inList {
+		return app.ErrLinkNoFound
+	}
+	if node.userID != userID {
+		return app.ErrForbidden
+	}
+	if node.deleted {
+		return app.ErrDeletedURL
+	}
+	if node.originURL == url {
+		return nil
+	}
+	if _, inList := list.findNodeByURL(url); inList && !node.alias {
+		return app.ErrConflictURLID
+	}
+
+	node.history = append(node.history, models.URLHistory{
+		OriginalURL: node.originURL,
+		ReplacedAt:  time.Now(),
+	})
+	node.originURL = url
+	return nil
+}
+
+func (list *URLsList) GetURLHistory(ctx context.Context, urlID string, userID uint64) ([]models.URLHistory, error) {
+	list.mu.RLock()
+	defer list.mu.RUnlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	node, inList := list.findNode(urlID)
+	if !inList {
+		return nil, app.ErrLinkNoFound
+	}
+	if node.userID != userID {
+		return nil, app.ErrForbidden
+	}
+	history := make([]models.URLHistory, len(node.history))
+	copy(history, node.history)
+	return history, nil
+}
+
+func (list *URLsList) GetUserTrash(ctx context.Context, userID uint64) ([]models.TrashURL, error) {
+	list.mu.RLock()
+	defer list.mu.RUnlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	urls := make([]models.TrashURL, 0)
+	current := list.head
+	for current != nil {
+		if current.userID == userID && current.deleted {
+			urls = append(urls, models.TrashURL{
+				ShortURL:    service.BaseURL(current.urlID),
+				OriginalURL: current.originURL,
+				DeletedAt:   current.deletedAt,
+			})
+		}
+		current = current.next
+	}
+	return urls, nil
+}
+
+func (list *URLsList) RestoreBatch(ctx context.Context, userID uint64, urlsID []string) ([]string, error) {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	restored := make([]string, 0, len(urlsID))
 	for _, urlID := range urlsID {
-		if node, inList := list.findNode(urlID); inList && node.userID == userID {
-			list.deleteNode(node)
+		node, inList := list.findNode(urlID)
+		if !inList || node.userID != userID || !node.deleted || service.Expired(node.expiresAt) {
+			continue
+		}
+		// the link was shortened again after the deletion
+		if _, shortened := list.findNodeByURL(node.originURL); shortened && !node.alias {
+			continue
+		}
+		node.deleted = false
+		node.deletedAt = time.Time{}
+		restored = append(restored, urlID)
+	}
+	return restored, nil
+}
+
+func (list *URLsList) PurgeDeleted(ctx context.Context, before time.Time) error {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	current := list.head
+	for current != nil {
+		next := current.next
+		if current.deleted && !current.deletedAt.After(before) {
+			list.deleteNode(current)
 		}
+		current = next
 	}
 	return nil
 }
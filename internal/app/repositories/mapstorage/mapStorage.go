@@ -2,123 +2,380 @@
 package mapstorage
 
 import (
-	"bufio"
-	"encoding/json"
-	"errors"
-	"os"
+	"context"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/romm80/shortener.git/internal/app"
+	"github.com/romm80/shortener.git/internal/app/logger"
 	"github.com/romm80/shortener.git/internal/app/models"
+	"github.com/romm80/shortener.git/internal/app/repositories/idempotency"
+	"github.com/romm80/shortener.git/internal/app/repositories/jobqueue"
 	"github.com/romm80/shortener.git/internal/app/server"
 	"github.com/romm80/shortener.git/internal/app/service"
 )
 
 type MapStorage struct {
-	mu         *sync.Mutex
-	links      map[string]string
-	usersLinks map[uint64]map[string]string
+	mu          *sync.Mutex
+	links       map[string]string
+	urls        map[string]string // the live or the latest link id of the original link
+	aliases     map[string]bool
+	expires     map[string]*time.Time
+	owners      map[string]uint64
+	created     map[string]time.Time
+	usersLinks  map[uint64]map[string]string
+	lastUserID  uint64
+	savedUserID uint64 // the last user id written to the storage file
+	clicks      map[string][]models.Click
+	history     map[string][]models.URLHistory
+	deleted     map[string]time.Time
+	idGen       service.IDGenerator
+	log         *recordLog
+	*idempotency.MemoryStore
+	*jobqueue.LogQueue
 }
 
 func New() (*MapStorage, error) {
 
-	storage := make(map[string]string)
-	usersLinks := make(map[uint64]map[string]string)
+	idGen, err := service.NewIDGenerator()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &MapStorage{
+		mu:         &sync.Mutex{},
+		links:      make(map[string]string),
+		urls:       make(map[string]string),
+		aliases:    make(map[string]bool),
+		expires:    make(map[string]*time.Time),
+		owners:     make(map[string]uint64),
+		created:    make(map[string]time.Time),
+		usersLinks: make(map[uint64]map[string]string),
+		clicks:     make(map[string][]models.Click),
+		history:    make(map[string][]models.URLHistory),
+		deleted:    make(map[string]time.Time),
+		idGen:      idGen,
+
+		MemoryStore: idempotency.NewMemoryStore(),
+	}
 
 	if server.Cfg.FileStorage != "" {
-		file, err := os.OpenFile(server.Cfg.FileStorage, os.O_RDONLY|os.O_CREATE, 0777)
+		snapshotSeq, snapshot, err := readSnapshot(snapshotPath(server.Cfg.FileStorage))
 		if err != nil {
 			return nil, err
 		}
-		defer file.Close()
+		for i := range snapshot {
+			s.apply(&snapshot[i])
+		}
 
-		url := &models.URLsID{}
-		scan := bufio.NewScanner(file)
-		for scan.Scan() {
-			if err = json.Unmarshal(scan.Bytes(), url); err != nil {
-				return nil, err
+		var records []record
+		if s.log, records, err = openLog(server.Cfg.FileStorage); err != nil {
+			return nil, err
+		}
+		for i := range records {
+			// records before the snapshot are left if the storage stopped before the file truncation
+			if records[i].Seq > snapshotSeq {
+				s.apply(&records[i])
 			}
-			storage[url.ID] = url.OriginalURL
 		}
+		if snapshotSeq > s.log.seq {
+			s.log.seq = snapshotSeq
+		}
+		s.savedUserID = s.lastUserID
 	}
 
-	return &MapStorage{
-		mu:         &sync.Mutex{},
-		links:      storage,
-		usersLinks: usersLinks,
-	}, nil
-}
-
-func (s *MapStorage) Add(url string, userID uint64) (string, error) {
-	urlID := service.ShortenURLID(url)
-
-	if _, inMap := s.links[urlID]; inMap {
-		return "", app.ErrConflictURLID
+	queuePath := ""
+	if server.Cfg.FileStorage != "" {
+		queuePath = server.Cfg.FileStorage + ".queue"
+	}
+	if s.LogQueue, err = jobqueue.New(queuePath); err != nil {
+		return nil, err
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	return s, nil
+}
 
-	s.links[urlID] = url
-	if s.usersLinks[userID] == nil {
-		s.usersLinks[userID] = make(map[string]string, 1)
+// commit writes the records to the storage file and then applies them to the storage, must be called under lock
+func (s *MapStorage) commit(ctx context.Context, recs ...*record) error {
+	if len(recs) == 0 {
+		return nil
 	}
-	s.usersLinks[userID][urlID] = url
+	if s.log != nil {
+		if s.lastUserID > s.savedUserID {
+			// new users are stored with the next record, a user without links may be issued again after restart
+			recs = append([]*record{{Type: recordUser, UserID: s.lastUserID, Time: time.Now()}}, recs...)
+		}
+		if err := s.log.append(recs...); err != nil {
+			return err
+		}
+	}
+	for _, rec := range recs {
+		s.apply(rec)
+	}
+	s.savedUserID = s.lastUserID
 
-	if server.Cfg.FileStorage != "" {
-		file, err := os.OpenFile(server.Cfg.FileStorage, os.O_WRONLY|os.O_APPEND, 0777)
-		if err != nil {
-			return "", err
+	if s.log != nil && s.snapshotDue() {
+		// the record is already stored, a failed snapshot is retried on the next record
+		if err := s.snapshot(); err != nil {
+			logger.FromContext(ctx).Error("storage snapshot failed", "error", err)
 		}
-		defer file.Close()
+	}
+	return nil
+}
 
-		res := &models.URLsID{
-			ID:          urlID,
-			OriginalURL: url,
+// apply changes the storage state by the record, must be called under lock
+func (s *MapStorage) apply(rec *record) {
+	switch rec.Type {
+	case recordUser:
+		if s.usersLinks[rec.UserID] == nil {
+			s.usersLinks[rec.UserID] = make(map[string]string)
+		}
+		if rec.UserID > s.lastUserID {
+			s.lastUserID = rec.UserID
+		}
+	case recordCreate:
+		s.links[rec.ID] = rec.URL
+		if rec.Alias {
+			s.aliases[rec.ID] = true
+		} else if current, ok := s.urls[rec.URL]; !ok || !s.live(current) {
+			s.urls[rec.URL] = rec.ID
+		}
+		if rec.ExpiresAt != nil {
+			s.expires[rec.ID] = rec.ExpiresAt
+		}
+		s.owners[rec.ID] = rec.UserID
+		s.created[rec.ID] = rec.Time
+		if s.usersLinks[rec.UserID] == nil {
+			s.usersLinks[rec.UserID] = make(map[string]string, 1)
+		}
+		s.usersLinks[rec.UserID][rec.ID] = rec.URL
+		if rec.UserID > s.lastUserID {
+			s.lastUserID = rec.UserID
+		}
+	case recordUpdate:
+		old := s.links[rec.ID]
+		if !s.aliases[rec.ID] {
+			if s.urls[old] == rec.ID {
+				delete(s.urls, old)
+			}
+			s.urls[rec.URL] = rec.ID
+		}
+		s.links[rec.ID] = rec.URL
+		if _, ok := s.usersLinks[s.owners[rec.ID]][rec.ID]; ok {
+			s.usersLinks[s.owners[rec.ID]][rec.ID] = rec.URL
+		}
+		s.history[rec.ID] = append(s.history[rec.ID], models.URLHistory{
+			OriginalURL: old,
+			ReplacedAt:  rec.Time,
+		})
+	case recordDelete:
+		delete(s.usersLinks[s.owners[rec.ID]], rec.ID)
+		s.deleted[rec.ID] = rec.Time
+	case recordRestore:
+		delete(s.deleted, rec.ID)
+		if !s.aliases[rec.ID] {
+			s.urls[s.links[rec.ID]] = rec.ID
+		}
+		owner := s.owners[rec.ID]
+		if s.usersLinks[owner] == nil {
+			s.usersLinks[owner] = make(map[string]string, 1)
 		}
-		b, err := json.Marshal(res)
+		s.usersLinks[owner][rec.ID] = s.links[rec.ID]
+	case recordHistory:
+		s.history[rec.ID] = append(s.history[rec.ID], models.URLHistory{
+			OriginalURL: rec.URL,
+			ReplacedAt:  rec.Time,
+		})
+	case recordPurge:
+		if url := s.links[rec.ID]; s.urls[url] == rec.ID {
+			delete(s.urls, url)
+		}
+		delete(s.usersLinks[s.owners[rec.ID]], rec.ID)
+		delete(s.links, rec.ID)
+		delete(s.aliases, rec.ID)
+		delete(s.expires, rec.ID)
+		delete(s.owners, rec.ID)
+		delete(s.created, rec.ID)
+		delete(s.clicks, rec.ID)
+		delete(s.history, rec.ID)
+		delete(s.deleted, rec.ID)
+	}
+}
+
+// live reports whether the link is neither deleted nor expired, must be called under lock
+func (s *MapStorage) live(urlID string) bool {
+	_, deleted := s.deleted[urlID]
+	return !deleted && !service.Expired(s.expires[urlID])
+}
+
+// liveURL returns the live link id of the original link, must be called under lock
+func (s *MapStorage) liveURL(url string) (string, bool) {
+	urlID, ok := s.urls[url]
+	if !ok || !s.live(urlID) {
+		return "", false
+	}
+	return urlID, true
+}
+
+// freeID returns a link id that is not yet taken or reserved, must be called under lock
+func (s *MapStorage) freeID(url string, reserved map[string]struct{}) (string, error) {
+	for attempt := 0; attempt < service.MaxIDAttempts; attempt++ {
+		urlID, err := s.idGen.Generate(url, attempt)
 		if err != nil {
 			return "", err
 		}
-		if _, err := file.Write(append(b, '\n')); err != nil {
-			return "", err
+		_, inMap := s.links[urlID]
+		if _, ok := reserved[urlID]; !inMap && !ok {
+			return urlID, nil
 		}
 	}
+	return "", service.ErrIDAttemptsExceeded
+}
+
+func (s *MapStorage) Add(ctx context.Context, url string, userID uint64, expiresAt *time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	// an expired or deleted link is shortened again with a new id
+	if urlID, inMap := s.liveURL(url); inMap {
+		return urlID, app.ErrConflictURLID
+	}
+
+	urlID, err := s.freeID(url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	err = s.commit(ctx, &record{
+		Type:      recordCreate,
+		ID:        urlID,
+		URL:       url,
+		UserID:    userID,
+		ExpiresAt: expiresAt,
+		Time:      time.Now(),
+	})
+	if err != nil {
+		return "", err
+	}
 
 	return urlID, nil
 }
 
-func (s *MapStorage) AddBatch(urls []models.RequestBatch, userID uint64) ([]models.ResponseBatch, error) {
-	respBatch := make([]models.ResponseBatch, 0)
-	if s.usersLinks[userID] == nil {
-		s.usersLinks[userID] = make(map[string]string, len(urls))
+func (s *MapStorage) AddAlias(ctx context.Context, url, alias string, userID uint64, expiresAt *time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return "", err
 	}
+
+	if _, inMap := s.links[alias]; inMap {
+		if s.owners[alias] == userID && s.links[alias] == url {
+			return alias, app.ErrConflictURLID
+		}
+		return "", app.ErrAliasTaken
+	}
+
+	err := s.commit(ctx, &record{
+		Type:      recordCreate,
+		ID:        alias,
+		URL:       url,
+		UserID:    userID,
+		Alias:     true,
+		ExpiresAt: expiresAt,
+		Time:      time.Now(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return alias, nil
+}
+
+// AddBatch writes the records of the new links at once, so the batch is flushed to disk once
+func (s *MapStorage) AddBatch(ctx context.Context, urls []models.RequestBatch, userID uint64) ([]models.ResponseBatch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	respBatch := make([]models.ResponseBatch, 0, len(urls))
+	records := make([]*record, 0, len(urls))
+	created := make(map[string]string, len(urls))    // ids of the links created by the batch by original link
+	reserved := make(map[string]struct{}, len(urls)) // ids taken by the batch
 	for _, v := range urls {
-		urlID, err := s.Add(v.OriginalURL, userID)
-		if err != nil && !errors.Is(err, app.ErrConflictURLID) {
-			return nil, err
+		status := models.BatchExisting
+		urlID, ok := s.liveURL(v.OriginalURL)
+		if !ok {
+			urlID, ok = created[v.OriginalURL]
 		}
-		if errors.Is(err, app.ErrConflictURLID) {
-			continue
+		if !ok {
+			var err error
+			if urlID, err = s.freeID(v.OriginalURL, reserved); err != nil {
+				return nil, err
+			}
+			status = models.BatchCreated
+			created[v.OriginalURL] = urlID
+			reserved[urlID] = struct{}{}
+			records = append(records, &record{
+				Type:      recordCreate,
+				ID:        urlID,
+				URL:       v.OriginalURL,
+				UserID:    userID,
+				ExpiresAt: v.ExpiresAt,
+				Time:      time.Now(),
+			})
 		}
 
 		respBatch = append(respBatch, models.ResponseBatch{
 			CorrelationID: v.CorrelationID,
 			ShortURL:      service.BaseURL(urlID),
+			Status:        status,
 		})
 	}
 
+	if err := s.commit(ctx, records...); err != nil {
+		return nil, err
+	}
 	return respBatch, nil
 }
 
-func (s *MapStorage) Get(id string) (string, error) {
-	if val, ok := s.links[id]; ok {
-		return val, nil
+func (s *MapStorage) Get(ctx context.Context, id string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return "", err
 	}
-	return "", app.ErrLinkNoFound
+
+	val, ok := s.links[id]
+	if !ok {
+		return "", app.ErrLinkNoFound
+	}
+	if _, ok := s.deleted[id]; ok {
+		return "", app.ErrDeletedURL
+	}
+	if service.Expired(s.expires[id]) {
+		return "", app.ErrExpiredURL
+	}
+	return val, nil
 }
 
-func (s *MapStorage) GetUserURLs(userID uint64) ([]models.UserURLs, error) {
+func (s *MapStorage) GetUserURLs(ctx context.Context, userID uint64) ([]models.UserURLs, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	urls := make([]models.UserURLs, 0)
 	for k, v := range s.usersLinks[userID] {
 		urls = append(urls, models.UserURLs{
@@ -129,21 +386,238 @@ func (s *MapStorage) GetUserURLs(userID uint64) ([]models.UserURLs, error) {
 	return urls, nil
 }
 
-func (s *MapStorage) NewUser() (uint64, error) {
+func (s *MapStorage) GetUserURLsPage(ctx context.Context, userID uint64, query models.URLsQuery) (models.UserURLsPage, error) {
 	s.mu.Lock()
-	id := uint64(len(s.usersLinks) + 1)
-	s.usersLinks[id] = make(map[string]string)
+	if err := ctx.Err(); err != nil {
+		s.mu.Unlock()
+		return models.UserURLsPage{}, err
+	}
+	records := make([]service.URLRecord, 0, len(s.usersLinks[userID]))
+	for k, v := range s.usersLinks[userID] {
+		records = append(records, service.URLRecord{
+			ID:          k,
+			OriginalURL: v,
+			CreatedAt:   s.created[k],
+		})
+	}
 	s.mu.Unlock()
-	return id, nil
+
+	return service.PageUserURLs(records, query)
+}
+
+func (s *MapStorage) NewUser(ctx context.Context) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	// the user is stored with the next record, so a request without links does not write the file
+	s.lastUserID++
+	return s.lastUserID, nil
 }
 
-func (s *MapStorage) Ping() error {
+func (s *MapStorage) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+func (s *MapStorage) DeleteBatch(ctx context.Context, userID uint64, urlsID []string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	deleted := make([]string, 0, len(urlsID))
+	for _, urlID := range urlsID {
+		if _, ok := s.usersLinks[userID][urlID]; !ok {
+			continue
+		}
+		if err := s.markDeleted(ctx, urlID); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, urlID)
+	}
+	return deleted, nil
+}
+
+// markDeleted leaves the link tombstone and moves the link to the owner trash, must be called under lock
+func (s *MapStorage) markDeleted(ctx context.Context, urlID string) error {
+	if _, ok := s.deleted[urlID]; ok {
+		return nil
+	}
+	return s.commit(ctx, &record{Type: recordDelete, ID: urlID, Time: time.Now()})
+}
+
+func (s *MapStorage) DeleteExpired(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	for urlID, expiresAt := range s.expires {
+		if !service.Expired(expiresAt) {
+			continue
+		}
+		if err := s.markDeleted(ctx, urlID); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (s *MapStorage) DeleteBatch(userID uint64, urlsID []string) error {
+func (s *MapStorage) GetUserTrash(ctx context.Context, userID uint64) ([]models.TrashURL, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	urls := make([]models.TrashURL, 0)
+	for urlID, deletedAt := range s.deleted {
+		if owner, ok := s.owners[urlID]; !ok || owner != userID {
+			continue
+		}
+		urls = append(urls, models.TrashURL{
+			ShortURL:    service.BaseURL(urlID),
+			OriginalURL: s.links[urlID],
+			DeletedAt:   deletedAt,
+		})
+	}
+	sort.Slice(urls, func(i, j int) bool { return urls[i].DeletedAt.Before(urls[j].DeletedAt) })
+	return urls, nil
+}
+
+func (s *MapStorage) RestoreBatch(ctx context.Context, userID uint64, urlsID []string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	restored := make([]string, 0, len(urlsID))
 	for _, urlID := range urlsID {
-		delete(s.usersLinks[userID], urlID)
+		if _, ok := s.deleted[urlID]; !ok {
+			continue
+		}
+		if owner, ok := s.owners[urlID]; !ok || owner != userID || service.Expired(s.expires[urlID]) {
+			continue
+		}
+		// the link was shortened again after the deletion
+		if _, inMap := s.liveURL(s.links[urlID]); inMap && !s.aliases[urlID] {
+			continue
+		}
+		if err := s.commit(ctx, &record{Type: recordRestore, ID: urlID, Time: time.Now()}); err != nil {
+			return restored, err
+		}
+		restored = append(restored, urlID)
+	}
+	return restored, nil
+}
+
+func (s *MapStorage) PurgeDeleted(ctx context.Context, before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	for urlID, deletedAt := range s.deleted {
+		if deletedAt.After(before) {
+			continue
+		}
+		if err := s.commit(ctx, &record{Type: recordPurge, ID: urlID, Time: time.Now()}); err != nil {
+			return err
+		}
 	}
 	return nil
 }
+
+func (s *MapStorage) AddClicks(ctx context.Context, clicks []models.Click) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	for _, click := range clicks {
+		// clicks of the links purged in the meantime are skipped
+		if _, ok := s.links[click.URLID]; ok {
+			s.clicks[click.URLID] = append(s.clicks[click.URLID], click)
+		}
+	}
+	return nil
+}
+
+func (s *MapStorage) GetStats(ctx context.Context, urlID string, userID uint64) (models.LinkStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return models.LinkStats{}, err
+	}
+
+	if _, ok := s.links[urlID]; !ok {
+		return models.LinkStats{}, app.ErrLinkNoFound
+	}
+	if owner, ok := s.owners[urlID]; !ok || owner != userID {
+		return models.LinkStats{}, app.ErrForbidden
+	}
+	return service.AggregateClicks(s.clicks[urlID]), nil
+}
+
+func (s *MapStorage) UpdateURL(ctx context.Context, urlID, url string, userID uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	old, ok := s.links[urlID]
+	if !ok {
+		return app.ErrLinkNoFound
+	}
+	if owner, ok := s.owners[urlID]; !ok || owner != userID {
+		return app.ErrForbidden
+	}
+	if _, ok := s.deleted[urlID]; ok {
+		return app.ErrDeletedURL
+	}
+	if old == url {
+		return nil
+	}
+
+	if _, inMap := s.liveURL(url); inMap && !s.aliases[urlID] {
+		return app.ErrConflictURLID
+	}
+
+	return s.commit(ctx, &record{Type: recordUpdate, ID: urlID, URL: url, Time: time.Now()})
+}
+
+func (s *MapStorage) GetURLHistory(ctx context.Context, urlID string, userID uint64) ([]models.URLHistory, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, ok := s.links[urlID]; !ok {
+		return nil, app.ErrLinkNoFound
+	}
+	if owner, ok := s.owners[urlID]; !ok || owner != userID {
+		return nil, app.ErrForbidden
+	}
+	history := make([]models.URLHistory, len(s.history[urlID]))
+	copy(history, s.history[urlID])
+	return history, nil
+}
@@ -0,0 +1,302 @@
+package mapstorage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+
+	"github.com/romm80/shortener.git/internal/app/logger"
+	"github.com/romm80/shortener.git/internal/app/models"
+)
+
+// logHeader - first line of the storage file, identifies the record log format version
+const logHeader = "shortener-log v1"
+
+type recordType string
+
+const (
+	recordUser    recordType = "user"    // user created
+	recordCreate  recordType = "create"  // link created
+	recordUpdate  recordType = "update"  // original link replaced
+	recordDelete  recordType = "delete"  // link moved to trash
+	recordRestore recordType = "restore" // link restored from trash
+	recordPurge   recordType = "purge"   // link removed permanently
+	recordHistory recordType = "history" // previous original link, written only to snapshots
+)
+
+// record - storage file entry, replaying all records in order rebuilds the storage state
+type record struct {
+	Seq       uint64     `json:"seq,omitempty"` // sequence number, increases through the whole storage history
+	Type      recordType `json:"type"`
+	ID        string     `json:"id,omitempty"`
+	URL       string     `json:"url,omitempty"`
+	UserID    uint64     `json:"user_id,omitempty"`
+	Alias     bool       `json:"alias,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Time      time.Time  `json:"time"`
+}
+
+// recordLog append-only storage file.
+// Every record is written on a separate line as "<crc32 of json in hex> <json>"
+type recordLog struct {
+	file    *os.File
+	seq     uint64 // sequence number of the last record
+	records int    // number of records in the file
+	size    int64  // file size
+}
+
+// openLog opens the storage file and reads its records.
+// A torn or corrupted last record is truncated, a corrupted record in the middle of the file is an error.
+// A file of the previous format with bare links lines is converted to the record log
+func openLog(path string) (*recordLog, []record, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records, legacy, err := readLog(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if legacy {
+		file.Close()
+		if err := rewriteLog(path, records); err != nil {
+			return nil, nil, err
+		}
+		if file, err = os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0666); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	l := &recordLog{file: file, records: len(records)}
+	for i := range records {
+		if records[i].Seq == 0 {
+			// records written before sequence numbers were introduced are numbered by position
+			records[i].Seq = l.seq + 1
+		}
+		l.seq = records[i].Seq
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	l.size = info.Size()
+
+	return l, records, nil
+}
+
+// append assigns the next sequence numbers to the records, writes them to the end of the file at once
+// and flushes them to disk
+func (l *recordLog) append(recs ...*record) error {
+	buf := &bytes.Buffer{}
+	for i, rec := range recs {
+		rec.Seq = l.seq + uint64(i) + 1
+		line, err := encodeRecord(rec)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+	}
+	if _, err := l.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.seq += uint64(len(recs))
+	l.records += len(recs)
+	l.size += int64(buf.Len())
+	return nil
+}
+
+// reset removes all records from the file, the sequence number keeps increasing
+func (l *recordLog) reset() error {
+	if err := l.file.Truncate(int64(len(logHeader) + 1)); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.records = 0
+	l.size = int64(len(logHeader) + 1)
+	return nil
+}
+
+func (l *recordLog) close() error {
+	return l.file.Close()
+}
+
+func encodeRecord(rec *record) ([]byte, error) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(b), b)), nil
+}
+
+func decodeRecord(line []byte) (*record, error) {
+	var sum uint32
+	if len(line) < 10 || line[8] != ' ' {
+		return nil, errors.New("malformed record")
+	}
+	if _, err := fmt.Sscanf(string(line[:8]), "%08x", &sum); err != nil {
+		return nil, errors.New("malformed record checksum")
+	}
+	payload := line[9:]
+	if crc32.ChecksumIEEE(payload) != sum {
+		return nil, errors.New("record checksum mismatch")
+	}
+	rec := &record{}
+	if err := json.Unmarshal(payload, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// readLog reads all records of the file, legacy is true if the file has the previous format
+func readLog(file *os.File) (records []record, legacy bool, err error) {
+	reader := bufio.NewReader(file)
+	header, err := reader.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, false, err
+	}
+	if len(header) == 0 || err == io.EOF && bytes.HasPrefix([]byte(logHeader), header) {
+		// a new file or a torn header write
+		if err := file.Truncate(0); err != nil {
+			return nil, false, err
+		}
+		_, err = file.Write([]byte(logHeader + "\n"))
+		return nil, false, err
+	}
+	if string(bytes.TrimSuffix(header, []byte("\n"))) != logHeader {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, false, err
+		}
+		records, err = readLegacy(file)
+		return records, true, err
+	}
+
+	offset := int64(len(header))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, false, err
+		}
+		if len(line) == 0 {
+			return records, false, nil
+		}
+
+		var rec *record
+		torn := err == io.EOF
+		if !torn {
+			rec, err = decodeRecord(line[:len(line)-1])
+			if err != nil {
+				if _, peekErr := reader.Peek(1); peekErr != io.EOF {
+					return nil, false, fmt.Errorf("storage file record at offset %d: %w", offset, err)
+				}
+				torn = true
+			}
+		}
+		if torn {
+			logger.Default().Warn("storage file: truncating torn record", "offset", offset)
+			return records, false, file.Truncate(offset)
+		}
+
+		records = append(records, *rec)
+		offset += int64(len(line))
+	}
+}
+
+// readLegacy reads the file of bare links lines, where the last line of the link is its current state,
+// and returns records which recreate the links without owners
+func readLegacy(file *os.File) ([]record, error) {
+	order := make([]string, 0)
+	links := make(map[string]*models.URLsID)
+
+	scan := bufio.NewScanner(file)
+	for scan.Scan() {
+		url := &models.URLsID{}
+		if err := json.Unmarshal(scan.Bytes(), url); err != nil {
+			return nil, err
+		}
+		if _, ok := links[url.ID]; !ok {
+			order = append(order, url.ID)
+		}
+		links[url.ID] = url
+	}
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+
+	records := make([]record, 0, len(order))
+	for _, id := range order {
+		url := links[id]
+		records = append(records, record{
+			Type:      recordCreate,
+			ID:        url.ID,
+			URL:       url.OriginalURL,
+			Alias:     url.Alias,
+			ExpiresAt: url.ExpiresAt,
+		})
+		if url.DeletedAt != nil {
+			records = append(records, record{
+				Type: recordDelete,
+				ID:   url.ID,
+				Time: *url.DeletedAt,
+			})
+		}
+	}
+	return records, nil
+}
+
+// rewriteLog atomically replaces the file with the records log
+func rewriteLog(path string, records []record) error {
+	return writeRecords(path, logHeader, records)
+}
+
+// writeRecords atomically replaces the file with the header and the records
+func writeRecords(path, header string, records []record) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	writer := bufio.NewWriter(file)
+	if _, err := writer.WriteString(header + "\n"); err != nil {
+		file.Close()
+		return err
+	}
+	for i := range records {
+		line, err := encodeRecord(&records[i])
+		if err != nil {
+			file.Close()
+			return err
+		}
+		if _, err := writer.Write(line); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
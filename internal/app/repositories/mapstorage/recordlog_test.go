@@ -0,0 +1,169 @@
+package mapstorage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/romm80/shortener.git/internal/app"
+	"github.com/romm80/shortener.git/internal/app/models"
+	"github.com/romm80/shortener.git/internal/app/server"
+	"github.com/romm80/shortener.git/internal/app/service"
+)
+
+func newFileStorage(t *testing.T, path string) *MapStorage {
+	server.Cfg.FileStorage = path
+	t.Cleanup(func() { server.Cfg.FileStorage = "" })
+
+	s, err := New()
+	require.NoError(t, err)
+	t.Cleanup(func() { s.log.close() })
+	return s
+}
+
+func TestMapStorage_Replay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.log")
+	s := newFileStorage(t, path)
+
+	userID, err := s.NewUser(context.Background())
+	require.NoError(t, err)
+	emptyUserID, err := s.NewUser(context.Background())
+	require.NoError(t, err)
+	updatedID, err := s.Add(context.Background(), "https://www.google.com/", userID, nil)
+	require.NoError(t, err)
+	deletedID, err := s.Add(context.Background(), "https://yandex.ru/", userID, nil)
+	require.NoError(t, err)
+	_, err = s.AddAlias(context.Background(), "https://go.dev/", "go", userID, nil)
+	require.NoError(t, err)
+	require.NoError(t, s.UpdateURL(context.Background(), updatedID, "https://www.google.ru/", userID))
+	_, err = s.DeleteBatch(context.Background(), userID, []string{deletedID})
+	require.NoError(t, err)
+
+	replayed := newFileStorage(t, path)
+
+	assert.Equal(t, s.links, replayed.links)
+	assert.Equal(t, s.urls, replayed.urls)
+	assert.Equal(t, s.usersLinks, replayed.usersLinks)
+	assert.Equal(t, s.owners, replayed.owners)
+	assert.Len(t, replayed.history[updatedID], 1)
+	_, err = replayed.Get(context.Background(), deletedID)
+	assert.ErrorIs(t, err, app.ErrDeletedURL)
+
+	newUserID, err := replayed.NewUser(context.Background())
+	require.NoError(t, err)
+	assert.Greater(t, newUserID, emptyUserID)
+}
+
+func TestMapStorage_NewUserRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.log")
+	s := newFileStorage(t, path)
+
+	_, err := s.NewUser(context.Background())
+	require.NoError(t, err)
+	emptyUserID, err := s.NewUser(context.Background())
+	require.NoError(t, err)
+	// users are not written until the next record
+	assert.Equal(t, 0, s.log.records)
+
+	_, err = s.Add(context.Background(), "https://www.google.com/", 1, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, s.log.records)
+
+	replayed := newFileStorage(t, path)
+	newUserID, err := replayed.NewUser(context.Background())
+	require.NoError(t, err)
+	assert.Greater(t, newUserID, emptyUserID)
+}
+
+func TestMapStorage_AddBatchRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.log")
+	s := newFileStorage(t, path)
+
+	existingID, err := s.Add(context.Background(), "https://go.dev/", 1, nil)
+	require.NoError(t, err)
+	batch, err := s.AddBatch(context.Background(), []models.RequestBatch{
+		{CorrelationID: "1", OriginalURL: "https://www.google.com/"},
+		{CorrelationID: "2", OriginalURL: "https://go.dev/"},
+		{CorrelationID: "3", OriginalURL: "https://www.google.com/"},
+		{CorrelationID: "4", OriginalURL: "https://yandex.ru/"},
+	}, 1)
+	require.NoError(t, err)
+	require.Len(t, batch, 4)
+	assert.Equal(t, []models.BatchStatus{models.BatchCreated, models.BatchExisting, models.BatchExisting, models.BatchCreated},
+		[]models.BatchStatus{batch[0].Status, batch[1].Status, batch[2].Status, batch[3].Status})
+	assert.Equal(t, service.BaseURL(existingID), batch[1].ShortURL)
+	assert.Equal(t, batch[0].ShortURL, batch[2].ShortURL)
+	assert.NotEqual(t, batch[0].ShortURL, batch[3].ShortURL)
+	// the new links of the batch are written as consecutive records
+	assert.Equal(t, 3, s.log.records)
+	assert.Equal(t, uint64(3), s.log.seq)
+
+	replayed := newFileStorage(t, path)
+	assert.Equal(t, s.links, replayed.links)
+	assert.Equal(t, s.urls, replayed.urls)
+	assert.Equal(t, s.usersLinks, replayed.usersLinks)
+}
+
+func TestMapStorage_TornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.log")
+	s := newFileStorage(t, path)
+	urlID, err := s.Add(context.Background(), "https://www.google.com/", 1, nil)
+	require.NoError(t, err)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+	require.NoError(t, err)
+	_, err = file.WriteString(`1234abcd {"type":"create","id":"torn"`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	replayed := newFileStorage(t, path)
+	originURL, err := replayed.Get(context.Background(), urlID)
+	require.NoError(t, err)
+	assert.Equal(t, "https://www.google.com/", originURL)
+
+	truncated, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, info.Size(), truncated.Size())
+}
+
+func TestMapStorage_CorruptedRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.log")
+	s := newFileStorage(t, path)
+	_, err := s.Add(context.Background(), "https://www.google.com/", 1, nil)
+	require.NoError(t, err)
+	_, err = s.Add(context.Background(), "https://yandex.ru/", 1, nil)
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	data[len(logHeader)+1] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(path, data, 0666))
+
+	server.Cfg.FileStorage = path
+	_, err = New()
+	assert.Error(t, err)
+}
+
+func TestMapStorage_LegacyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+	legacy := `{"id":"8ffd","original_url":"https://www.google.com/"}` + "\n" +
+		`{"id":"go","original_url":"https://go.dev/","alias":true}` + "\n"
+	require.NoError(t, ioutil.WriteFile(path, []byte(legacy), 0666))
+
+	s := newFileStorage(t, path)
+	originURL, err := s.Get(context.Background(), "8ffd")
+	require.NoError(t, err)
+	assert.Equal(t, "https://www.google.com/", originURL)
+	assert.Equal(t, map[string]string{"https://www.google.com/": "8ffd"}, s.urls)
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), logHeader+"\n")
+}
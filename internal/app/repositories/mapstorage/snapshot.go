@@ -0,0 +1,139 @@
+package mapstorage
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/romm80/shortener.git/internal/app"
+	"github.com/romm80/shortener.git/internal/app/server"
+)
+
+// snapshotHeader - first line of the snapshot file, followed by the sequence number of the last record it covers
+const snapshotHeader = "shortener-snapshot v1"
+
+// snapshotPath returns the path of the snapshot file next to the storage file
+func snapshotPath(path string) string {
+	return path + ".snapshot"
+}
+
+// readSnapshot reads the snapshot file, a missing file is an empty snapshot.
+// The snapshot is written by renaming a complete file, so any damage is an error
+func readSnapshot(path string) (uint64, []record, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		return 0, nil, fmt.Errorf("snapshot file header: %w", err)
+	}
+	var seq uint64
+	if _, err := fmt.Sscanf(strings.TrimSuffix(header, "\n"), snapshotHeader+" %d", &seq); err != nil {
+		return 0, nil, fmt.Errorf("snapshot file header: %w", err)
+	}
+
+	records := make([]record, 0)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return seq, records, nil
+		}
+		if err != nil {
+			return 0, nil, fmt.Errorf("snapshot file record %d: %w", len(records)+1, err)
+		}
+		rec, err := decodeRecord(line[:len(line)-1])
+		if err != nil {
+			return 0, nil, fmt.Errorf("snapshot file record %d: %w", len(records)+1, err)
+		}
+		records = append(records, *rec)
+	}
+}
+
+// Snapshot writes the full storage state to the snapshot file and truncates the storage file
+func (s *MapStorage) Snapshot(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s.log == nil {
+		return fmt.Errorf("%w: storage file is not set", app.ErrNotSupported)
+	}
+	return s.snapshot()
+}
+
+// snapshotDue reports whether the storage file has grown over the configured thresholds, must be called under lock
+func (s *MapStorage) snapshotDue() bool {
+	return server.Cfg.SnapshotRecords > 0 && s.log.records >= server.Cfg.SnapshotRecords ||
+		server.Cfg.SnapshotSize > 0 && s.log.size >= server.Cfg.SnapshotSize
+}
+
+// snapshot must be called under lock.
+// A crash between writing the snapshot and truncating the storage file is safe:
+// records already covered by the snapshot are skipped by their sequence numbers on startup
+func (s *MapStorage) snapshot() error {
+	header := fmt.Sprintf("%s %d", snapshotHeader, s.log.seq)
+	if err := writeRecords(snapshotPath(s.log.file.Name()), header, s.snapshotRecords()); err != nil {
+		return err
+	}
+	return s.log.reset()
+}
+
+// snapshotRecords returns records which rebuild the current storage state, must be called under lock
+func (s *MapStorage) snapshotRecords() []record {
+	users := make([]uint64, 0, len(s.usersLinks)+1)
+	for userID := range s.usersLinks {
+		users = append(users, userID)
+	}
+	if _, ok := s.usersLinks[s.lastUserID]; !ok && s.lastUserID > 0 {
+		users = append(users, s.lastUserID)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i] < users[j] })
+
+	ids := make([]string, 0, len(s.links))
+	for id := range s.links {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if !s.created[ids[i]].Equal(s.created[ids[j]]) {
+			return s.created[ids[i]].Before(s.created[ids[j]])
+		}
+		return ids[i] < ids[j]
+	})
+
+	records := make([]record, 0, len(users)+len(ids))
+	for _, userID := range users {
+		records = append(records, record{Type: recordUser, UserID: userID})
+	}
+	for _, id := range ids {
+		url := s.links[id]
+		records = append(records, record{
+			Type:      recordCreate,
+			ID:        id,
+			URL:       url,
+			UserID:    s.owners[id],
+			Alias:     s.aliases[id],
+			ExpiresAt: s.expires[id],
+			Time:      s.created[id],
+		})
+		for _, h := range s.history[id] {
+			records = append(records, record{Type: recordHistory, ID: id, URL: h.OriginalURL, Time: h.ReplacedAt})
+		}
+		if deletedAt, ok := s.deleted[id]; ok {
+			records = append(records, record{Type: recordDelete, ID: id, Time: deletedAt})
+		}
+	}
+	return records
+}
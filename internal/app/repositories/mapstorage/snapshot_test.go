@@ -0,0 +1,87 @@
+package mapstorage
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/romm80/shortener.git/internal/app"
+	"github.com/romm80/shortener.git/internal/app/server"
+)
+
+func TestMapStorage_Snapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.log")
+	s := newFileStorage(t, path)
+
+	userID, err := s.NewUser(context.Background())
+	require.NoError(t, err)
+	updatedID, err := s.Add(context.Background(), "https://www.google.com/", userID, nil)
+	require.NoError(t, err)
+	deletedID, err := s.Add(context.Background(), "https://yandex.ru/", userID, nil)
+	require.NoError(t, err)
+	_, err = s.AddAlias(context.Background(), "https://go.dev/", "go", userID, nil)
+	require.NoError(t, err)
+	require.NoError(t, s.UpdateURL(context.Background(), updatedID, "https://www.google.ru/", userID))
+	_, err = s.DeleteBatch(context.Background(), userID, []string{deletedID})
+	require.NoError(t, err)
+
+	require.NoError(t, s.Snapshot(context.Background()))
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, logHeader+"\n", string(data))
+
+	tailID, err := s.Add(context.Background(), "https://github.com/", userID, nil)
+	require.NoError(t, err)
+
+	replayed := newFileStorage(t, path)
+	assert.Equal(t, s.links, replayed.links)
+	assert.Equal(t, s.urls, replayed.urls)
+	assert.Equal(t, s.usersLinks, replayed.usersLinks)
+	require.Len(t, replayed.history[updatedID], 1)
+	assert.Equal(t, "https://www.google.com/", replayed.history[updatedID][0].OriginalURL)
+	assert.True(t, s.history[updatedID][0].ReplacedAt.Equal(replayed.history[updatedID][0].ReplacedAt))
+	assert.True(t, s.deleted[deletedID].Equal(replayed.deleted[deletedID]))
+	assert.Contains(t, replayed.links, tailID)
+	assert.Equal(t, s.log.seq, replayed.log.seq)
+}
+
+func TestMapStorage_SnapshotBeforeTruncation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.log")
+	s := newFileStorage(t, path)
+	urlID, err := s.Add(context.Background(), "https://www.google.com/", 1, nil)
+	require.NoError(t, err)
+	require.NoError(t, s.UpdateURL(context.Background(), urlID, "https://www.google.ru/", 1))
+
+	// the storage stopped after the snapshot was written but before the storage file was truncated
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, s.Snapshot(context.Background()))
+	require.NoError(t, ioutil.WriteFile(path, data, 0666))
+
+	replayed := newFileStorage(t, path)
+	assert.Equal(t, s.links, replayed.links)
+	assert.Len(t, replayed.history[urlID], 1)
+}
+
+func TestMapStorage_SnapshotThreshold(t *testing.T) {
+	server.Cfg.SnapshotRecords = 3
+	t.Cleanup(func() { server.Cfg.SnapshotRecords = 0 })
+
+	s := newFileStorage(t, filepath.Join(t.TempDir(), "storage.log"))
+	for _, url := range []string{"https://www.google.com/", "https://yandex.ru/", "https://go.dev/", "https://github.com/"} {
+		_, err := s.Add(context.Background(), url, 1, nil)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 1, s.log.records)
+	assert.Equal(t, uint64(4), s.log.seq)
+}
+
+func TestMapStorage_SnapshotWithoutFile(t *testing.T) {
+	s, err := New()
+	require.NoError(t, err)
+	assert.ErrorIs(t, s.Snapshot(context.Background()), app.ErrNotSupported)
+}
@@ -2,7 +2,9 @@
 package repositories
 
 import (
+	"context"
 	"errors"
+	"time"
 
 	"github.com/romm80/shortener.git/internal/app/models"
 	"github.com/romm80/shortener.git/internal/app/repositories/dbpostgres"
@@ -13,13 +15,75 @@ import (
 
 // Shortener repository interface
 type Shortener interface {
-	Add(url string, userID uint64) (string, error)                                      // adds a link by user id
-	AddBatch(urls []models.RequestBatch, userID uint64) ([]models.ResponseBatch, error) // adds a batch of links by user id
-	Get(id string) (string, error)                                                      // returns original link by id
-	GetUserURLs(userID uint64) ([]models.UserURLs, error)                               // returns user shortened links
-	NewUser() (uint64, error)                                                           // adds a new user
-	Ping() error                                                                        // database connection check
-	DeleteBatch(uint64, []string) error                                                 // batch deleting links by user id
+	Add(ctx context.Context, url string, userID uint64, expiresAt *time.Time) (string, error)                // adds a link by user id
+	AddBatch(ctx context.Context, urls []models.RequestBatch, userID uint64) ([]models.ResponseBatch, error) // adds a batch of links by user id, returns a result for every link in order
+	AddAlias(ctx context.Context, url, alias string, userID uint64, expiresAt *time.Time) (string, error)    // adds a link with a custom id by user id
+	Get(ctx context.Context, id string) (string, error)                                                      // returns original link by id
+	GetUserURLs(ctx context.Context, userID uint64) ([]models.UserURLs, error)                               // returns user shortened links
+	GetUserURLsPage(ctx context.Context, userID uint64, query models.URLsQuery) (models.UserURLsPage, error) // returns a page of user shortened links
+	NewUser(ctx context.Context) (uint64, error)                                                             // adds a new user
+	Ping(ctx context.Context) error                                                                          // database connection check
+	DeleteBatch(ctx context.Context, userID uint64, urlsID []string) ([]string, error)                       // batch deleting links by user id, returns deleted ids
+	GetUserTrash(ctx context.Context, userID uint64) ([]models.TrashURL, error)                              // returns user deleted links
+	RestoreBatch(ctx context.Context, userID uint64, urlsID []string) ([]string, error)                      // restores deleted links by user id, returns restored ids
+	PurgeDeleted(ctx context.Context, before time.Time) error                                                // permanently removes links deleted before the time
+	DeleteExpired(ctx context.Context) error                                                                 // marks expired links as deleted
+	UpdateURL(ctx context.Context, urlID, url string, userID uint64) error                                   // replaces the original link by the link owner
+	GetURLHistory(ctx context.Context, urlID string, userID uint64) ([]models.URLHistory, error)             // returns previous original links for the link owner
+}
+
+// Stats click statistics repository interface
+type Stats interface {
+	AddClicks(ctx context.Context, clicks []models.Click) error                          // records redirect events
+	GetStats(ctx context.Context, urlID string, userID uint64) (models.LinkStats, error) // returns link statistics for the link owner
+}
+
+// Idempotency idempotency keys repository interface
+type Idempotency interface {
+	BeginRequest(ctx context.Context, userID uint64, key, requestHash string, expiresAt time.Time) (*models.IdempotentResponse, error) // reserves the key, returns the remembered response of the completed request
+	CompleteRequest(ctx context.Context, userID uint64, key string, response models.IdempotentResponse) error                          // remembers the response of the request
+	ReleaseRequest(ctx context.Context, userID uint64, key string) error                                                               // frees the key of the failed request
+	DeleteExpiredKeys(ctx context.Context) error                                                                                       // removes keys of expired window
+}
+
+// Queue durable background job queue interface.
+// A dequeued message is hidden for the visibility timeout and delivered again unless it is acknowledged
+type Queue interface {
+	Enqueue(ctx context.Context, kind string, payload []byte, limit int) (string, error)                          // adds a message, app.ErrQueueFull if the kind has limit messages, 0 - no limit
+	Dequeue(ctx context.Context, kind string, limit int, visibility time.Duration) ([]models.QueueMessage, error) // leases up to limit available messages in order
+	Ack(ctx context.Context, id string) error                                                                     // removes the processed message
+	Pending(ctx context.Context, kind string) (int, error)                                                        // returns the number of messages of the kind including leased ones
+	Retry(ctx context.Context, id string, availableAt time.Time, reason string) error                             // returns the failed message to the queue until the time
+}
+
+// JobStore durable state of the background jobs kept alongside the queue, so jobs outlive restarts
+type JobStore interface {
+	SaveJobs(ctx context.Context, jobs ...models.DeleteJob) error    // creates or replaces the jobs at once
+	GetJob(ctx context.Context, id string) (models.DeleteJob, error) // returns the job, app.ErrJobNotFound if it is unknown
+	RemoveJob(ctx context.Context, id string) error                  // removes the job
+	RemoveFinishedJobs(ctx context.Context, before time.Time) error  // removes the jobs finished before the time
+}
+
+// Locker storage shared by several instances which can elect the instance running a named job.
+// A lock is held by the instance until it is unlocked or the instance loses the storage connection
+type Locker interface {
+	TryLock(ctx context.Context, name string) (bool, error) // acquires the lock or checks it is still held, false if another instance holds it
+	Unlock(ctx context.Context, name string) error          // releases the lock held by the instance
+}
+
+// Migrations storage with a versioned schema
+type Migrations interface {
+	CheckMigrations(ctx context.Context) error // checks the schema is at the version expected by the instance
+}
+
+// Pooled storage with a connection pool
+type Pooled interface {
+	PoolStats() models.PoolStats // returns the connection pool statistics
+}
+
+// Snapshotter storage which can write its state to a snapshot and compact the storage file
+type Snapshotter interface {
+	Snapshot(ctx context.Context) error // writes the full storage state to the snapshot and truncates the storage file
 }
 
 // NewStorage returns an initialized database connection
@@ -33,7 +97,7 @@ func NewStorage() (Shortener, error) {
 	case server.DBPostgres:
 		storage, err = dbpostgres.New()
 	case server.DBLinkedList:
-		storage = linkedliststorage.New()
+		storage, err = linkedliststorage.New()
 	default:
 		return nil, errors.New("wrong DB type")
 	}
@@ -43,3 +107,39 @@ func NewStorage() (Shortener, error) {
 
 	return storage, nil
 }
+
+// NewIdempotency returns the idempotency keys repository stored alongside the links
+func NewIdempotency(storage Shortener) (Idempotency, error) {
+	keys, ok := Unwrap(storage).(Idempotency)
+	if !ok {
+		return nil, errors.New("storage does not support idempotency keys")
+	}
+	return keys, nil
+}
+
+// NewQueue returns the background job queue stored alongside the links
+func NewQueue(storage Shortener) (Queue, error) {
+	queue, ok := Unwrap(storage).(Queue)
+	if !ok {
+		return nil, errors.New("storage does not support job queue")
+	}
+	return queue, nil
+}
+
+// NewJobStore returns the background jobs state stored alongside the queue
+func NewJobStore(storage Shortener) (JobStore, error) {
+	jobs, ok := Unwrap(storage).(JobStore)
+	if !ok {
+		return nil, errors.New("storage does not support job state")
+	}
+	return jobs, nil
+}
+
+// NewStats returns the click statistics repository stored alongside the links
+func NewStats(storage Shortener) (Stats, error) {
+	stats, ok := Unwrap(storage).(Stats)
+	if !ok {
+		return nil, errors.New("storage does not support click statistics")
+	}
+	return stats, nil
+}
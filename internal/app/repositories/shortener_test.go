@@ -1,12 +1,25 @@
 package repositories
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base32"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/romm80/shortener.git/internal/app"
+	"github.com/romm80/shortener.git/internal/app/models"
+	"github.com/romm80/shortener.git/internal/app/repositories/dbpostgres"
 	"github.com/romm80/shortener.git/internal/app/repositories/linkedliststorage"
 	"github.com/romm80/shortener.git/internal/app/repositories/mapstorage"
+	"github.com/romm80/shortener.git/internal/app/server"
 )
 
 const triesN = 10000
@@ -14,7 +27,7 @@ const triesN = 10000
 func BenchmarkAdd(b *testing.B) {
 
 	mapDB, _ := mapstorage.New()
-	listDB := linkedliststorage.New()
+	listDB, _ := linkedliststorage.New()
 	var urls []string
 
 	for i := 0; i < triesN; i++ {
@@ -27,20 +40,99 @@ func BenchmarkAdd(b *testing.B) {
 
 	b.Run("map", func(b *testing.B) {
 		for i := 0; i < triesN; i++ {
-			_, _ = mapDB.Add(urls[i], 1)
+			_, _ = mapDB.Add(context.Background(), urls[i], 1, nil)
 		}
 	})
 
 	b.Run("list", func(b *testing.B) {
 		for i := 0; i < triesN; i++ {
-			_, _ = listDB.Add(urls[i], 1)
+			_, _ = listDB.Add(context.Background(), urls[i], 1, nil)
+		}
+	})
+}
+
+// newPostgres connects to the database from DATABASE_DSN, the benchmark or the test is skipped without it
+func newPostgres(b testing.TB) *dbpostgres.DB {
+	server.Cfg.DatabaseDNS = os.Getenv("DATABASE_DSN")
+	if server.Cfg.DatabaseDNS == "" {
+		b.Skip("DATABASE_DSN is not set")
+	}
+	server.Cfg.MigrationsPath = filepath.Join("..", "..", "..", "db", "migrations")
+
+	db, err := dbpostgres.New()
+	require.NoError(b, err)
+	return db
+}
+
+// newBatches returns n batches of links which are not stored yet
+func newBatches(n, size int) [][]models.RequestBatch {
+	batches := make([][]models.RequestBatch, n)
+	for i := range batches {
+		batches[i] = make([]models.RequestBatch, 0, size)
+		for j := 0; j < size; j++ {
+			randomBytes := make([]byte, 32)
+			_, _ = rand.Read(randomBytes)
+			batches[i] = append(batches[i], models.RequestBatch{
+				CorrelationID: strconv.Itoa(j),
+				OriginalURL:   "https://" + base32.StdEncoding.EncodeToString(randomBytes),
+			})
+		}
+	}
+	return batches
+}
+
+func BenchmarkAddBatch(b *testing.B) {
+	const batchSize = 1000
+
+	b.Run("map", func(b *testing.B) {
+		mapDB, _ := mapstorage.New()
+		batches := newBatches(b.N, batchSize)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_, _ = mapDB.AddBatch(context.Background(), batches[i], 1)
+		}
+	})
+
+	b.Run("list", func(b *testing.B) {
+		listDB, _ := linkedliststorage.New()
+		batches := newBatches(b.N, batchSize)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_, _ = listDB.AddBatch(context.Background(), batches[i], 1)
+		}
+	})
+
+	// row by row inserts, as the batch was stored before the staging table
+	b.Run("postgres_rows", func(b *testing.B) {
+		db := newPostgres(b)
+		userID, err := db.NewUser(context.Background())
+		require.NoError(b, err)
+		batches := newBatches(b.N, batchSize)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, v := range batches[i] {
+				_, err := db.Add(context.Background(), v.OriginalURL, userID, nil)
+				require.NoError(b, err)
+			}
+		}
+	})
+
+	b.Run("postgres_batch", func(b *testing.B) {
+		db := newPostgres(b)
+		userID, err := db.NewUser(context.Background())
+		require.NoError(b, err)
+		batches := newBatches(b.N, batchSize)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_, err := db.AddBatch(context.Background(), batches[i], userID)
+			require.NoError(b, err)
 		}
 	})
 }
 
 func BenchmarkGet(b *testing.B) {
 	mapDB, _ := mapstorage.New()
-	listDB := linkedliststorage.New()
+	listDB, _ := linkedliststorage.New()
 	var urls, IDs []string
 
 	for i := 0; i < triesN; i++ {
@@ -49,21 +141,21 @@ func BenchmarkGet(b *testing.B) {
 		urls = append(urls, base32.StdEncoding.EncodeToString(randomBytes))
 	}
 	for i := 0; i < triesN; i++ {
-		_, _ = mapDB.Add(urls[i], 1)
-		id, _ := listDB.Add(urls[i], 1)
+		_, _ = mapDB.Add(context.Background(), urls[i], 1, nil)
+		id, _ := listDB.Add(context.Background(), urls[i], 1, nil)
 		IDs = append(IDs, id)
 	}
 	b.ResetTimer()
 
 	b.Run("map", func(b *testing.B) {
 		for i := 0; i < triesN; i++ {
-			_, _ = mapDB.Get(IDs[i])
+			_, _ = mapDB.Get(context.Background(), IDs[i])
 		}
 	})
 
 	b.Run("list", func(b *testing.B) {
 		for i := 0; i < triesN; i++ {
-			_, _ = listDB.Get(IDs[i])
+			_, _ = listDB.Get(context.Background(), IDs[i])
 		}
 	})
 }
@@ -74,15 +166,15 @@ func BenchmarkGetUserURLs(b *testing.B) {
 		urlsN  = 100
 	)
 	mapDB, _ := mapstorage.New()
-	listDB := linkedliststorage.New()
+	listDB, _ := linkedliststorage.New()
 
 	for i := 0; i < usersN; i++ {
 		for j := 0; j < urlsN; j++ {
 			randomBytes := make([]byte, 32)
 			_, _ = rand.Read(randomBytes)
 			originURL := base32.StdEncoding.EncodeToString(randomBytes)
-			_, _ = mapDB.Add(originURL, uint64(i))
-			_, _ = listDB.Add(originURL, uint64(i))
+			_, _ = mapDB.Add(context.Background(), originURL, uint64(i), nil)
+			_, _ = listDB.Add(context.Background(), originURL, uint64(i), nil)
 		}
 	}
 
@@ -90,13 +182,13 @@ func BenchmarkGetUserURLs(b *testing.B) {
 
 	b.Run("map", func(b *testing.B) {
 		for i := 0; i < triesN; i++ {
-			_, _ = mapDB.GetUserURLs(uint64(i % usersN))
+			_, _ = mapDB.GetUserURLs(context.Background(), uint64(i%usersN))
 		}
 	})
 
 	b.Run("list", func(b *testing.B) {
 		for i := 0; i < triesN; i++ {
-			_, _ = listDB.GetUserURLs(uint64(i % usersN))
+			_, _ = listDB.GetUserURLs(context.Background(), uint64(i%usersN))
 		}
 	})
 
@@ -108,7 +200,7 @@ func BenchmarkDeleteBatch(b *testing.B) {
 		urlsN  = 100
 	)
 	mapDB, _ := mapstorage.New()
-	listDB := linkedliststorage.New()
+	listDB, _ := linkedliststorage.New()
 	userURLs := make(map[uint64][]string, usersN)
 
 	for i := 0; i < usersN; i++ {
@@ -116,8 +208,8 @@ func BenchmarkDeleteBatch(b *testing.B) {
 			randomBytes := make([]byte, 32)
 			_, _ = rand.Read(randomBytes)
 			originURL := base32.StdEncoding.EncodeToString(randomBytes)
-			_, _ = mapDB.Add(originURL, uint64(i))
-			urlID, _ := listDB.Add(originURL, uint64(i))
+			_, _ = mapDB.Add(context.Background(), originURL, uint64(i), nil)
+			urlID, _ := listDB.Add(context.Background(), originURL, uint64(i), nil)
 			if userURLs[uint64(i)] == nil {
 				userURLs[uint64(i)] = make([]string, 0, urlsN)
 			}
@@ -129,13 +221,249 @@ func BenchmarkDeleteBatch(b *testing.B) {
 
 	b.Run("map", func(b *testing.B) {
 		for i := 0; i < usersN; i++ {
-			_ = mapDB.DeleteBatch(uint64(i), userURLs[uint64(i)])
+			_, _ = mapDB.DeleteBatch(context.Background(), uint64(i), userURLs[uint64(i)])
 		}
 	})
 
 	b.Run("list", func(b *testing.B) {
 		for i := 0; i < usersN; i++ {
-			_ = listDB.DeleteBatch(uint64(i), userURLs[uint64(i)])
+			_, _ = listDB.DeleteBatch(context.Background(), uint64(i), userURLs[uint64(i)])
 		}
 	})
 }
+
+func TestDeleteBatch(t *testing.T) {
+	server.Cfg.FileStorage = ""
+	mapDB, err := mapstorage.New()
+	require.NoError(t, err)
+	listDB, err := linkedliststorage.New()
+	require.NoError(t, err)
+
+	for name, storage := range map[string]Shortener{"map": mapDB, "list": listDB} {
+		t.Run(name, func(t *testing.T) {
+			ownURL, err := storage.Add(context.Background(), "https://www.google.com/", 1, nil)
+			require.NoError(t, err)
+			otherURL, err := storage.Add(context.Background(), "https://yandex.ru/", 2, nil)
+			require.NoError(t, err)
+
+			deleted, err := storage.DeleteBatch(context.Background(), 1, []string{ownURL, otherURL})
+			require.NoError(t, err)
+			assert.Equal(t, []string{ownURL}, deleted)
+
+			_, err = storage.Get(context.Background(), ownURL)
+			assert.ErrorIs(t, err, app.ErrDeletedURL)
+			originURL, err := storage.Get(context.Background(), otherURL)
+			assert.NoError(t, err)
+			assert.Equal(t, "https://yandex.ru/", originURL)
+
+			urls, err := storage.GetUserURLs(context.Background(), 1)
+			require.NoError(t, err)
+			assert.Empty(t, urls)
+		})
+	}
+}
+
+func TestGet_UnknownID(t *testing.T) {
+	server.Cfg.FileStorage = ""
+	mapDB, err := mapstorage.New()
+	require.NoError(t, err)
+	listDB, err := linkedliststorage.New()
+	require.NoError(t, err)
+	storages := map[string]func(t *testing.T) Shortener{
+		"map":      func(t *testing.T) Shortener { return mapDB },
+		"list":     func(t *testing.T) Shortener { return listDB },
+		"postgres": func(t *testing.T) Shortener { return newPostgres(t) },
+	}
+
+	for name, newStorage := range storages {
+		t.Run(name, func(t *testing.T) {
+			storage := newStorage(t)
+			_, err := storage.Get(context.Background(), "unknown-"+strconv.FormatInt(time.Now().UnixNano(), 36))
+			assert.ErrorIs(t, err, app.ErrLinkNoFound)
+
+			// a purged link is unknown as well
+			urlID, err := storage.Add(context.Background(), "https://purged.example/"+strconv.FormatInt(time.Now().UnixNano(), 36), 1, nil)
+			require.NoError(t, err)
+			_, err = storage.DeleteBatch(context.Background(), 1, []string{urlID})
+			require.NoError(t, err)
+			require.NoError(t, storage.PurgeDeleted(context.Background(), time.Now().Add(time.Second)))
+			_, err = storage.Get(context.Background(), urlID)
+			assert.ErrorIs(t, err, app.ErrLinkNoFound)
+		})
+	}
+}
+
+func TestAdd_Concurrent(t *testing.T) {
+	db := newPostgres(t)
+	url := "https://concurrent.example/" + strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	const n = 8
+	ids := make([]string, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids[i], errs[i] = db.Add(context.Background(), url, 1, nil)
+		}(i)
+	}
+	wg.Wait()
+
+	// the link is created once, the rest of the requests get the existing id
+	created := 0
+	for i := 0; i < n; i++ {
+		if errs[i] == nil {
+			created++
+		} else {
+			assert.ErrorIs(t, errs[i], app.ErrConflictURLID)
+		}
+		assert.Equal(t, ids[0], ids[i])
+	}
+	assert.Equal(t, 1, created)
+}
+
+func TestMapStorage_Tombstones(t *testing.T) {
+	server.Cfg.FileStorage = filepath.Join(t.TempDir(), "storage.json")
+	defer func() { server.Cfg.FileStorage = "" }()
+
+	storage, err := mapstorage.New()
+	require.NoError(t, err)
+	deletedURL, err := storage.Add(context.Background(), "https://www.google.com/", 1, nil)
+	require.NoError(t, err)
+	restoredURL, err := storage.Add(context.Background(), "https://yandex.ru/", 1, nil)
+	require.NoError(t, err)
+	_, err = storage.DeleteBatch(context.Background(), 1, []string{deletedURL, restoredURL})
+	require.NoError(t, err)
+	_, err = storage.RestoreBatch(context.Background(), 1, []string{restoredURL})
+	require.NoError(t, err)
+
+	storage, err = mapstorage.New()
+	require.NoError(t, err)
+	_, err = storage.Get(context.Background(), deletedURL)
+	assert.ErrorIs(t, err, app.ErrDeletedURL)
+	originURL, err := storage.Get(context.Background(), restoredURL)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://yandex.ru/", originURL)
+}
+
+func TestCancelledContext(t *testing.T) {
+	server.Cfg.FileStorage = ""
+	mapDB, err := mapstorage.New()
+	require.NoError(t, err)
+	listDB, err := linkedliststorage.New()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for name, storage := range map[string]Shortener{"map": mapDB, "list": listDB} {
+		t.Run(name, func(t *testing.T) {
+			urlID, err := storage.Add(context.Background(), "https://www.google.com/", 1, nil)
+			require.NoError(t, err)
+
+			_, err = storage.Add(ctx, "https://yandex.ru/", 1, nil)
+			assert.ErrorIs(t, err, context.Canceled)
+			_, err = storage.Get(ctx, urlID)
+			assert.ErrorIs(t, err, context.Canceled)
+			_, err = storage.DeleteBatch(ctx, 1, []string{urlID})
+			assert.ErrorIs(t, err, context.Canceled)
+			_, err = storage.GetUserURLsPage(ctx, 1, models.URLsQuery{})
+			assert.ErrorIs(t, err, context.Canceled)
+
+			_, err = storage.Get(context.Background(), urlID)
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	server.Cfg.FileStorage = ""
+	mapDB, err := mapstorage.New()
+	require.NoError(t, err)
+	listDB, err := linkedliststorage.New()
+	require.NoError(t, err)
+
+	for name, storage := range map[string]Shortener{"map": mapDB, "list": listDB} {
+		t.Run(name, func(t *testing.T) {
+			past := time.Now().Add(-time.Minute)
+			future := time.Now().Add(time.Hour)
+			expiredURL, err := storage.Add(context.Background(), "https://www.google.com/", 1, &past)
+			require.NoError(t, err)
+			liveURL, err := storage.Add(context.Background(), "https://yandex.ru/", 1, &future)
+			require.NoError(t, err)
+
+			_, err = storage.Get(context.Background(), expiredURL)
+			assert.ErrorIs(t, err, app.ErrExpiredURL)
+
+			require.NoError(t, storage.DeleteExpired(context.Background()))
+			_, err = storage.Get(context.Background(), expiredURL)
+			assert.ErrorIs(t, err, app.ErrDeletedURL)
+			originURL, err := storage.Get(context.Background(), liveURL)
+			assert.NoError(t, err)
+			assert.Equal(t, "https://yandex.ru/", originURL)
+
+			trash, err := storage.GetUserTrash(context.Background(), 1)
+			require.NoError(t, err)
+			require.Len(t, trash, 1)
+			assert.Equal(t, "https://www.google.com/", trash[0].OriginalURL)
+
+			// the expired link is not restored
+			restored, err := storage.RestoreBatch(context.Background(), 1, []string{expiredURL})
+			require.NoError(t, err)
+			assert.Empty(t, restored)
+		})
+	}
+}
+
+func TestAdd_DeadURL(t *testing.T) {
+	server.Cfg.FileStorage = filepath.Join(t.TempDir(), "storage.json")
+	defer func() { server.Cfg.FileStorage = "" }()
+	mapDB, err := mapstorage.New()
+	require.NoError(t, err)
+	listDB, err := linkedliststorage.New()
+	require.NoError(t, err)
+
+	for name, storage := range map[string]Shortener{"map": mapDB, "list": listDB} {
+		t.Run(name, func(t *testing.T) {
+			past := time.Now().Add(-time.Minute)
+			expiredURL, err := storage.Add(context.Background(), "https://www.google.com/", 1, &past)
+			require.NoError(t, err)
+			deletedURL, err := storage.Add(context.Background(), "https://yandex.ru/", 1, nil)
+			require.NoError(t, err)
+			_, err = storage.DeleteBatch(context.Background(), 1, []string{deletedURL})
+			require.NoError(t, err)
+
+			// dead links do not conflict, the original links are shortened again
+			reshortened := make([]string, 0, 2)
+			for _, originURL := range []string{"https://www.google.com/", "https://yandex.ru/"} {
+				urlID, err := storage.Add(context.Background(), originURL, 2, nil)
+				require.NoError(t, err)
+				reshortened = append(reshortened, urlID)
+				got, err := storage.Get(context.Background(), urlID)
+				require.NoError(t, err)
+				assert.Equal(t, originURL, got)
+			}
+			assert.NotEqual(t, expiredURL, reshortened[0])
+			assert.NotEqual(t, deletedURL, reshortened[1])
+
+			// the live link conflicts
+			urlID, err := storage.Add(context.Background(), "https://yandex.ru/", 1, nil)
+			assert.ErrorIs(t, err, app.ErrConflictURLID)
+			assert.Equal(t, reshortened[1], urlID)
+
+			// the deleted link is not restored while the original link is shortened again
+			restored, err := storage.RestoreBatch(context.Background(), 1, []string{deletedURL})
+			require.NoError(t, err)
+			assert.Empty(t, restored)
+		})
+	}
+
+	// the live link is found after the replay
+	mapDB, err = mapstorage.New()
+	require.NoError(t, err)
+	_, err = mapDB.Add(context.Background(), "https://yandex.ru/", 1, nil)
+	assert.ErrorIs(t, err, app.ErrConflictURLID)
+	_, err = mapDB.Add(context.Background(), "https://www.google.com/", 1, nil)
+	assert.ErrorIs(t, err, app.ErrConflictURLID)
+}
@@ -1,43 +1,123 @@
 package server
 
 import (
-	"encoding/json"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"flag"
-	"io/ioutil"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/caarlos0/env/v6"
+	"github.com/romm80/shortener.git/internal/app/logger"
 	"github.com/romm80/shortener.git/internal/app/service/certificate"
+	"github.com/romm80/shortener.git/internal/app/service/tracing"
 )
 
-// Config stores server settings
+// Config stores server settings.
+// Every field with the env tag is read from the defaults, the config file keyed by the json tag,
+// the environment and the command line flags in order of increasing priority
 type Config struct {
 	// SrvAddr - server address
-	SrvAddr string `env:"SERVER_ADDRESS" envDefault:"127.0.0.1:8080" json:"server_address,omitempty"`
+	SrvAddr string `env:"SERVER_ADDRESS" envDefault:"127.0.0.1:8080" json:"server_address"`
 	// BaseURL - host for generated shortener link id
-	BaseURL string `env:"BASE_URL" envDefault:"http://127.0.0.1:8080" json:"base_url,omitempty"`
+	BaseURL string `env:"BASE_URL" envDefault:"http://127.0.0.1:8080" json:"base_url"`
 	// FileStorage - path to the shortened link storage file
-	FileStorage string `env:"FILE_STORAGE_PATH" json:"file_storage_path,omitempty"`
+	FileStorage string `env:"FILE_STORAGE_PATH" json:"file_storage_path"`
 	// DatabaseDNS - connection string to postgres
-	DatabaseDNS string `env:"DATABASE_DSN" envDefault:"" json:"database_dsn,omitempty"`
-	// DBType - database type used to store shortened links
-	DBType DBType
+	DatabaseDNS string `env:"DATABASE_DSN" json:"database_dsn" secret:"dsn"`
+	// DBType - database type used to store shortened links, empty - DBPostgres with the connection string, DBMap otherwise
+	DBType DBType `env:"DB_TYPE" json:"db_type"`
+	// MigrationsPath - directory of the postgres schema migrations
+	MigrationsPath string `env:"MIGRATIONS_PATH" envDefault:"db/migrations" json:"migrations_path"`
 	// Domain - domain used to fill in the cookie
-	Domain string
-	// SecretKey - signing key
-	SecretKey []byte
+	Domain string `env:"DOMAIN" envDefault:"localhost" json:"domain"`
+	// SecretKey - signing key of the user cookies, required by the persistent storage, empty - a random key valid until restart
+	SecretKey string `env:"SECRET_KEY" json:"secret_key" secret:"true"`
 	// EnableHTTPS - turn on/of https
-	EnableHTTPS bool `env:"ENABLE_HTTPS" envDefault:"false" json:"enable_https,omitempty"`
-	// Config - config json file
-	Config string `env:"CONFIG"`
-	// CertFilePath
-	CertFilePath string
-	// PrivateKeyFilePath
-	PrivateKeyFilePath string
+	EnableHTTPS bool `env:"ENABLE_HTTPS" envDefault:"false" json:"enable_https"`
+	// Config - config file, YAML with the .yaml or .yml extension, JSON otherwise
+	Config string `env:"CONFIG" json:"-"`
+	// CertFilePath - TLS certificate, a self-signed one is generated if the certificate and the key are not set
+	CertFilePath string `env:"TLS_CERT" json:"tls_cert"`
+	// PrivateKeyFilePath - TLS private key
+	PrivateKeyFilePath string `env:"TLS_KEY" json:"tls_key"`
+	// IDStrategy - shortened link id generation strategy, empty - hash
+	IDStrategy IDStrategy `env:"ID_STRATEGY" json:"id_strategy"`
+	// IDLength - initial length of generated link id, 0 - strategy default
+	IDLength int `env:"ID_LENGTH" json:"id_length"`
+	// IDAlphabet - alphabet of the counter and random strategies, empty - base62
+	IDAlphabet string `env:"ID_ALPHABET" json:"id_alphabet"`
+	// ExpireInterval - period of marking expired links as deleted
+	ExpireInterval time.Duration `env:"EXPIRE_INTERVAL" envDefault:"1m" json:"expire_interval"`
+	// PurgeInterval - period of permanently removing deleted links
+	PurgeInterval time.Duration `env:"PURGE_INTERVAL" envDefault:"1h" json:"purge_interval"`
+	// TrashRetention - period during which deleted links can be restored
+	TrashRetention time.Duration `env:"TRASH_RETENTION" envDefault:"720h" json:"trash_retention"`
+	// StorageReadTimeout - deadline of storage read operations, 0 - request deadline only
+	StorageReadTimeout time.Duration `env:"STORAGE_READ_TIMEOUT" envDefault:"2s" json:"storage_read_timeout"`
+	// StorageWriteTimeout - deadline of storage single link write operations, 0 - request deadline only
+	StorageWriteTimeout time.Duration `env:"STORAGE_WRITE_TIMEOUT" envDefault:"5s" json:"storage_write_timeout"`
+	// StorageBatchTimeout - deadline of storage batch and background operations, 0 - request deadline only
+	StorageBatchTimeout time.Duration `env:"STORAGE_BATCH_TIMEOUT" envDefault:"30s" json:"storage_batch_timeout"`
+	// IdempotencyWindow - period during which a request with the same Idempotency-Key is replayed, 0 - disabled
+	IdempotencyWindow time.Duration `env:"IDEMPOTENCY_WINDOW" envDefault:"24h" json:"idempotency_window"`
+	// AdminAddr - admin server address, empty - the admin server is disabled
+	AdminAddr string `env:"ADMIN_ADDRESS" envDefault:"127.0.0.1:8081" json:"admin_address"`
+	// AdminCertFile - admin server TLS certificate, the admin server uses TLS if the certificate and the key are set
+	AdminCertFile string `env:"ADMIN_TLS_CERT" json:"admin_tls_cert"`
+	// AdminKeyFile - admin server TLS private key
+	AdminKeyFile string `env:"ADMIN_TLS_KEY" json:"admin_tls_key"`
+	// AdminUser - admin basic auth user, empty - basic auth is disabled
+	AdminUser string `env:"ADMIN_USER" json:"admin_user"`
+	// AdminPassword - admin basic auth password
+	AdminPassword string `env:"ADMIN_PASSWORD" json:"admin_password" secret:"true"`
+	// AdminTrustedSubnet - CIDR of the admin clients, empty - any client
+	AdminTrustedSubnet string `env:"ADMIN_TRUSTED_SUBNET" json:"admin_trusted_subnet"`
+	// DeleteWorkers - number of concurrent link deletions
+	DeleteWorkers int `env:"DELETE_WORKERS" envDefault:"4" json:"delete_workers"`
+	// DeleteQueueSize - number of pending deletion requests, new requests are rejected when it is full
+	DeleteQueueSize int `env:"DELETE_QUEUE_SIZE" envDefault:"1000" json:"delete_queue_size"`
+	// DeleteWindow - period during which deletion requests of the user are coalesced, 0 - disabled
+	DeleteWindow time.Duration `env:"DELETE_COALESCE_WINDOW" envDefault:"100ms" json:"delete_coalesce_window"`
+	// QueueVisibilityTimeout - period after which a delivered but not processed background job is delivered again
+	QueueVisibilityTimeout time.Duration `env:"QUEUE_VISIBILITY_TIMEOUT" envDefault:"1m" json:"queue_visibility_timeout"`
+	// QueueMaxAttempts - number of deliveries after which a failing background job is dropped
+	QueueMaxAttempts int `env:"QUEUE_MAX_ATTEMPTS" envDefault:"10" json:"queue_max_attempts"`
+	// QueueRetryBackoff - delay before the first retry of a failed background job, doubled on every next retry
+	QueueRetryBackoff time.Duration `env:"QUEUE_RETRY_BACKOFF" envDefault:"1s" json:"queue_retry_backoff"`
+	// ReadyQueueDepth - number of queued deletions after which the instance is not ready, 0 - the delete queue size
+	ReadyQueueDepth int `env:"READY_QUEUE_DEPTH" json:"ready_queue_depth"`
+	// ReadyCertExpiry - period before the TLS certificate expiration when the instance becomes not ready
+	ReadyCertExpiry time.Duration `env:"READY_CERT_EXPIRY" envDefault:"168h" json:"ready_cert_expiry"`
+	// ShutdownDelay - period between reporting not ready and stopping the server on shutdown
+	ShutdownDelay time.Duration `env:"SHUTDOWN_DELAY" envDefault:"5s" json:"shutdown_delay"`
+	// SnapshotRecords - number of storage file records after which a snapshot is written, 0 - disabled
+	SnapshotRecords int `env:"SNAPSHOT_RECORDS" envDefault:"10000" json:"snapshot_records"`
+	// SnapshotSize - storage file size in bytes after which a snapshot is written, 0 - disabled
+	SnapshotSize int64 `env:"SNAPSHOT_SIZE" envDefault:"67108864" json:"snapshot_size"`
+	// LogLevel - minimal level of written log lines: debug, info, warn, error
+	LogLevel string `env:"LOG_LEVEL" envDefault:"info" json:"log_level"`
+	// TraceExporter - exporter of the trace spans: stdout, file, empty - spans are not exported
+	TraceExporter string `env:"TRACE_EXPORTER" json:"trace_exporter"`
+	// TraceFile - file of the file trace exporter, spans are appended as JSON lines
+	TraceFile string `env:"TRACE_FILE" envDefault:"traces.jsonl" json:"trace_file"`
+	// PrintConfig - print the effective config and exit, set by the flag only
+	PrintConfig bool `json:"-"`
 }
 
 // DBType - database type used to store shortened links
 type DBType string
 
+// IDStrategy - shortened link id generation strategy
+type IDStrategy string
+
 var Cfg Config
 
 const (
@@ -46,60 +126,255 @@ const (
 	DBLinkedList DBType = "DBLinkedList"
 )
 
+const (
+	IDHash    IDStrategy = "hash"
+	IDCounter IDStrategy = "counter"
+	IDRandom  IDStrategy = "random"
+)
+
+// commandFlag - command line flag overriding the config field read from the env variable
+type commandFlag struct {
+	name   string
+	env    string
+	usage  string
+	isBool bool
+}
+
+var commandFlags = []commandFlag{
+	{name: "a", env: "SERVER_ADDRESS", usage: "Server address"},
+	{name: "b", env: "BASE_URL", usage: "Base URL address"},
+	{name: "f", env: "FILE_STORAGE_PATH", usage: "File storage path"},
+	{name: "d", env: "DATABASE_DSN", usage: "Database DSN"},
+	{name: "s", env: "ENABLE_HTTPS", usage: "Enable HTTPs", isBool: true},
+	{name: "c", env: "CONFIG", usage: "Config file, JSON or YAML"},
+	{name: "config", env: "CONFIG", usage: "Config file, JSON or YAML"},
+	{name: "id-strategy", env: "ID_STRATEGY", usage: "Link ID strategy: hash, counter, random"},
+	{name: "id-length", env: "ID_LENGTH", usage: "Link ID length"},
+	{name: "admin-address", env: "ADMIN_ADDRESS", usage: "Admin server address, empty - disabled"},
+	{name: "admin-trusted-subnet", env: "ADMIN_TRUSTED_SUBNET", usage: "Admin clients CIDR"},
+	{name: "log-level", env: "LOG_LEVEL", usage: "Log level: debug, info, warn, error"},
+	{name: "trace-exporter", env: "TRACE_EXPORTER", usage: "Trace exporter: stdout, file, empty - disabled"},
+	{name: "trace-file", env: "TRACE_FILE", usage: "Trace file of the file exporter"},
+}
+
+// InitConfig loads the config of the process, generates the missing secret key and TLS certificate.
+// Nothing is generated if the config is only printed
 func InitConfig() error {
-	if err := env.Parse(&Cfg); err != nil {
+	cfg, err := LoadConfig(os.Args[1:], os.Environ())
+	if err != nil {
 		return err
 	}
-	flag.StringVar(&Cfg.SrvAddr, "a", Cfg.SrvAddr, "Server address")
-	flag.StringVar(&Cfg.BaseURL, "b", Cfg.BaseURL, "Base URL address")
-	flag.StringVar(&Cfg.FileStorage, "f", Cfg.FileStorage, "File storage path")
-	flag.StringVar(&Cfg.DatabaseDNS, "d", Cfg.DatabaseDNS, "Database DNS")
-	flag.BoolVar(&Cfg.EnableHTTPS, "s", Cfg.EnableHTTPS, "Enable HTTPs")
-	flag.StringVar(&Cfg.Config, "c", Cfg.Config, "Database DNS")
-	flag.StringVar(&Cfg.Config, "config", Cfg.Config, "Database DNS")
-	flag.Parse()
-
-	if Cfg.Config != "" {
-		file, err := ioutil.ReadFile(Cfg.Config)
-		if err != nil {
+	Cfg = cfg
+	if Cfg.PrintConfig {
+		return nil
+	}
+
+	if Cfg.SecretKey == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
 			return err
 		}
-		fileConfig := &Config{}
-		if err := json.Unmarshal(file, fileConfig); err != nil {
+		Cfg.SecretKey = hex.EncodeToString(key)
+		// the in-memory storage loses the users on restart anyway
+		logger.Default().Warn("secret key is not configured, user cookies are valid until restart")
+	}
+
+	if Cfg.EnableHTTPS && Cfg.CertFilePath == "" {
+		Cfg.CertFilePath = "cert.pem"
+		Cfg.PrivateKeyFilePath = "privateKey.pem"
+		if err := certificate.GenerateCert(Cfg.CertFilePath, Cfg.PrivateKeyFilePath); err != nil {
 			return err
 		}
-		if Cfg.SrvAddr == "" {
-			Cfg.SrvAddr = fileConfig.SrvAddr
+	}
+
+	return nil
+}
+
+// LoadConfig builds the config from the defaults, the config file, the environment and the arguments
+// in order of increasing priority. The config file is set by the arguments or the environment
+func LoadConfig(args, environ []string) (Config, error) {
+	var cfg Config
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	envNames := make(map[string]string, len(commandFlags))
+	for _, f := range commandFlags {
+		envNames[f.name] = f.env
+		if f.isBool {
+			flags.Bool(f.name, false, f.usage)
+		} else {
+			flags.String(f.name, "", f.usage)
 		}
-		if Cfg.BaseURL == "" {
-			Cfg.BaseURL = fileConfig.BaseURL
+	}
+	flags.BoolVar(&cfg.PrintConfig, "print-config", false, "Print the effective config with redacted secrets and exit")
+	if err := flags.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	environment := make(map[string]string, len(environ))
+	for _, kv := range environ {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			environment[kv[:i]] = kv[i+1:]
 		}
-		if Cfg.FileStorage == "" {
-			Cfg.FileStorage = fileConfig.FileStorage
+	}
+	arguments := make(map[string]string)
+	flags.Visit(func(f *flag.Flag) {
+		if name, ok := envNames[f.Name]; ok {
+			arguments[name] = f.Value.String()
 		}
-		if Cfg.DatabaseDNS == "" {
-			Cfg.DatabaseDNS = fileConfig.DatabaseDNS
+	})
+
+	path, ok := arguments["CONFIG"]
+	if !ok {
+		path = environment["CONFIG"]
+	}
+	layered := make(map[string]string)
+	if path != "" {
+		file, err := readConfigFile(path)
+		if err != nil {
+			return cfg, err
+		}
+		for k, v := range file {
+			layered[k] = v
 		}
-		if !Cfg.EnableHTTPS {
-			Cfg.EnableHTTPS = fileConfig.EnableHTTPS
+	}
+	for k, v := range environment {
+		layered[k] = v
+	}
+	for k, v := range arguments {
+		layered[k] = v
+	}
+
+	if err := env.Parse(&cfg, env.Options{Environment: layered}); err != nil {
+		return cfg, parseError(err)
+	}
+	if cfg.DBType == "" {
+		cfg.DBType = DBMap
+		if cfg.DatabaseDNS != "" {
+			cfg.DBType = DBPostgres
 		}
 	}
+	return cfg, cfg.validate()
+}
 
-	Cfg.Domain = "localhost"
-	Cfg.SecretKey = []byte("very_secret_key")
+var parseErrorPrefix = regexp.MustCompile(`^env: parse error on field "(\w+)" of type "[^"]*": `)
 
-	Cfg.DBType = DBMap
-	if Cfg.DatabaseDNS != "" {
-		Cfg.DBType = DBPostgres
+// parseError names the field of the env parse error by its config file key and env variable
+func parseError(err error) error {
+	m := parseErrorPrefix.FindStringSubmatch(err.Error())
+	if m == nil {
+		return fmt.Errorf("invalid config: %w", err)
 	}
+	field, ok := reflect.TypeOf(Config{}).FieldByName(m[1])
+	if !ok {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	return fmt.Errorf("invalid config: %s (%s): %s",
+		jsonKey(field), field.Tag.Get("env"), strings.TrimPrefix(err.Error(), m[0]))
+}
 
-	if Cfg.EnableHTTPS {
-		Cfg.CertFilePath = "cert.pem"
-		Cfg.PrivateKeyFilePath = "privateKey.pem"
-		if err := certificate.GenerateCert(Cfg.CertFilePath, Cfg.PrivateKeyFilePath); err != nil {
-			return err
+// validate returns the error listing all invalid settings by their config file keys
+func (c *Config) validate() error {
+	problems := make([]string, 0)
+	invalid := func(key, format string, args ...interface{}) {
+		problems = append(problems, key+": "+fmt.Sprintf(format, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.SrvAddr); err != nil {
+		invalid("server_address", "%v", err)
+	}
+	if u, err := url.Parse(c.BaseURL); err != nil {
+		invalid("base_url", "%v", err)
+	} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		invalid("base_url", "must be an absolute http or https URL")
+	}
+	switch c.DBType {
+	case DBMap, DBLinkedList:
+	case DBPostgres:
+		if c.DatabaseDNS == "" {
+			invalid("database_dsn", "is required by %s", DBPostgres)
+		}
+	default:
+		invalid("db_type", "must be one of %s, %s, %s", DBMap, DBPostgres, DBLinkedList)
+	}
+	// users of the persistent storage outlive the process and are shared by the replicas,
+	// so their cookies must be signed by the same key
+	if c.SecretKey == "" && (c.DBType == DBPostgres || c.FileStorage != "") {
+		invalid("secret_key", "is required by the persistent storage")
+	}
+	switch c.IDStrategy {
+	case "", IDHash, IDCounter, IDRandom:
+	default:
+		invalid("id_strategy", "must be one of %s, %s, %s", IDHash, IDCounter, IDRandom)
+	}
+	if c.IDAlphabet != "" {
+		if err := checkIDAlphabet(c.IDAlphabet); err != nil {
+			invalid("id_alphabet", "%v", err)
+		}
+	}
+	if (c.CertFilePath == "") != (c.PrivateKeyFilePath == "") {
+		invalid("tls_cert", "the certificate and the key must be set together")
+	}
+	if c.AdminAddr != "" {
+		if _, _, err := net.SplitHostPort(c.AdminAddr); err != nil {
+			invalid("admin_address", "%v", err)
 		}
 	}
+	if (c.AdminCertFile == "") != (c.AdminKeyFile == "") {
+		invalid("admin_tls_cert", "the certificate and the key must be set together")
+	}
+	if c.AdminUser != "" && c.AdminPassword == "" {
+		invalid("admin_password", "is required by admin_user")
+	}
+	if c.AdminTrustedSubnet != "" {
+		if _, _, err := net.ParseCIDR(c.AdminTrustedSubnet); err != nil {
+			invalid("admin_trusted_subnet", "%v", err)
+		}
+	}
+	if _, err := logger.ParseLevel(c.LogLevel); err != nil {
+		invalid("log_level", "%v", err)
+	}
+	switch c.TraceExporter {
+	case tracing.ExporterNone, tracing.ExporterStdout:
+	case tracing.ExporterFile:
+		if c.TraceFile == "" {
+			invalid("trace_file", "is required by the %s exporter", tracing.ExporterFile)
+		}
+	default:
+		invalid("trace_exporter", "must be %s, %s or empty", tracing.ExporterStdout, tracing.ExporterFile)
+	}
 
+	// counts, sizes and periods
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		switch v.Field(i).Kind() {
+		case reflect.Int, reflect.Int64:
+			if v.Field(i).Int() < 0 {
+				invalid(jsonKey(v.Type().Field(i)), "must not be negative")
+			}
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New("invalid config: " + strings.Join(problems, "; "))
+}
+
+// checkIDAlphabet checks that the alphabet has at least 2 unique URL unreserved ASCII characters,
+// so ids are valid path segments and the counter encoding terminates
+func checkIDAlphabet(alphabet string) error {
+	seen := make(map[rune]bool, len(alphabet))
+	for _, r := range alphabet {
+		isAlnum := (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+		if !isAlnum && !strings.ContainsRune("-._~", r) {
+			return fmt.Errorf("character %q is not URL-safe ASCII", r)
+		}
+		if seen[r] {
+			return fmt.Errorf("character %q is repeated", r)
+		}
+		seen[r] = true
+	}
+	if len(seen) < 2 {
+		return errors.New("must have at least 2 characters")
+	}
 	return nil
 }
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0666))
+	return path
+}
+
+func TestLoadConfig_Precedence(t *testing.T) {
+	jsonFile := writeFile(t, "config.json", `{
+		"server_address": "0.0.0.0:9090",
+		"base_url": "https://file.example",
+		"expire_interval": "30s",
+		"delete_workers": 8,
+		"enable_https": true,
+		"domain": "file.example"
+	}`)
+	yamlFile := writeFile(t, "config.yml", `
+server_address: "0.0.0.0:9090"
+base_url: https://file.example
+expire_interval: 30s
+delete_workers: 8
+enable_https: true
+domain: file.example
+`)
+
+	for _, path := range []string{jsonFile, yamlFile} {
+		t.Run(filepath.Ext(path), func(t *testing.T) {
+			cfg, err := LoadConfig([]string{"-c", path}, nil)
+			require.NoError(t, err)
+			// file values replace the defaults
+			assert.Equal(t, "0.0.0.0:9090", cfg.SrvAddr)
+			assert.Equal(t, "https://file.example", cfg.BaseURL)
+			assert.Equal(t, 30*time.Second, cfg.ExpireInterval)
+			assert.Equal(t, 8, cfg.DeleteWorkers)
+			assert.True(t, cfg.EnableHTTPS)
+			assert.Equal(t, "file.example", cfg.Domain)
+			// defaults of the missing keys
+			assert.Equal(t, time.Hour, cfg.PurgeInterval)
+			assert.Equal(t, DBMap, cfg.DBType)
+
+			cfg, err = LoadConfig([]string{"-a", "127.0.0.1:7070", "-s=false"},
+				[]string{"CONFIG=" + path, "SERVER_ADDRESS=127.0.0.1:6060", "BASE_URL=http://env.example"})
+			require.NoError(t, err)
+			// environment replaces the file, flags replace the environment
+			assert.Equal(t, "127.0.0.1:7070", cfg.SrvAddr)
+			assert.Equal(t, "http://env.example", cfg.BaseURL)
+			assert.False(t, cfg.EnableHTTPS)
+			assert.Equal(t, 30*time.Second, cfg.ExpireInterval)
+		})
+	}
+}
+
+func TestLoadConfig_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		args    []string
+		environ []string
+		want    string
+	}{
+		{name: "unknown file key", file: `{"server_adress": "0.0.0.0:9090"}`,
+			want: `unknown key "server_adress"`},
+		{name: "nested value", file: `{"server_address": {"host": "x"}}`,
+			want: "server_address: unsupported value"},
+		{name: "invalid duration", environ: []string{"EXPIRE_INTERVAL=soon"},
+			want: `invalid config: expire_interval (EXPIRE_INTERVAL): unable to parse duration: time: invalid duration "soon"`},
+		{name: "all problems listed", args: []string{"-a", "nope", "-b", "ftp://x", "-log-level", "loud"},
+			environ: []string{"ID_LENGTH=-1"},
+			want: `invalid config: server_address: address nope: missing port in address; ` +
+				`base_url: must be an absolute http or https URL; log_level: unknown log level "loud"; ` +
+				`id_length: must not be negative`},
+		{name: "postgres without secret key", environ: []string{"DATABASE_DSN=postgres://db/app"},
+			want: "secret_key: is required by the persistent storage"},
+		{name: "file storage without secret key", args: []string{"-f", "urls.log"},
+			want: "secret_key: is required by the persistent storage"},
+		{name: "postgres without dsn", environ: []string{"DB_TYPE=DBPostgres"},
+			want: "database_dsn: is required by DBPostgres"},
+		{name: "admin user without password", environ: []string{"ADMIN_USER=ops"},
+			want: "admin_password: is required by admin_user"},
+		{name: "single character alphabet", environ: []string{"ID_ALPHABET=a"},
+			want: "id_alphabet: must have at least 2 characters"},
+		{name: "multibyte alphabet", environ: []string{"ID_ALPHABET=abcé"},
+			want: `id_alphabet: character 'é' is not URL-safe ASCII`},
+		{name: "unsafe alphabet", environ: []string{"ID_ALPHABET=ab/?"},
+			want: `id_alphabet: character '/' is not URL-safe ASCII`},
+		{name: "repeated alphabet", environ: []string{"ID_ALPHABET=abca"},
+			want: `id_alphabet: character 'a' is repeated`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeFile(t, "config.json", tt.file)}, args...)
+			}
+			_, err := LoadConfig(args, tt.environ)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.want)
+		})
+	}
+}
+
+func TestWriteConfig(t *testing.T) {
+	cfg, err := LoadConfig([]string{"--print-config"}, []string{
+		"DATABASE_DSN=postgres://app:pw@db:5432/app",
+		"ADMIN_USER=ops",
+		"ADMIN_PASSWORD=hunter2",
+		"SECRET_KEY=signing",
+	})
+	require.NoError(t, err)
+	assert.True(t, cfg.PrintConfig)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, WriteConfig(buf, cfg))
+	assert.NotContains(t, buf.String(), "hunter2")
+	assert.NotContains(t, buf.String(), "signing")
+	assert.NotContains(t, buf.String(), ":pw@")
+
+	var printed map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &printed))
+	assert.Equal(t, "postgres://app:xxxxx@db:5432/app", printed["database_dsn"])
+	assert.Equal(t, "xxxxx", printed["admin_password"])
+	assert.Equal(t, "ops", printed["admin_user"])
+	assert.Equal(t, "1m0s", printed["expire_interval"])
+	assert.Equal(t, "DBPostgres", printed["db_type"])
+
+	assert.Equal(t, "host=db password=xxxxx user=app", redactDSN("host=db password=secret user=app"))
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// redacted - printed value of a secret
+const redacted = "xxxxx"
+
+// jsonKey returns the config file key of the field
+func jsonKey(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("json"), ",")[0]
+}
+
+// fileKeys returns env variable names of the config fields by their config file keys
+func fileKeys() map[string]string {
+	keys := make(map[string]string)
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if key, name := jsonKey(field), field.Tag.Get("env"); key != "" && key != "-" && name != "" {
+			keys[key] = name
+		}
+	}
+	return keys
+}
+
+// readConfigFile reads the YAML or JSON config file and returns its values by env variable names,
+// so they are parsed the same way as the environment
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config file: %w", err)
+	}
+
+	values := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&values)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	keys := fileKeys()
+	vars := make(map[string]string, len(values))
+	for key, value := range values {
+		name, ok := keys[key]
+		if !ok {
+			return nil, fmt.Errorf("config file %s: unknown key %q", path, key)
+		}
+		switch v := value.(type) {
+		case nil:
+			continue
+		case string:
+			vars[name] = v
+		case bool:
+			vars[name] = strconv.FormatBool(v)
+		case json.Number:
+			vars[name] = v.String()
+		case int:
+			vars[name] = strconv.Itoa(v)
+		case float64:
+			vars[name] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return nil, fmt.Errorf("config file %s: %s: unsupported value %v", path, key, value)
+		}
+	}
+	return vars, nil
+}
+
+// WriteConfig writes the config as JSON by the config file keys, secrets are redacted
+func WriteConfig(w io.Writer, cfg Config) error {
+	values := make(map[string]interface{})
+	v := reflect.ValueOf(cfg)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		key := jsonKey(field)
+		if key == "" || key == "-" {
+			continue
+		}
+		var value interface{}
+		switch fv := v.Field(i).Interface().(type) {
+		case time.Duration:
+			value = fv.String()
+		case DBType:
+			value = string(fv)
+		case IDStrategy:
+			value = string(fv)
+		default:
+			value = fv
+		}
+		switch field.Tag.Get("secret") {
+		case "true":
+			if value != "" {
+				value = redacted
+			}
+		case "dsn":
+			value = redactDSN(value.(string))
+		}
+		values[key] = value
+	}
+
+	data, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+var dsnPassword = regexp.MustCompile(`(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+
+// redactDSN hides the password of the URL or the key-value connection string
+func redactDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+		return u.Redacted()
+	}
+	return dsnPassword.ReplaceAllString(dsn, "${1}"+redacted)
+}
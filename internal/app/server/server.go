@@ -2,14 +2,16 @@ package server
 
 import (
 	"context"
-	"log"
 	"net/http"
 	"time"
+
+	"github.com/romm80/shortener.git/internal/app/logger"
 )
 
 // Server - http server
 type Server struct {
-	httpServer *http.Server
+	httpServer  *http.Server
+	adminServer *http.Server
 }
 
 func NewServer() (*Server, error) {
@@ -17,6 +19,9 @@ func NewServer() (*Server, error) {
 		return nil, err
 	}
 	srv := new(Server)
+	if Cfg.AdminAddr != "" {
+		srv.adminServer = &http.Server{Addr: Cfg.AdminAddr}
+	}
 	return srv, nil
 }
 
@@ -34,12 +39,33 @@ func (s *Server) Run(handler http.Handler) error {
 	return s.httpServer.ListenAndServe()
 }
 
+// RunAdmin starts admin http server, it is not started without the admin address
+func (s *Server) RunAdmin(handler http.Handler) error {
+	if s.adminServer == nil {
+		return nil
+	}
+	s.adminServer.Handler = handler
+
+	if Cfg.AdminCertFile != "" {
+		return s.adminServer.ListenAndServeTLS(Cfg.AdminCertFile, Cfg.AdminKeyFile)
+	}
+
+	return s.adminServer.ListenAndServe()
+}
+
+// Stop stops the http server, the admin server is stopped after it to keep probes and metrics available
 func (s *Server) Stop() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	if err := s.httpServer.Shutdown(ctx); err != nil {
-		log.Fatalf("Server shutdown failed:%+v", err)
+		logger.Default().Fatal("server shutdown failed", "error", err)
+	}
+	logger.Default().Info("server stopped")
+
+	if s.adminServer != nil {
+		if err := s.adminServer.Shutdown(ctx); err != nil {
+			logger.Default().Fatal("admin server shutdown failed", "error", err)
+		}
 	}
-	log.Println("Server shutdowned")
 }
@@ -0,0 +1,48 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/romm80/shortener.git/internal/app"
+)
+
+// MaxAliasLength - maximum length of the custom link id
+const MaxAliasLength = 64
+
+// ReservedAliases returns the static first segments of the route paths, which aliases must not shadow
+func ReservedAliases(paths []string) map[string]struct{} {
+	reserved := make(map[string]struct{}, len(paths))
+	for _, path := range paths {
+		segment := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+		if segment == "" || strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			continue
+		}
+		reserved[strings.ToLower(segment)] = struct{}{}
+	}
+	return reserved
+}
+
+// ValidAlias checks the custom link id: latin letters, digits, '-' and '_' are allowed,
+// reserved route names are forbidden
+func ValidAlias(alias string, reserved map[string]struct{}) error {
+	if alias == "" || len(alias) > MaxAliasLength {
+		return fmt.Errorf("%w: length must be from 1 to %d", app.ErrInvalidAlias, MaxAliasLength)
+	}
+	for _, r := range alias {
+		if !isAliasChar(r) {
+			return fmt.Errorf("%w: forbidden character %q", app.ErrInvalidAlias, r)
+		}
+	}
+	if _, ok := reserved[strings.ToLower(alias)]; ok {
+		return fmt.Errorf("%w: %s is reserved", app.ErrInvalidAlias, alias)
+	}
+	return nil
+}
+
+func isAliasChar(r rune) bool {
+	return r >= 'a' && r <= 'z' ||
+		r >= 'A' && r <= 'Z' ||
+		r >= '0' && r <= '9' ||
+		r == '-' || r == '_'
+}
@@ -0,0 +1,36 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/romm80/shortener.git/internal/app"
+)
+
+// ExpiresAt returns the link expiration time set by the absolute time or by the ttl duration (e.g. "72h"),
+// nil if the link never expires
+func ExpiresAt(expiresAt *time.Time, ttl string) (*time.Time, error) {
+	if expiresAt != nil && ttl != "" {
+		return nil, fmt.Errorf("%w: expires_at and ttl are mutually exclusive", app.ErrInvalidExpiration)
+	}
+	if ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", app.ErrInvalidExpiration, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("%w: ttl must be positive", app.ErrInvalidExpiration)
+		}
+		t := time.Now().Add(d)
+		return &t, nil
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return nil, fmt.Errorf("%w: expires_at is in the past", app.ErrInvalidExpiration)
+	}
+	return expiresAt, nil
+}
+
+// Expired checks if the link expiration time has passed
+func Expired(expiresAt *time.Time) bool {
+	return expiresAt != nil && !expiresAt.After(time.Now())
+}
@@ -0,0 +1,59 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/romm80/shortener.git/internal/app"
+)
+
+func TestExpiresAt(t *testing.T) {
+	future := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name      string
+		expiresAt *time.Time
+		ttl       string
+		want      time.Duration // expected lifetime, 0 - the link never expires
+		wantErr   string
+	}{
+		{name: "never expires"},
+		{name: "ttl", ttl: "72h", want: 72 * time.Hour},
+		{name: "expires at", expiresAt: &future, want: time.Hour},
+		{name: "both", expiresAt: &future, ttl: "1h", wantErr: "expires_at and ttl are mutually exclusive"},
+		{name: "malformed ttl", ttl: "soon", wantErr: `time: invalid duration "soon"`},
+		{name: "zero ttl", ttl: "0s", wantErr: "ttl must be positive"},
+		{name: "negative ttl", ttl: "-1h", wantErr: "ttl must be positive"},
+		{name: "past expires at", expiresAt: &past, wantErr: "expires_at is in the past"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExpiresAt(tt.expiresAt, tt.ttl)
+			if tt.wantErr != "" {
+				assert.ErrorIs(t, err, app.ErrInvalidExpiration)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			if tt.want == 0 {
+				assert.Nil(t, got)
+				return
+			}
+			require.NotNil(t, got)
+			assert.WithinDuration(t, time.Now().Add(tt.want), *got, time.Second)
+		})
+	}
+}
+
+func TestExpired(t *testing.T) {
+	future := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Hour)
+
+	assert.False(t, Expired(nil))
+	assert.False(t, Expired(&future))
+	assert.True(t, Expired(&past))
+}
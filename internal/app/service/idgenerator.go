@@ -0,0 +1,152 @@
+package service
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/romm80/shortener.git/internal/app/server"
+)
+
+// MaxIDAttempts - maximum number of attempts to generate a free link id
+const MaxIDAttempts = 32
+
+const (
+	// Base62Alphabet - default alphabet of the counter and random generators
+	Base62Alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+	defaultHashLength   = 4
+	defaultRandomLength = 8
+)
+
+// ErrIDAttemptsExceeded returned when no free link id is found in MaxIDAttempts attempts
+var ErrIDAttemptsExceeded = errors.New("link id generation attempts exceeded")
+
+// IDGenerator generates shortened link ids.
+// attempt is the number of collisions that have already occurred for the url,
+// on each attempt the generator must return a new candidate id
+type IDGenerator interface {
+	Generate(url string, attempt int) (string, error)
+}
+
+// NewIDGenerator returns the generator selected in the config
+func NewIDGenerator() (IDGenerator, error) {
+	length := server.Cfg.IDLength
+	alphabet := server.Cfg.IDAlphabet
+	if alphabet == "" {
+		alphabet = Base62Alphabet
+	}
+
+	switch server.Cfg.IDStrategy {
+	case "", server.IDHash:
+		if length == 0 {
+			length = defaultHashLength
+		}
+		return NewHashGenerator(length), nil
+	case server.IDCounter:
+		return NewCounterGenerator(alphabet), nil
+	case server.IDRandom:
+		if length == 0 {
+			length = defaultRandomLength
+		}
+		return NewRandomGenerator(length, alphabet), nil
+	default:
+		return nil, errors.New("wrong id strategy")
+	}
+}
+
+// HashGenerator generates ids from the md5 checksum of the link,
+// the id is extended by one character on each collision
+type HashGenerator struct {
+	length int
+}
+
+// NewHashGenerator returns the md5 generator with the initial id length
+func NewHashGenerator(length int) *HashGenerator {
+	return &HashGenerator{length: length}
+}
+
+// Generate returns the md5 prefix of the link, longer prefix for the next attempts
+func (g *HashGenerator) Generate(url string, attempt int) (string, error) {
+	n := g.length + attempt
+	sum := md5.Sum([]byte(url))
+	id := hex.EncodeToString(sum[:])
+	if n <= len(id) {
+		return id[:n], nil
+	}
+
+	// the whole checksum is taken, so the link is salted with the attempt number
+	sum = md5.Sum([]byte(url + strconv.Itoa(attempt)))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// CounterGenerator generates sequential ids encoded in the alphabet
+type CounterGenerator struct {
+	counter  uint64
+	alphabet string
+}
+
+// NewCounterGenerator returns the counter generator
+func NewCounterGenerator(alphabet string) *CounterGenerator {
+	return &CounterGenerator{alphabet: alphabet}
+}
+
+// Generate returns the next counter value.
+// On collision the counter skips 2^attempt values forward, so already used ranges
+// (e.g. restored from a file or written by another instance) are passed in a few attempts
+func (g *CounterGenerator) Generate(_ string, attempt int) (string, error) {
+	step := uint64(1)
+	if attempt > 0 {
+		step <<= uint(attempt)
+	}
+	return encode(atomic.AddUint64(&g.counter, step), g.alphabet), nil
+}
+
+// RandomGenerator generates cryptographically random ids
+type RandomGenerator struct {
+	length   int
+	alphabet string
+}
+
+// NewRandomGenerator returns the random generator with the id length and alphabet
+func NewRandomGenerator(length int, alphabet string) *RandomGenerator {
+	return &RandomGenerator{
+		length:   length,
+		alphabet: alphabet,
+	}
+}
+
+// Generate returns a random id, every fourth collision the id is extended by one character
+func (g *RandomGenerator) Generate(_ string, attempt int) (string, error) {
+	n := g.length + attempt/4
+	max := big.NewInt(int64(len(g.alphabet)))
+	id := make([]byte, n)
+	for i := range id {
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		id[i] = g.alphabet[idx.Int64()]
+	}
+	return string(id), nil
+}
+
+func encode(n uint64, alphabet string) string {
+	base := uint64(len(alphabet))
+	if n == 0 {
+		return alphabet[:1]
+	}
+	id := make([]byte, 0, 11)
+	for n > 0 {
+		id = append(id, alphabet[n%base])
+		n /= base
+	}
+	for i, j := 0, len(id)-1; i < j; i, j = i+1, j-1 {
+		id[i], id[j] = id[j], id[i]
+	}
+	return string(id)
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashGenerator_Generate(t *testing.T) {
+	g := NewHashGenerator(4)
+	url := "https://www.google.com/"
+
+	first, err := g.Generate(url, 0)
+	require.NoError(t, err)
+	assert.Equal(t, ShortenURLID(url), first)
+
+	second, err := g.Generate(url, 1)
+	require.NoError(t, err)
+	assert.Len(t, second, 5)
+	assert.True(t, strings.HasPrefix(second, first))
+
+	salted, err := g.Generate(url, 40)
+	require.NoError(t, err)
+	assert.Len(t, salted, 32)
+}
+
+func TestCounterGenerator_Generate(t *testing.T) {
+	g := NewCounterGenerator(Base62Alphabet)
+
+	tests := []struct {
+		name    string
+		attempt int
+		want    string
+	}{
+		{name: "first id", attempt: 0, want: "1"},
+		{name: "second id", attempt: 0, want: "2"},
+		{name: "collision skips forward", attempt: 3, want: "a"},
+		{name: "two-character id", attempt: 6, want: "1c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := g.Generate("", tt.attempt)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, id)
+		})
+	}
+}
+
+func TestRandomGenerator_Generate(t *testing.T) {
+	g := NewRandomGenerator(6, "ab")
+
+	id, err := g.Generate("", 0)
+	require.NoError(t, err)
+	assert.Len(t, id, 6)
+	assert.Empty(t, strings.Trim(id, "ab"))
+
+	id, err = g.Generate("", 8)
+	require.NoError(t, err)
+	assert.Len(t, id, 8)
+}
@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry_Write(t *testing.T) {
+	registry := NewRegistry()
+	requests := registry.NewCounter("requests_total", "Number of requests.", "route", "status")
+	latency := registry.NewHistogram("latency_seconds", "Request latency.", []float64{0.1, 1}, "route")
+	registry.NewGaugeFunc("queue_length", "Queue length.", nil, func() []Sample {
+		return []Sample{{Value: 3}}
+	})
+
+	requests.Inc("/:id", "307")
+	requests.Add(2, "/", "201")
+	requests.Inc(`/"quoted"`, "200")
+	latency.Observe(0.05, "/")
+	latency.Observe(0.5, "/")
+	latency.Observe(5, "/")
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, registry.Write(buf))
+	assert.Equal(t, `# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{route="/",status="201"} 2
+requests_total{route="/\"quoted\"",status="200"} 1
+requests_total{route="/:id",status="307"} 1
+# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/",le="0.1"} 1
+latency_seconds_bucket{route="/",le="1"} 2
+latency_seconds_bucket{route="/",le="+Inf"} 3
+latency_seconds_sum{route="/"} 5.55
+latency_seconds_count{route="/"} 3
+# HELP queue_length Queue length.
+# TYPE queue_length gauge
+queue_length 3
+`, buf.String())
+
+	assert.Panics(t, func() {
+		registry.NewCounter("requests_total", "Duplicate.")
+	})
+}
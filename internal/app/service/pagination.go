@@ -0,0 +1,176 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/romm80/shortener.git/internal/app"
+	"github.com/romm80/shortener.git/internal/app/models"
+)
+
+// MaxPageLimit - maximum number of links on a page
+const MaxPageLimit = 1000
+
+const (
+	SortCreated = "created"
+	SortURL     = "url"
+)
+
+// URLRecord stored link fields used for sorting and filtering
+type URLRecord struct {
+	ID          string
+	OriginalURL string
+	CreatedAt   time.Time
+}
+
+// ParseURLsQuery validates the user links query parameters
+func ParseURLsQuery(limit, cursor, sortField, order, domain, search string) (models.URLsQuery, error) {
+	query := models.URLsQuery{
+		Cursor: cursor,
+		Sort:   sortField,
+		Domain: strings.ToLower(domain),
+		Search: search,
+	}
+
+	if limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > MaxPageLimit {
+			return query, fmt.Errorf("%w: limit must be from 1 to %d", app.ErrInvalidQuery, MaxPageLimit)
+		}
+		query.Limit = n
+	}
+
+	switch sortField {
+	case "":
+		query.Sort = SortCreated
+	case SortCreated, SortURL:
+	default:
+		return query, fmt.Errorf("%w: unknown sort %s", app.ErrInvalidQuery, sortField)
+	}
+
+	switch order {
+	case "", "asc":
+	case "desc":
+		query.Desc = true
+	default:
+		return query, fmt.Errorf("%w: unknown order %s", app.ErrInvalidQuery, order)
+	}
+
+	if cursor != "" {
+		if _, err := DecodeCursor(cursor); err != nil {
+			return query, err
+		}
+	}
+	return query, nil
+}
+
+// EncodeCursor returns an opaque page position
+func EncodeCursor(cursor models.Cursor) string {
+	b, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeCursor parses the page position
+func DecodeCursor(src string) (models.Cursor, error) {
+	cursor := models.Cursor{}
+	b, err := base64.RawURLEncoding.DecodeString(src)
+	if err != nil {
+		return cursor, fmt.Errorf("%w: malformed cursor", app.ErrInvalidQuery)
+	}
+	if err := json.Unmarshal(b, &cursor); err != nil {
+		return cursor, fmt.Errorf("%w: malformed cursor", app.ErrInvalidQuery)
+	}
+	return cursor, nil
+}
+
+// NextCursor returns the position after the record in the sort order
+func NextCursor(record URLRecord, sortField string) string {
+	cursor := models.Cursor{ID: record.ID}
+	if sortField == SortURL {
+		cursor.URL = record.OriginalURL
+	} else {
+		cursor.CreatedAt = record.CreatedAt
+	}
+	return EncodeCursor(cursor)
+}
+
+// URLDomain returns the lowercase host of the link
+func URLDomain(originURL string) string {
+	u, err := url.Parse(originURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// MatchURLsQuery checks the link against the query filters
+func MatchURLsQuery(originURL string, query models.URLsQuery) bool {
+	if query.Domain != "" {
+		domain := URLDomain(originURL)
+		if domain != query.Domain && !strings.HasSuffix(domain, "."+query.Domain) {
+			return false
+		}
+	}
+	if query.Search != "" && !strings.Contains(strings.ToLower(originURL), strings.ToLower(query.Search)) {
+		return false
+	}
+	return true
+}
+
+// PageUserURLs filters, sorts and paginates the records of the in-memory storages
+func PageUserURLs(records []URLRecord, query models.URLsQuery) (models.UserURLsPage, error) {
+	page := models.UserURLsPage{URLs: make([]models.UserURLs, 0)}
+
+	less := func(a, b URLRecord) bool {
+		if query.Sort == SortURL && a.OriginalURL != b.OriginalURL {
+			return a.OriginalURL < b.OriginalURL
+		}
+		if query.Sort != SortURL && !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return a.ID < b.ID
+	}
+	before := less
+	if query.Desc {
+		before = func(a, b URLRecord) bool { return less(b, a) }
+	}
+
+	var after *URLRecord
+	if query.Cursor != "" {
+		cursor, err := DecodeCursor(query.Cursor)
+		if err != nil {
+			return page, err
+		}
+		after = &URLRecord{ID: cursor.ID, OriginalURL: cursor.URL, CreatedAt: cursor.CreatedAt}
+	}
+
+	filtered := make([]URLRecord, 0, len(records))
+	for _, record := range records {
+		if !MatchURLsQuery(record.OriginalURL, query) {
+			continue
+		}
+		if after != nil && !before(*after, record) {
+			continue
+		}
+		filtered = append(filtered, record)
+	}
+	sort.Slice(filtered, func(i, j int) bool { return before(filtered[i], filtered[j]) })
+
+	if query.Limit > 0 && len(filtered) > query.Limit {
+		filtered = filtered[:query.Limit]
+		page.NextCursor = NextCursor(filtered[len(filtered)-1], query.Sort)
+	}
+	for _, record := range filtered {
+		page.URLs = append(page.URLs, models.UserURLs{
+			ShortURL:    BaseURL(record.ID),
+			OriginalURL: record.OriginalURL,
+		})
+	}
+	return page, nil
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/romm80/shortener.git/internal/app/models"
+)
+
+func TestPageUserURLs(t *testing.T) {
+	created := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	records := []URLRecord{
+		{ID: "c", OriginalURL: "https://yandex.ru/maps", CreatedAt: created.Add(2 * time.Minute)},
+		{ID: "a", OriginalURL: "https://www.google.com/", CreatedAt: created},
+		{ID: "b", OriginalURL: "https://go.dev/doc", CreatedAt: created.Add(time.Minute)},
+		{ID: "d", OriginalURL: "https://mail.yandex.ru/", CreatedAt: created.Add(3 * time.Minute)},
+	}
+	originURLs := func(page models.UserURLsPage) []string {
+		res := make([]string, 0, len(page.URLs))
+		for _, u := range page.URLs {
+			res = append(res, u.OriginalURL)
+		}
+		return res
+	}
+
+	tests := []struct {
+		name  string
+		query models.URLsQuery
+		want  []string
+	}{
+		{
+			name:  "sort by creation time",
+			query: models.URLsQuery{Sort: SortCreated},
+			want:  []string{"https://www.google.com/", "https://go.dev/doc", "https://yandex.ru/maps", "https://mail.yandex.ru/"},
+		},
+		{
+			name:  "sort by url descending",
+			query: models.URLsQuery{Sort: SortURL, Desc: true},
+			want:  []string{"https://yandex.ru/maps", "https://www.google.com/", "https://mail.yandex.ru/", "https://go.dev/doc"},
+		},
+		{
+			name:  "filter by domain with subdomains",
+			query: models.URLsQuery{Sort: SortCreated, Domain: "yandex.ru"},
+			want:  []string{"https://yandex.ru/maps", "https://mail.yandex.ru/"},
+		},
+		{
+			name:  "filter by substring",
+			query: models.URLsQuery{Sort: SortCreated, Search: "DOC"},
+			want:  []string{"https://go.dev/doc"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := PageUserURLs(records, tt.query)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, originURLs(page))
+			assert.Empty(t, page.NextCursor)
+		})
+	}
+
+	t.Run("pages by cursor", func(t *testing.T) {
+		query := models.URLsQuery{Sort: SortCreated, Limit: 3}
+		page, err := PageUserURLs(records, query)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"https://www.google.com/", "https://go.dev/doc", "https://yandex.ru/maps"}, originURLs(page))
+		require.NotEmpty(t, page.NextCursor)
+
+		query.Cursor = page.NextCursor
+		page, err = PageUserURLs(records, query)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"https://mail.yandex.ru/"}, originURLs(page))
+		assert.Empty(t, page.NextCursor)
+	})
+}
+
+func TestParseURLsQuery(t *testing.T) {
+	_, err := ParseURLsQuery("0", "", "", "", "", "")
+	assert.Error(t, err)
+	_, err = ParseURLsQuery("", "", "name", "", "", "")
+	assert.Error(t, err)
+	_, err = ParseURLsQuery("", "not a cursor", "", "", "", "")
+	assert.Error(t, err)
+
+	query, err := ParseURLsQuery("10", "", "", "desc", "Yandex.RU", "")
+	require.NoError(t, err)
+	assert.Equal(t, models.URLsQuery{Limit: 10, Sort: SortCreated, Desc: true, Domain: "yandex.ru"}, query)
+}
@@ -0,0 +1,139 @@
+// Package scheduler runs named periodic jobs.
+// With a storage shared by several instances every job runs on the single instance holding its lock
+package scheduler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/romm80/shortener.git/internal/app/logger"
+	"github.com/romm80/shortener.git/internal/app/repositories"
+	"github.com/romm80/shortener.git/internal/app/service/tracing"
+)
+
+// unlockTimeout - period to release the locks on stop
+const unlockTimeout = 5 * time.Second
+
+// Job periodic job
+type Job func(ctx context.Context) error
+
+type job struct {
+	name     string
+	interval time.Duration
+	run      Job
+}
+
+// Scheduler periodic jobs runner
+type Scheduler struct {
+	locker repositories.Locker // nil - jobs run on every instance
+	mu     *sync.Mutex
+	jobs   []job
+	wg     *sync.WaitGroup
+}
+
+// New returns the scheduler electing the running instance by the storage locks,
+// jobs of a storage without locks run locally
+func New(storage repositories.Shortener) *Scheduler {
+	locker, _ := repositories.Unwrap(storage).(repositories.Locker)
+	return &Scheduler{
+		locker: locker,
+		mu:     &sync.Mutex{},
+		wg:     &sync.WaitGroup{},
+	}
+}
+
+// Register adds the job, zero interval disables it. Jobs are registered before Run
+func (s *Scheduler) Register(name string, interval time.Duration, run Job) {
+	if interval <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jobs = append(s.jobs, job{name: name, interval: interval, run: run})
+}
+
+// Run starts the jobs until the context is cancelled, the locks are released on stop
+func (s *Scheduler) Run(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, j := range s.jobs {
+		s.wg.Add(1)
+		go func(j job) {
+			defer s.wg.Done()
+			s.schedule(ctx, j)
+		}(j)
+	}
+}
+
+// Wait waits until the stopped jobs finish and release their locks
+func (s *Scheduler) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Scheduler) schedule(ctx context.Context, j job) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	l := logger.Default().With("job", j.name)
+	leader := false
+	for {
+		select {
+		case <-ctx.Done():
+			if leader {
+				s.unlock(j.name)
+			}
+			return
+		case <-ticker.C:
+			isLeader, err := s.lock(ctx, j.name)
+			if err != nil {
+				l.Error("scheduler lock failed", "error", err)
+			}
+			if isLeader != leader {
+				l.Info("scheduler leadership changed", "leader", isLeader)
+				leader = isLeader
+			}
+			if !leader {
+				continue
+			}
+			jobCtx, span := tracing.Start(logger.WithContext(ctx, l), "scheduler."+j.name)
+			err = j.run(jobCtx)
+			span.SetError(err)
+			span.End()
+			if err != nil {
+				l.Error("scheduled job failed", "error", err)
+			}
+		}
+	}
+}
+
+// lock reports whether the instance holds the job lock
+func (s *Scheduler) lock(ctx context.Context, name string) (bool, error) {
+	if s.locker == nil {
+		return true, nil
+	}
+	return s.locker.TryLock(ctx, name)
+}
+
+func (s *Scheduler) unlock(name string) {
+	if s.locker == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), unlockTimeout)
+	defer cancel()
+	if err := s.locker.Unlock(ctx, name); err != nil {
+		logger.Default().Error("scheduler unlock failed", "job", name, "error", err)
+	}
+}
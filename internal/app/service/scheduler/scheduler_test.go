@@ -0,0 +1,115 @@
+package scheduler
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/romm80/shortener.git/internal/app/repositories/mapstorage"
+	"github.com/romm80/shortener.git/internal/app/server"
+)
+
+// sharedLocks locks of the storage shared by the instances
+type sharedLocks struct {
+	mu      *sync.Mutex
+	holders map[string]*instanceLocker
+}
+
+// instanceLocker storage connection of the instance
+type instanceLocker struct {
+	*mapstorage.MapStorage
+	locks *sharedLocks
+}
+
+func (l *instanceLocker) TryLock(ctx context.Context, name string) (bool, error) {
+	l.locks.mu.Lock()
+	defer l.locks.mu.Unlock()
+
+	holder, ok := l.locks.holders[name]
+	if !ok {
+		l.locks.holders[name] = l
+		return true, nil
+	}
+	return holder == l, nil
+}
+
+func (l *instanceLocker) Unlock(ctx context.Context, name string) error {
+	l.locks.mu.Lock()
+	defer l.locks.mu.Unlock()
+
+	if l.locks.holders[name] == l {
+		delete(l.locks.holders, name)
+	}
+	return nil
+}
+
+func TestScheduler_Leader(t *testing.T) {
+	server.Cfg.FileStorage = ""
+	storage, err := mapstorage.New()
+	require.NoError(t, err)
+	locks := &sharedLocks{mu: &sync.Mutex{}, holders: make(map[string]*instanceLocker)}
+
+	var runs [2]int32
+	var stops [2]context.CancelFunc
+	var schedulers [2]*Scheduler
+	for i := range schedulers {
+		i := i
+		schedulers[i] = New(&instanceLocker{MapStorage: storage, locks: locks})
+		schedulers[i].Register("job", 5*time.Millisecond, func(ctx context.Context) error {
+			atomic.AddInt32(&runs[i], 1)
+			return nil
+		})
+		schedulers[i].Register("disabled", 0, func(ctx context.Context) error {
+			t.Error("disabled job runs")
+			return nil
+		})
+		var ctx context.Context
+		ctx, stops[i] = context.WithCancel(context.Background())
+		schedulers[i].Run(ctx)
+	}
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&runs[0])+atomic.LoadInt32(&runs[1]) >= 3
+	}, time.Second, time.Millisecond)
+	leader, follower := 0, 1
+	if atomic.LoadInt32(&runs[1]) > 0 {
+		leader, follower = 1, 0
+	}
+	assert.Zero(t, atomic.LoadInt32(&runs[follower]))
+
+	// the lock is released on stop and taken over by the other instance
+	stops[leader]()
+	require.NoError(t, schedulers[leader].Wait(context.Background()))
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&runs[follower]) > 0
+	}, time.Second, time.Millisecond)
+
+	stops[follower]()
+	require.NoError(t, schedulers[follower].Wait(context.Background()))
+	assert.Empty(t, locks.holders)
+}
+
+func TestScheduler_Local(t *testing.T) {
+	server.Cfg.FileStorage = ""
+	storage, err := mapstorage.New()
+	require.NoError(t, err)
+
+	var runs int32
+	s := New(storage)
+	s.Register("job", time.Millisecond, func(ctx context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Run(ctx)
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&runs) >= 2
+	}, time.Second, time.Millisecond)
+	cancel()
+	require.NoError(t, s.Wait(context.Background()))
+}
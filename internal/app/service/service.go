@@ -29,7 +29,7 @@ func SignUserID(id uint64) (string, error) {
 	buf := make([]byte, 8)
 	binary.BigEndian.PutUint64(buf, id)
 
-	h := hmac.New(sha256.New, server.Cfg.SecretKey)
+	h := hmac.New(sha256.New, []byte(server.Cfg.SecretKey))
 	if _, err := h.Write(buf); err != nil {
 		return "", err
 	}
@@ -45,7 +45,7 @@ func ValidUserID(src string, userID *uint64) bool {
 	}
 
 	*userID = binary.BigEndian.Uint64(data[:8])
-	h := hmac.New(sha256.New, server.Cfg.SecretKey)
+	h := hmac.New(sha256.New, []byte(server.Cfg.SecretKey))
 	h.Write(data[:8])
 	sign := h.Sum(nil)
 
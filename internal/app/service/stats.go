@@ -0,0 +1,29 @@
+package service
+
+import (
+	"github.com/romm80/shortener.git/internal/app/models"
+)
+
+// DateLayout - layout of the day in the click statistics
+const DateLayout = "2006-01-02"
+
+// AggregateClicks returns the total number of clicks and per-day breakdown in UTC ordered by date
+func AggregateClicks(clicks []models.Click) models.LinkStats {
+	stats := models.LinkStats{Days: make([]models.DayStats, 0)}
+	for _, click := range clicks {
+		stats.Total++
+		date := click.Time.UTC().Format(DateLayout)
+		i := len(stats.Days) - 1
+		for i >= 0 && stats.Days[i].Date > date {
+			i--
+		}
+		if i >= 0 && stats.Days[i].Date == date {
+			stats.Days[i].Clicks++
+			continue
+		}
+		stats.Days = append(stats.Days, models.DayStats{})
+		copy(stats.Days[i+2:], stats.Days[i+1:])
+		stats.Days[i+1] = models.DayStats{Date: date, Clicks: 1}
+	}
+	return stats
+}
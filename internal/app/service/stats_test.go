@@ -0,0 +1,31 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/romm80/shortener.git/internal/app/models"
+)
+
+func TestAggregateClicks(t *testing.T) {
+	day := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	clicks := []models.Click{
+		{Time: day},
+		{Time: day.Add(time.Hour)},
+		{Time: day.AddDate(0, 0, 1)},
+		{Time: day.AddDate(0, 0, -1)},
+	}
+
+	stats := AggregateClicks(clicks)
+
+	assert.Equal(t, models.LinkStats{
+		Total: 4,
+		Days: []models.DayStats{
+			{Date: "2022-05-31", Clicks: 1},
+			{Date: "2022-06-01", Clicks: 2},
+			{Date: "2022-06-02", Clicks: 1},
+		},
+	}, stats)
+}
@@ -0,0 +1,14 @@
+package service
+
+import (
+	"context"
+	"time"
+)
+
+// WithTimeout returns a context of the storage operation, zero timeout keeps only the parent context deadline
+func WithTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
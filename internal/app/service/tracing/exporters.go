@@ -0,0 +1,76 @@
+package tracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Exporter names of the configuration
+const (
+	ExporterNone   = ""       // spans are not exported
+	ExporterStdout = "stdout" // JSON lines written to stdout
+	ExporterFile   = "file"   // JSON lines appended to the file
+)
+
+// WriterExporter writes every span as a JSON line
+type WriterExporter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	closer io.Closer // nil - the writer is not closed
+}
+
+// NewWriterExporter returns the exporter writing to w, the writer is not closed by the exporter
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{mu: &sync.Mutex{}, w: w}
+}
+
+// NewFileExporter returns the exporter appending to the file, the file is created if it does not exist
+func NewFileExporter(path string) (*WriterExporter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &WriterExporter{mu: &sync.Mutex{}, w: file, closer: file}, nil
+}
+
+func (e *WriterExporter) Export(span SpanData) error {
+	line, err := json.Marshal(span)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.w.Write(line)
+	return err
+}
+
+func (e *WriterExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closer == nil {
+		return nil
+	}
+	err := e.closer.Close()
+	e.closer = nil
+	return err
+}
+
+// NewExporter returns the exporter by the configured name, nil for ExporterNone
+func NewExporter(name, path string) (Exporter, error) {
+	switch name {
+	case ExporterNone:
+		return nil, nil
+	case ExporterStdout:
+		return NewWriterExporter(os.Stdout), nil
+	case ExporterFile:
+		return NewFileExporter(path)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", name)
+	}
+}
@@ -0,0 +1,285 @@
+// Package tracing implements trace spans propagated by the W3C traceparent header and exported as JSON lines
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/romm80/shortener.git/internal/app/logger"
+)
+
+// TraceID - 16 bytes trace identifier
+type TraceID [16]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+// IsValid reports whether the id is not zero
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+
+// SpanID - 8 bytes span identifier
+type SpanID [8]byte
+
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+// IsValid reports whether the id is not zero
+func (s SpanID) IsValid() bool { return s != SpanID{} }
+
+// SpanContext identifies the span across process boundaries
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid reports whether the trace and the span ids are set
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent formats the span context as the traceparent header value
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent parses the traceparent header value, version 00 and future versions are accepted
+func ParseTraceparent(value string) (SpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}, fmt.Errorf("invalid traceparent %q", value)
+	}
+	var sc SpanContext
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || len(version) != 1 {
+		return SpanContext{}, fmt.Errorf("invalid traceparent version %q", parts[0])
+	}
+	if err := decodeHex(sc.TraceID[:], parts[1]); err != nil || !sc.TraceID.IsValid() {
+		return SpanContext{}, fmt.Errorf("invalid trace id %q", parts[1])
+	}
+	if err := decodeHex(sc.SpanID[:], parts[2]); err != nil || !sc.SpanID.IsValid() {
+		return SpanContext{}, fmt.Errorf("invalid parent id %q", parts[2])
+	}
+	var flags [1]byte
+	if err := decodeHex(flags[:], parts[3]); err != nil {
+		return SpanContext{}, fmt.Errorf("invalid trace flags %q", parts[3])
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+// decodeHex decodes the lowercase hex string of the exact length of dst
+func decodeHex(dst []byte, s string) error {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return fmt.Errorf("invalid length or case")
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err
+}
+
+// SpanData finished span passed to the exporter
+type SpanData struct {
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	ParentID   string                 `json:"parent_id,omitempty"`
+	Name       string                 `json:"name"`
+	Start      time.Time              `json:"start"`
+	End        time.Time              `json:"end"`
+	Duration   float64                `json:"duration_ms"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+// Exporter receives the finished sampled spans
+type Exporter interface {
+	Export(span SpanData) error
+	Close() error
+}
+
+// Tracer creates spans and passes the finished ones to the exporter
+type Tracer struct {
+	exporter Exporter // nil - spans are propagated but not exported
+}
+
+// NewTracer returns the tracer exporting spans, nil exporter - spans are not exported
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+// Close closes the exporter
+func (t *Tracer) Close() error {
+	if t.exporter == nil {
+		return nil
+	}
+	return t.exporter.Close()
+}
+
+var (
+	defaultMu     = &sync.RWMutex{}
+	defaultTracer = NewTracer(nil)
+)
+
+// Default returns the tracer of the process
+func Default() *Tracer {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultTracer
+}
+
+// SetDefault replaces the tracer of the process
+func SetDefault(t *Tracer) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultTracer = t
+}
+
+// Span operation of the trace
+type Span struct {
+	tracer   *Tracer
+	context  SpanContext
+	parentID SpanID
+	name     string
+	start    time.Time
+
+	mu         *sync.Mutex
+	attributes map[string]interface{}
+	err        string
+	ended      bool
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// ContextWithRemote returns the context with the span context received from the caller,
+// the next span started from the context becomes its child
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// SpanFromContext returns the current span of the context, nil if the context has none
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// SpanContextFromContext returns the span context of the current or the remote span of the context
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.context
+	}
+	sc, _ := ctx.Value(remoteKey{}).(SpanContext)
+	return sc
+}
+
+// Start starts the span of the default tracer
+func Start(ctx context.Context, name string, kv ...interface{}) (context.Context, *Span) {
+	return Default().Start(ctx, name, kv...)
+}
+
+// Start starts the child span of the context span or the root span of a new trace,
+// the returned context carries the span. A new trace is sampled
+func (t *Tracer) Start(ctx context.Context, name string, kv ...interface{}) (context.Context, *Span) {
+	span := &Span{
+		tracer: t,
+		name:   name,
+		start:  time.Now(),
+		mu:     &sync.Mutex{},
+	}
+	parent := SpanContextFromContext(ctx)
+	if parent.IsValid() {
+		span.context.TraceID = parent.TraceID
+		span.context.Sampled = parent.Sampled
+		span.parentID = parent.SpanID
+	} else {
+		rand.Read(span.context.TraceID[:])
+		span.context.Sampled = true
+	}
+	rand.Read(span.context.SpanID[:])
+	span.SetAttributes(kv...)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Context returns the span context to propagate
+func (s *Span) Context() SpanContext {
+	return s.context
+}
+
+// SetName replaces the span name, e.g. when the route becomes known
+func (s *Span) SetName(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = name
+}
+
+// SetAttributes adds the key-value pairs to the span
+func (s *Span) SetAttributes(kv ...interface{}) {
+	if len(kv) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.attributes == nil {
+		s.attributes = make(map[string]interface{}, len(kv)/2)
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		value := kv[i+1]
+		switch v := value.(type) {
+		case error:
+			value = v.Error()
+		case fmt.Stringer:
+			value = v.String()
+		}
+		s.attributes[fmt.Sprint(kv[i])] = value
+	}
+}
+
+// SetError marks the span failed, nil error is ignored
+func (s *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+// End finishes the span and exports it if the trace is sampled, the second call is ignored
+func (s *Span) End() {
+	end := time.Now()
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	data := SpanData{
+		TraceID:    s.context.TraceID.String(),
+		SpanID:     s.context.SpanID.String(),
+		Name:       s.name,
+		Start:      s.start,
+		End:        end,
+		Duration:   float64(end.Sub(s.start)) / float64(time.Millisecond),
+		Attributes: s.attributes,
+		Error:      s.err,
+	}
+	if s.parentID.IsValid() {
+		data.ParentID = s.parentID.String()
+	}
+	s.mu.Unlock()
+
+	if s.tracer.exporter == nil || !s.context.Sampled {
+		return
+	}
+	// a failed export must not fail the traced operation
+	if err := s.tracer.exporter.Export(data); err != nil {
+		logger.Default().Warn("span export failed", "span", data.Name, "error", err)
+	}
+}
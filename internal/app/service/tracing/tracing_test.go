@@ -0,0 +1,88 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		sampled bool
+		wantErr bool
+	}{
+		{name: "sampled", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sampled: true},
+		{name: "not sampled", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"},
+		{name: "future version", value: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", sampled: true},
+		{name: "extra fields of version 00", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", wantErr: true},
+		{name: "invalid version", value: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", wantErr: true},
+		{name: "zero trace id", value: "00-00000000000000000000000000000000-00f067aa0ba902b7-01", wantErr: true},
+		{name: "zero parent id", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", wantErr: true},
+		{name: "uppercase", value: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", wantErr: true},
+		{name: "short", value: "00-4bf92f35-00f067aa0ba902b7-01", wantErr: true},
+		{name: "empty", value: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, err := ParseTraceparent(tt.value)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+			assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+			assert.Equal(t, tt.sampled, sc.Sampled)
+			if tt.value[:2] == "00" {
+				assert.Equal(t, tt.value, sc.Traceparent())
+			}
+		})
+	}
+}
+
+func TestTracer(t *testing.T) {
+	buf := &bytes.Buffer{}
+	tracer := NewTracer(NewWriterExporter(buf))
+
+	remote, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.NoError(t, err)
+	ctx, root := tracer.Start(ContextWithRemote(context.Background(), remote), "root", "key", "value")
+	_, child := tracer.Start(ctx, "child")
+	child.SetError(errors.New("boom"))
+	child.End()
+	child.End()
+	root.End()
+
+	ctx = ContextWithRemote(context.Background(), SpanContext{TraceID: remote.TraceID, SpanID: remote.SpanID})
+	_, unsampled := tracer.Start(ctx, "unsampled")
+	unsampled.End()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	var childData, rootData SpanData
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &childData))
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &rootData))
+
+	assert.Equal(t, "child", childData.Name)
+	assert.Equal(t, "boom", childData.Error)
+	assert.Equal(t, rootData.SpanID, childData.ParentID)
+	assert.Equal(t, remote.TraceID.String(), childData.TraceID)
+
+	assert.Equal(t, "root", rootData.Name)
+	assert.Equal(t, remote.SpanID.String(), rootData.ParentID)
+	assert.Equal(t, remote.TraceID.String(), rootData.TraceID)
+	assert.Equal(t, "value", rootData.Attributes["key"])
+
+	_, newRoot := tracer.Start(context.Background(), "new")
+	assert.True(t, newRoot.Context().IsValid())
+	assert.True(t, newRoot.Context().Sampled)
+	assert.NotEqual(t, remote.TraceID, newRoot.Context().TraceID)
+}
@@ -0,0 +1,98 @@
+package workers
+
+import (
+	"context"
+	"time"
+
+	"github.com/romm80/shortener.git/internal/app/logger"
+	"github.com/romm80/shortener.git/internal/app/models"
+	"github.com/romm80/shortener.git/internal/app/repositories"
+	"github.com/romm80/shortener.git/internal/app/server"
+	"github.com/romm80/shortener.git/internal/app/service"
+)
+
+const (
+	clicksBatchSize     = 100         // maximum number of clicks written at once
+	clicksFlushInterval = time.Second // period of writing accumulated clicks
+)
+
+// ClickWorker asynchronous redirect events recorder
+type ClickWorker struct {
+	Clicks       chan models.Click // channel of redirect events
+	BatchTimeout time.Duration     // limit of a batch write, 0 - no limit
+
+	done chan struct{} // closed when the clicks are written after the context is cancelled
+}
+
+// NewClickWorker worker initialization
+func NewClickWorker(size int) *ClickWorker {
+	return &ClickWorker{
+		Clicks:       make(chan models.Click, size),
+		BatchTimeout: server.Cfg.StorageBatchTimeout,
+		done:         make(chan struct{}),
+	}
+}
+
+// Run starts a worker, clicks are written in batches.
+// Accumulated and queued clicks are written once more after the context is cancelled
+func (r *ClickWorker) Run(ctx context.Context, stats repositories.Stats) {
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(clicksFlushInterval)
+		defer ticker.Stop()
+
+		batch := make([]models.Click, 0, clicksBatchSize)
+		flush := func(ctx context.Context) {
+			if len(batch) == 0 {
+				return
+			}
+			ctx, cancel := service.WithTimeout(ctx, r.BatchTimeout)
+			defer cancel()
+			if err := stats.AddClicks(ctx, batch); err != nil {
+				logger.Default().Error("clicks are not stored", "count", len(batch), "error", err)
+			}
+			batch = make([]models.Click, 0, clicksBatchSize)
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				// the worker is the only reader, queued clicks are received without blocking
+				for len(r.Clicks) > 0 {
+					batch = append(batch, <-r.Clicks)
+					if len(batch) == clicksBatchSize {
+						flush(context.Background())
+					}
+				}
+				flush(context.Background())
+				return
+			case click := <-r.Clicks:
+				batch = append(batch, click)
+				if len(batch) == clicksBatchSize {
+					flush(ctx)
+				}
+			case <-ticker.C:
+				flush(ctx)
+			}
+		}
+	}()
+}
+
+// Add adds a redirect event to a channel without blocking, the event is dropped if the channel is full
+func (r *ClickWorker) Add(click models.Click) {
+	select {
+	case r.Clicks <- click:
+	default:
+		logger.Default().Warn("click dropped: queue is full", "url_id", click.URLID)
+	}
+}
+
+// Wait waits until the stopped worker writes the remaining clicks
+func (r *ClickWorker) Wait(ctx context.Context) error {
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,36 @@
+package workers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/romm80/shortener.git/internal/app/models"
+	"github.com/romm80/shortener.git/internal/app/repositories/mapstorage"
+	"github.com/romm80/shortener.git/internal/app/server"
+)
+
+func TestClickWorker_Wait(t *testing.T) {
+	server.Cfg.FileStorage = ""
+	storage, err := mapstorage.New()
+	require.NoError(t, err)
+	urlID, err := storage.Add(context.Background(), "https://go.dev/", 1, nil)
+	require.NoError(t, err)
+
+	worker := NewClickWorker(10)
+	ctx, cancel := context.WithCancel(context.Background())
+	// the clicks are queued before the worker starts, so only the final flush writes them
+	for i := 0; i < 3; i++ {
+		worker.Add(models.Click{URLID: urlID, Time: time.Now()})
+	}
+	cancel()
+	worker.Run(ctx, storage)
+	require.NoError(t, worker.Wait(context.Background()))
+
+	stats, err := storage.GetStats(context.Background(), urlID, 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), stats.Total)
+}
@@ -2,48 +2,418 @@
 package workers
 
 import (
-	"log"
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
 
+	"github.com/romm80/shortener.git/internal/app"
+	"github.com/romm80/shortener.git/internal/app/logger"
+	"github.com/romm80/shortener.git/internal/app/models"
 	"github.com/romm80/shortener.git/internal/app/repositories"
+	"github.com/romm80/shortener.git/internal/app/server"
+	"github.com/romm80/shortener.git/internal/app/service"
+	"github.com/romm80/shortener.git/internal/app/service/tracing"
+)
+
+// deleteKind - queue messages kind of the delete tasks
+const deleteKind = "delete_urls"
+
+const (
+	defaultDeleteQueueSize = 1000             // tasks queue size if it is not configured
+	defaultDeleteWorkers   = 1                // number of workers if it is not configured
+	defaultPollInterval    = time.Second      // period of checking the queue for retried and redelivered tasks without the window
+	defaultVisibility      = time.Minute      // visibility timeout if it is not configured
+	defaultMaxAttempts     = 10               // number of attempts if it is not configured
+	defaultRetryBackoff    = time.Second      // first retry delay if it is not configured
+	maxRetryBackoff        = 10 * time.Minute // limit of the retry delay
+	dequeueLimit           = 100              // number of tasks leased at once
 )
 
 // Task - task to remove links
 type Task struct {
-	UrlsID []string // list of shortened links IDs to remove
-	UserID uint64   // user id
+	JobID     string   `json:"job_id"`                // id of the job tracking the task
+	UrlsID    []string `json:"urls_id"`               // list of shortened links IDs to remove
+	UserID    uint64   `json:"user_id"`               // user id
+	RequestID string   `json:"request_id,omitempty"`  // id of the request which added the task
+	Trace     string   `json:"traceparent,omitempty"` // span of the request which added the task
+}
+
+// logger returns the logger adding the task request and job to every line
+func (t Task) logger() *logger.Logger {
+	l := logger.Default().With("job_id", t.JobID)
+	if t.RequestID != "" {
+		l = l.With("request_id", t.RequestID)
+	}
+	return l
+}
+
+// deleteBatch coalesced tasks of the user
+type deleteBatch struct {
+	userID   uint64
+	urlsID   []string
+	tasks    []Task
+	messages []models.QueueMessage // queue messages of the tasks
+}
+
+// start starts the span of the batch with the context carrying the request id and the trace of its tasks.
+// The batch of the single request continues its trace
+func (b deleteBatch) start() (context.Context, *tracing.Span) {
+	ctx := context.Background()
+	ids := distinct(b.tasks, func(t Task) string { return t.RequestID })
+	switch len(ids) {
+	case 0:
+	case 1:
+		ctx = logger.WithRequestID(ctx, ids[0])
+	default:
+		// coalesced tasks of several requests
+		ctx = logger.WithContext(ctx, logger.Default().With("request_ids", ids))
+	}
+
+	traces := distinct(b.tasks, func(t Task) string { return t.Trace })
+	if len(traces) == 1 {
+		if parent, err := tracing.ParseTraceparent(traces[0]); err == nil {
+			ctx = tracing.ContextWithRemote(ctx, parent)
+		}
+	}
+	ctx, span := tracing.Start(ctx, "delete_worker.batch",
+		"user_id", b.userID, "tasks", len(b.tasks), "urls", len(b.urlsID))
+	if len(traces) > 1 {
+		span.SetAttributes("linked_traces", traces)
+	}
+	return ctx, span
+}
+
+// distinct returns the non-empty distinct values of the tasks field in order
+func distinct(tasks []Task, field func(Task) string) []string {
+	values := make([]string, 0, len(tasks))
+	seen := make(map[string]bool, len(tasks))
+	for _, task := range tasks {
+		if v := field(task); v != "" && !seen[v] {
+			seen[v] = true
+			values = append(values, v)
+		}
+	}
+	return values
 }
 
-// DeleteWorker link remover worker
+// DeleteWorker pool of link removers.
+// Tasks are kept in the durable queue until they are processed, a task is delivered at least once.
+// Tasks of the user queued within the window are coalesced into one storage call
 type DeleteWorker struct {
-	Tasks chan Task // канал задач удаляемых ссылок
+	Queue       repositories.Queue
+	Jobs        *Jobs         // deletion jobs
+	QueueSize   int           // number of queued tasks after which new tasks are rejected
+	Workers     int           // number of concurrent storage calls
+	Window      time.Duration // period of coalescing tasks, 0 - every task is processed immediately
+	Visibility  time.Duration // period after which a task which is not processed is delivered again
+	MaxAttempts int           // number of deliveries after which the failing task is dropped
+	Backoff     time.Duration // delay before the first retry, doubled on every next retry
+
+	ReadTimeout  time.Duration // limit of a queue read, 0 - no limit
+	WriteTimeout time.Duration // limit of a queue write, 0 - no limit
+	BatchTimeout time.Duration // limit of a storage delete call, 0 - no limit
+
+	mu      *sync.RWMutex
+	stopped bool          // new tasks are not accepted
+	wake    chan struct{} // signals a new task
+	done    chan struct{} // closed when all delivered tasks are processed
 }
 
-// NewDeleteWorker worker initialization
-func NewDeleteWorker(size int) *DeleteWorker {
-	return &DeleteWorker{
-		Tasks: make(chan Task, size),
+// NewDeleteWorker worker initialization, zero settings are replaced by defaults
+func NewDeleteWorker(queue repositories.Queue, jobs repositories.JobStore, size, workers int, window time.Duration) *DeleteWorker {
+	if size <= 0 {
+		size = defaultDeleteQueueSize
+	}
+	if workers <= 0 {
+		workers = defaultDeleteWorkers
+	}
+	r := &DeleteWorker{
+		Queue:       queue,
+		Jobs:        NewJobs(jobs),
+		QueueSize:   size,
+		Workers:     workers,
+		Window:      window,
+		Visibility:  server.Cfg.QueueVisibilityTimeout,
+		MaxAttempts: server.Cfg.QueueMaxAttempts,
+		Backoff:     server.Cfg.QueueRetryBackoff,
+
+		ReadTimeout:  server.Cfg.StorageReadTimeout,
+		WriteTimeout: server.Cfg.StorageWriteTimeout,
+		BatchTimeout: server.Cfg.StorageBatchTimeout,
+
+		mu:   &sync.RWMutex{},
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	if r.Visibility <= 0 {
+		r.Visibility = defaultVisibility
+	}
+	if r.MaxAttempts <= 0 {
+		r.MaxAttempts = defaultMaxAttempts
 	}
+	if r.Backoff <= 0 {
+		r.Backoff = defaultRetryBackoff
+	}
+	return r
 }
 
-// Run starts a worker
-func (r *DeleteWorker) Run(storage repositories.Shortener) {
+// Run starts the pool. After the context is cancelled new tasks are rejected,
+// available tasks are processed and Wait returns. Tasks waiting for retry stay in the queue
+func (r *DeleteWorker) Run(ctx context.Context, storage repositories.Shortener) {
+	batches := make(chan deleteBatch)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < r.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				r.delete(storage, batch)
+			}
+		}()
+	}
+
 	go func() {
-		for {
-			for task := range r.Tasks {
-				if err := storage.DeleteBatch(task.UserID, task.UrlsID); err != nil {
-					log.Println(err)
-				}
+		r.dispatch(ctx, batches)
+		close(batches)
+		wg.Wait()
+		close(r.done)
+	}()
+}
+
+// dispatch polls the queue and passes the tasks to the workers until the context is cancelled
+func (r *DeleteWorker) dispatch(ctx context.Context, batches chan<- deleteBatch) {
+	interval := r.Window
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// tasks left from the previous run
+	r.poll(batches)
+	for {
+		select {
+		case <-ctx.Done():
+			r.mu.Lock()
+			r.stopped = true
+			r.mu.Unlock()
+			r.poll(batches)
+			return
+		case <-r.wake:
+			if r.Window <= 0 {
+				r.poll(batches)
 			}
+		case <-ticker.C:
+			r.poll(batches)
 		}
-	}()
+	}
 }
 
-// Add add a delete task to a channel
-func (r *DeleteWorker) Add(userID uint64, urlsID []string) {
-	go func(userID uint64, urlsID []string) {
-		r.Tasks <- Task{
-			UserID: userID,
-			UrlsID: urlsID,
+// poll leases all available tasks, coalesces them by user and passes them to the workers
+func (r *DeleteWorker) poll(batches chan<- deleteBatch) {
+	for {
+		ctx, cancel := service.WithTimeout(context.Background(), r.ReadTimeout)
+		messages, err := r.Queue.Dequeue(ctx, deleteKind, dequeueLimit, r.Visibility)
+		cancel()
+		if err != nil {
+			logger.Default().Error("delete tasks dequeue failed", "error", err)
+			return
+		}
+
+		pending := make(map[uint64]*deleteBatch)
+		order := make([]uint64, 0)
+		for _, m := range messages {
+			var task Task
+			if err := json.Unmarshal(m.Payload, &task); err != nil {
+				logger.Default().Error("malformed delete task", "message_id", m.ID, "error", err)
+				r.ack(m, task)
+				continue
+			}
+			batch, ok := pending[task.UserID]
+			if !ok {
+				batch = &deleteBatch{userID: task.UserID}
+				pending[task.UserID] = batch
+				order = append(order, task.UserID)
+			}
+			batch.urlsID = append(batch.urlsID, task.UrlsID...)
+			batch.tasks = append(batch.tasks, task)
+			batch.messages = append(batch.messages, m)
+		}
+		for _, userID := range order {
+			batches <- *pending[userID]
+		}
+
+		if len(messages) < dequeueLimit {
+			return
 		}
-	}(userID, urlsID)
+	}
+}
+
+// delete removes links of the batch, the storage call is not bound to the pool context to let it drain
+func (r *DeleteWorker) delete(storage repositories.Shortener, batch deleteBatch) {
+	ctx, span := batch.start()
+	defer span.End()
+
+	r.updateJobs(ctx, batch.tasks, func(_ int, job *models.DeleteJob) {
+		job.Status = models.JobRunning
+	})
+
+	deleteCtx, cancel := service.WithTimeout(ctx, r.BatchTimeout)
+	deleted, err := storage.DeleteBatch(deleteCtx, batch.userID, batch.urlsID)
+	cancel()
+	span.SetError(err)
+	if err != nil {
+		logger.FromContext(ctx).Error("delete failed", "user_id", batch.userID, "deleted", len(deleted), "error", err)
+	}
+
+	// links deleted before the failure are recorded before the retry, the next attempt does not find them
+	own := claim(batch.tasks, deleted)
+	r.updateJobs(ctx, batch.tasks, func(i int, job *models.DeleteJob) {
+		progress(job, own[i])
+		switch {
+		case err == nil:
+			finish(job, nil)
+		case batch.messages[i].Attempts >= r.MaxAttempts:
+			finish(job, err)
+		default:
+			job.Status = models.JobPending
+			job.Error = err.Error()
+		}
+	})
+
+	for i, task := range batch.tasks {
+		if err != nil {
+			r.retry(batch.messages[i], task, err)
+			continue
+		}
+		task.logger().Debug("delete task finished", "deleted", len(own[i]))
+		r.ack(batch.messages[i], task)
+	}
+}
+
+// claim splits the deleted links between the tasks, a link requested by several tasks is deleted by the first one
+func claim(tasks []Task, deleted []string) [][]string {
+	unclaimed := make(map[string]struct{}, len(deleted))
+	for _, urlID := range deleted {
+		unclaimed[urlID] = struct{}{}
+	}
+	own := make([][]string, len(tasks))
+	for i, task := range tasks {
+		own[i] = make([]string, 0, len(task.UrlsID))
+		for _, urlID := range task.UrlsID {
+			if _, ok := unclaimed[urlID]; ok {
+				delete(unclaimed, urlID)
+				own[i] = append(own[i], urlID)
+			}
+		}
+	}
+	return own
+}
+
+// updateJobs changes the jobs of the tasks, the tasks are processed even if the jobs are not stored
+func (r *DeleteWorker) updateJobs(ctx context.Context, tasks []Task, change func(i int, job *models.DeleteJob)) {
+	ctx, cancel := service.WithTimeout(ctx, r.WriteTimeout)
+	defer cancel()
+	if err := r.Jobs.Update(ctx, tasks, change); err != nil {
+		logger.FromContext(ctx).Error("delete jobs update failed", "error", err)
+	}
+}
+
+// retry returns the failed task to the queue with exponential backoff, the task of the last attempt is dropped
+func (r *DeleteWorker) retry(m models.QueueMessage, task Task, err error) {
+	if m.Attempts >= r.MaxAttempts {
+		task.logger().Error("delete task dropped", "attempts", m.Attempts, "error", err)
+		r.ack(m, task)
+		return
+	}
+
+	backoff := r.Backoff
+	for i := 1; i < m.Attempts && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	task.logger().Warn("delete task retried", "attempts", m.Attempts, "backoff", backoff, "error", err)
+
+	ctx, cancel := service.WithTimeout(context.Background(), r.WriteTimeout)
+	defer cancel()
+	if err := r.Queue.Retry(ctx, m.ID, time.Now().Add(backoff), err.Error()); err != nil {
+		// the task is delivered again after the visibility timeout
+		task.logger().Error("delete task retry failed", "error", err)
+	}
+}
+
+// ack removes the processed task from the queue
+func (r *DeleteWorker) ack(m models.QueueMessage, task Task) {
+	ctx, cancel := service.WithTimeout(context.Background(), r.WriteTimeout)
+	defer cancel()
+	if err := r.Queue.Ack(ctx, m.ID); err != nil {
+		// the task is delivered again after the visibility timeout, the job result is kept
+		task.logger().Error("delete task ack failed", "error", err)
+	}
+}
+
+// Add add a delete task to the queue and returns the job tracking it.
+// app.ErrQueueFull is returned if the queue is full or the pool is stopped
+func (r *DeleteWorker) Add(ctx context.Context, userID uint64, urlsID []string) (models.DeleteJob, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.stopped {
+		return models.DeleteJob{}, app.ErrQueueFull
+	}
+	job, err := r.Jobs.Create(ctx, userID, urlsID)
+	if err != nil {
+		return job, err
+	}
+	task := Task{
+		JobID:     job.ID,
+		UserID:    userID,
+		UrlsID:    urlsID,
+		RequestID: logger.RequestID(ctx),
+	}
+	if sc := tracing.SpanContextFromContext(ctx); sc.IsValid() {
+		task.Trace = sc.Traceparent()
+	}
+	payload, err := json.Marshal(task)
+	if err != nil {
+		r.forget(job.ID)
+		return models.DeleteJob{}, err
+	}
+	if _, err := r.Queue.Enqueue(ctx, deleteKind, payload, r.QueueSize); err != nil {
+		r.forget(job.ID)
+		return models.DeleteJob{}, err
+	}
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// forget removes the job of the task which is not queued, the request context may be already cancelled
+func (r *DeleteWorker) forget(id string) {
+	ctx, cancel := service.WithTimeout(context.Background(), r.WriteTimeout)
+	defer cancel()
+	if err := r.Jobs.Remove(ctx, id); err != nil {
+		logger.Default().Error("delete job remove failed", "job_id", id, "error", err)
+	}
+}
+
+// Pending returns the number of queued tasks
+func (r *DeleteWorker) Pending(ctx context.Context) (int, error) {
+	return r.Queue.Pending(ctx, deleteKind)
+}
+
+// Wait waits until the stopped pool processes delivered tasks
+func (r *DeleteWorker) Wait(ctx context.Context) error {
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
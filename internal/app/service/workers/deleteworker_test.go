@@ -0,0 +1,141 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/romm80/shortener.git/internal/app"
+	"github.com/romm80/shortener.git/internal/app/models"
+	"github.com/romm80/shortener.git/internal/app/repositories"
+	"github.com/romm80/shortener.git/internal/app/repositories/jobqueue"
+	"github.com/romm80/shortener.git/internal/app/repositories/mapstorage"
+	"github.com/romm80/shortener.git/internal/app/server"
+)
+
+// countingStorage counts storage deletion calls, the first failures calls return an error.
+// A partial failure deletes the first link before the error
+type countingStorage struct {
+	repositories.Shortener
+	calls    int32
+	failures int32
+	partial  bool
+}
+
+func (s *countingStorage) DeleteBatch(ctx context.Context, userID uint64, urlsID []string) ([]string, error) {
+	if atomic.AddInt32(&s.calls, 1) <= s.failures {
+		if !s.partial {
+			return nil, errors.New("storage is unavailable")
+		}
+		deleted, err := s.Shortener.DeleteBatch(ctx, userID, urlsID[:1])
+		if err != nil {
+			return nil, err
+		}
+		return deleted, errors.New("storage is unavailable")
+	}
+	return s.Shortener.DeleteBatch(ctx, userID, urlsID)
+}
+
+func newTestStorage(t *testing.T, failures int32) (*countingStorage, []string) {
+	server.Cfg.FileStorage = ""
+	db, err := mapstorage.New()
+	require.NoError(t, err)
+	storage := &countingStorage{Shortener: db, failures: failures}
+
+	var urls []string
+	for _, originURL := range []string{"https://www.google.com/", "https://yandex.ru/", "https://go.dev/"} {
+		urlID, err := storage.Add(context.Background(), originURL, 1, nil)
+		require.NoError(t, err)
+		urls = append(urls, urlID)
+	}
+	return storage, urls
+}
+
+func TestDeleteWorker_Coalesce(t *testing.T) {
+	storage, urls := newTestStorage(t, 0)
+	queue, err := jobqueue.New("")
+	require.NoError(t, err)
+
+	worker := NewDeleteWorker(queue, queue, 2, 2, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	worker.Run(ctx, storage)
+
+	first, err := worker.Add(context.Background(), 1, urls[:2])
+	require.NoError(t, err)
+	second, err := worker.Add(context.Background(), 1, urls[1:])
+	require.NoError(t, err)
+	_, err = worker.Add(context.Background(), 1, urls)
+	assert.ErrorIs(t, err, app.ErrQueueFull)
+
+	cancel()
+	require.NoError(t, worker.Wait(context.Background()))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&storage.calls))
+
+	job, err := worker.Jobs.Get(context.Background(), first.ID, 1)
+	require.NoError(t, err)
+	assert.Equal(t, models.JobSucceeded, job.Status)
+	assert.Equal(t, urls[:2], job.Deleted)
+	job, err = worker.Jobs.Get(context.Background(), second.ID, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{urls[2]}, job.Deleted)
+	assert.Equal(t, []string{urls[1]}, job.Skipped)
+
+	messages, err := queue.Dequeue(context.Background(), deleteKind, 0, time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, messages)
+}
+
+func TestDeleteWorker_Retry(t *testing.T) {
+	storage, urls := newTestStorage(t, 2)
+	queue, err := jobqueue.New("")
+	require.NoError(t, err)
+
+	worker := NewDeleteWorker(queue, queue, 0, 1, 0)
+	worker.Backoff = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	worker.Run(ctx, storage)
+
+	job, err := worker.Add(context.Background(), 1, urls)
+	require.NoError(t, err)
+
+	// retries are picked up by the poll, which runs every second without the window
+	require.Eventually(t, func() bool {
+		job, err = worker.Jobs.Get(context.Background(), job.ID, 1)
+		require.NoError(t, err)
+		return job.Status == models.JobSucceeded
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, urls, job.Deleted)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&storage.calls))
+}
+
+func TestDeleteWorker_PartialRetry(t *testing.T) {
+	storage, urls := newTestStorage(t, 1)
+	storage.partial = true
+	queue, err := jobqueue.New("")
+	require.NoError(t, err)
+
+	worker := NewDeleteWorker(queue, queue, 0, 1, 0)
+	worker.Backoff = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	worker.Run(ctx, storage)
+
+	job, err := worker.Add(context.Background(), 1, urls)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		job, err = worker.Jobs.Get(context.Background(), job.ID, 1)
+		require.NoError(t, err)
+		return job.Status == models.JobSucceeded
+	}, 5*time.Second, 10*time.Millisecond)
+	// the link deleted by the failed attempt is not reported as skipped
+	assert.Equal(t, urls, job.Deleted)
+	assert.Empty(t, job.Skipped)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&storage.calls))
+}
@@ -0,0 +1,49 @@
+package workers
+
+import (
+	"context"
+	"time"
+
+	"github.com/romm80/shortener.git/internal/app/logger"
+	"github.com/romm80/shortener.git/internal/app/repositories"
+	"github.com/romm80/shortener.git/internal/app/server"
+	"github.com/romm80/shortener.git/internal/app/service"
+	"github.com/romm80/shortener.git/internal/app/service/scheduler"
+)
+
+// ExpireWorker expired links and idempotency keys reaper
+type ExpireWorker struct {
+	Interval     time.Duration // period of marking expired links as deleted
+	BatchTimeout time.Duration // limit of a storage call, 0 - no limit
+}
+
+// NewExpireWorker reaper initialization
+func NewExpireWorker(interval time.Duration) *ExpireWorker {
+	return &ExpireWorker{
+		Interval:     interval,
+		BatchTimeout: server.Cfg.StorageBatchTimeout,
+	}
+}
+
+// Register adds the reaper to the scheduler, zero interval disables it
+func (r *ExpireWorker) Register(s *scheduler.Scheduler, storage repositories.Shortener) {
+	s.Register("expire", r.Interval, func(ctx context.Context) error {
+		return r.expire(ctx, storage)
+	})
+}
+
+// expire marks expired links as deleted and removes expired idempotency keys, a failure of one does not stop the other
+func (r *ExpireWorker) expire(ctx context.Context, storage repositories.Shortener) error {
+	ctx, cancel := service.WithTimeout(ctx, r.BatchTimeout)
+	defer cancel()
+	err := storage.DeleteExpired(ctx)
+	if keys, ok := repositories.Unwrap(storage).(repositories.Idempotency); ok {
+		if keysErr := keys.DeleteExpiredKeys(ctx); keysErr != nil {
+			if err != nil {
+				logger.FromContext(ctx).Error("expired links are not deleted", "error", err)
+			}
+			err = keysErr
+		}
+	}
+	return err
+}
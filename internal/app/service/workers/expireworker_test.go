@@ -0,0 +1,70 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/romm80/shortener.git/internal/app"
+	"github.com/romm80/shortener.git/internal/app/repositories/mapstorage"
+	"github.com/romm80/shortener.git/internal/app/server"
+	"github.com/romm80/shortener.git/internal/app/service/scheduler"
+)
+
+// failingReaper storage failing to delete expired links, counts the expired keys deletions
+type failingReaper struct {
+	*mapstorage.MapStorage
+	keysCalls int
+}
+
+func (s *failingReaper) DeleteExpired(ctx context.Context) error {
+	return errors.New("storage is unavailable")
+}
+
+func (s *failingReaper) DeleteExpiredKeys(ctx context.Context) error {
+	s.keysCalls++
+	return s.MapStorage.DeleteExpiredKeys(ctx)
+}
+
+func TestExpireWorker(t *testing.T) {
+	server.Cfg.FileStorage = ""
+	storage, err := mapstorage.New()
+	require.NoError(t, err)
+
+	past := time.Now().Add(-time.Minute)
+	expiredURL, err := storage.Add(context.Background(), "https://www.google.com/", 1, &past)
+	require.NoError(t, err)
+	liveURL, err := storage.Add(context.Background(), "https://yandex.ru/", 1, nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := scheduler.New(storage)
+	NewExpireWorker(10*time.Millisecond).Register(s, storage)
+	s.Run(ctx)
+
+	require.Eventually(t, func() bool {
+		_, err := storage.Get(context.Background(), expiredURL)
+		return errors.Is(err, app.ErrDeletedURL)
+	}, time.Second, 10*time.Millisecond)
+	_, err = storage.Get(context.Background(), liveURL)
+	assert.NoError(t, err)
+
+	cancel()
+	require.NoError(t, s.Wait(context.Background()))
+}
+
+func TestExpireWorker_Failure(t *testing.T) {
+	server.Cfg.FileStorage = ""
+	storage, err := mapstorage.New()
+	require.NoError(t, err)
+
+	// the links failure is reported, the keys are reaped anyway
+	reaper := &failingReaper{MapStorage: storage}
+	err = NewExpireWorker(time.Minute).expire(context.Background(), reaper)
+	assert.EqualError(t, err, "storage is unavailable")
+	assert.Equal(t, 1, reaper.keysCalls)
+}
@@ -0,0 +1,135 @@
+package workers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/romm80/shortener.git/internal/app"
+	"github.com/romm80/shortener.git/internal/app/models"
+	"github.com/romm80/shortener.git/internal/app/repositories"
+)
+
+// jobRetention - period during which a finished job can be requested
+const jobRetention = 24 * time.Hour
+
+// Jobs registry of the asynchronous jobs, the jobs state is kept alongside the queue
+type Jobs struct {
+	store repositories.JobStore
+}
+
+// NewJobs registry initialization
+func NewJobs(store repositories.JobStore) *Jobs {
+	return &Jobs{store: store}
+}
+
+// Create registers a pending job, finished jobs older than the retention period are forgotten
+func (r *Jobs) Create(ctx context.Context, userID uint64, urlsID []string) (models.DeleteJob, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return models.DeleteJob{}, err
+	}
+	job := models.DeleteJob{
+		ID:        hex.EncodeToString(id),
+		UserID:    userID,
+		Status:    models.JobPending,
+		URLsID:    urlsID,
+		CreatedAt: time.Now(),
+	}
+
+	if err := r.store.RemoveFinishedJobs(ctx, time.Now().Add(-jobRetention)); err != nil {
+		return models.DeleteJob{}, err
+	}
+	if err := r.store.SaveJobs(ctx, job); err != nil {
+		return models.DeleteJob{}, err
+	}
+	return job, nil
+}
+
+// Get returns the job of the user
+func (r *Jobs) Get(ctx context.Context, id string, userID uint64) (models.DeleteJob, error) {
+	job, err := r.store.GetJob(ctx, id)
+	if err != nil {
+		return models.DeleteJob{}, err
+	}
+	if job.UserID != userID {
+		return models.DeleteJob{}, app.ErrJobNotFound
+	}
+	return job, nil
+}
+
+// Remove forgets the job which was not accepted for processing
+func (r *Jobs) Remove(ctx context.Context, id string) error {
+	return r.store.RemoveJob(ctx, id)
+}
+
+// Update applies the change to the jobs of the tasks and stores them at once.
+// Finished jobs are not changed, so a redelivered task does not overwrite the result.
+// A job lost before the tasks are processed is registered again
+func (r *Jobs) Update(ctx context.Context, tasks []Task, change func(i int, job *models.DeleteJob)) error {
+	jobs := make([]models.DeleteJob, 0, len(tasks))
+	for i, task := range tasks {
+		job, err := r.store.GetJob(ctx, task.JobID)
+		if errors.Is(err, app.ErrJobNotFound) {
+			job = models.DeleteJob{
+				ID:        task.JobID,
+				UserID:    task.UserID,
+				Status:    models.JobPending,
+				URLsID:    task.UrlsID,
+				CreatedAt: time.Now(),
+			}
+		} else if err != nil {
+			return err
+		}
+		if job.FinishedAt != nil {
+			continue
+		}
+		change(i, &job)
+		jobs = append(jobs, job)
+	}
+	if len(jobs) == 0 {
+		return nil
+	}
+	return r.store.SaveJobs(ctx, jobs...)
+}
+
+// progress adds the links deleted by the attempt, links deleted by the previous attempts are kept
+func progress(job *models.DeleteJob, deleted []string) {
+	done := make(map[string]struct{}, len(job.Deleted))
+	for _, urlID := range job.Deleted {
+		done[urlID] = struct{}{}
+	}
+	for _, urlID := range deleted {
+		if _, ok := done[urlID]; !ok {
+			done[urlID] = struct{}{}
+			job.Deleted = append(job.Deleted, urlID)
+		}
+	}
+}
+
+// finish records the job result, requested links which are not deleted by any attempt are skipped
+func finish(job *models.DeleteJob, err error) {
+	now := time.Now()
+	job.Error = ""
+	job.FinishedAt = &now
+	if err != nil {
+		job.Status = models.JobFailed
+		job.Error = err.Error()
+		return
+	}
+	job.Status = models.JobSucceeded
+
+	done := make(map[string]struct{}, len(job.Deleted))
+	for _, urlID := range job.Deleted {
+		done[urlID] = struct{}{}
+	}
+	job.Skipped = nil
+	for _, urlID := range job.URLsID {
+		if _, ok := done[urlID]; !ok {
+			done[urlID] = struct{}{}
+			job.Skipped = append(job.Skipped, urlID)
+		}
+	}
+}
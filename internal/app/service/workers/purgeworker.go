@@ -0,0 +1,40 @@
+package workers
+
+import (
+	"context"
+	"time"
+
+	"github.com/romm80/shortener.git/internal/app/repositories"
+	"github.com/romm80/shortener.git/internal/app/server"
+	"github.com/romm80/shortener.git/internal/app/service"
+	"github.com/romm80/shortener.git/internal/app/service/scheduler"
+)
+
+// PurgeWorker permanently removes links deleted longer than the retention period ago
+type PurgeWorker struct {
+	Interval     time.Duration // period of purging the trash
+	Retention    time.Duration // period during which deleted links can be restored
+	BatchTimeout time.Duration // limit of a storage call, 0 - no limit
+}
+
+// NewPurgeWorker worker initialization
+func NewPurgeWorker(interval, retention time.Duration) *PurgeWorker {
+	return &PurgeWorker{
+		Interval:     interval,
+		Retention:    retention,
+		BatchTimeout: server.Cfg.StorageBatchTimeout,
+	}
+}
+
+// Register adds the worker to the scheduler, zero interval disables it
+func (r *PurgeWorker) Register(s *scheduler.Scheduler, storage repositories.Shortener) {
+	s.Register("purge", r.Interval, func(ctx context.Context) error {
+		return r.purge(ctx, storage)
+	})
+}
+
+func (r *PurgeWorker) purge(ctx context.Context, storage repositories.Shortener) error {
+	ctx, cancel := service.WithTimeout(ctx, r.BatchTimeout)
+	defer cancel()
+	return storage.PurgeDeleted(ctx, time.Now().Add(-r.Retention))
+}